@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type AdminCmd int
+type GameControl int
+
+var (
+	// World admin commands
+	AdminCmdListGames    = AdminCmd(0)
+	AdminCmdKickPlayer   = AdminCmd(1)
+	AdminCmdNotice       = AdminCmd(2)
+	AdminCmdMutePlayer   = AdminCmd(3)
+	AdminCmdUnmutePlayer = AdminCmd(4)
+	// Game controls
+	GameControlPause  = GameControl(0)
+	GameControlResume = GameControl(1)
+	GameControlStop   = GameControl(2)
+	GameControlDrain  = GameControl(3) // Ends the game after the current round
+)
+
+// Request from the admin API to the world. The reply is sent on the
+// request's reply channel.
+type AdminRequest struct {
+	Command  AdminCmd
+	PlayerId PlayerId
+	Notice   string
+	Reply    chan *AdminReply
+}
+
+type AdminReply struct {
+	Games []*Game
+	Err   error
+}
+
+// Summary of a game's state, listed by the admin API
+type GameSummary struct {
+	Id            uint64
+	Type          string
+	State         string
+	Round         int
+	NumPlayers    int
+	NumSpectators int
+	MaxPlayers    int
+	Uptime        int64 // Seconds since the game was created
+}
+
+// Complete state of a game, inspected with the admin API
+type GameInspection struct {
+	GameSummary
+	Seed       int64
+	Tick       uint64
+	Seq        uint64
+	Players    []AdminPlayerInfo
+	Spectators []AdminPlayerInfo
+	Entities   []MsgPartEntity
+}
+
+type AdminPlayerInfo struct {
+	Id        PlayerId
+	Name      string
+	Score     int
+	SelcColor EntityColor
+	Selected  []EntityId
+}
+
+// Returns the name of the game state
+func (s GameState) String() string {
+	switch s {
+	case GameStateRunning:
+		return "running"
+	case GameStateCountdown:
+		return "countdown"
+	case GameStateStopped:
+		return "stopped"
+	case GameStateEnded:
+		return "results"
+	case GameStatePaused:
+		return "paused"
+	}
+	return "unknown"
+}
+
+// Processes a request from the admin API
+func (w *World) procAdminRequest(req *AdminRequest) *AdminReply {
+	reply := &AdminReply{}
+
+	switch req.Command {
+	case AdminCmdListGames:
+		reply.Games = make([]*Game, len(w.games))
+		copy(reply.Games, w.games)
+
+	case AdminCmdKickPlayer:
+		reply.Err = WorldErrorPlayerNotRegistered
+		for p, info := range w.players {
+			if p.GetId() != req.PlayerId {
+				continue
+			}
+			log.Println("Admin kicked player", p.GetId())
+			if info.Conn != nil {
+				info.Conn.Kick(CloseCodeKicked, "Kicked by an admin")
+			}
+			reply.Err = w.unregisterPlayer(p)
+			break
+		}
+
+	case AdminCmdNotice:
+		log.Println("Admin notice:", req.Notice)
+		w.broadcastNotice(req.Notice)
+
+	case AdminCmdMutePlayer, AdminCmdUnmutePlayer:
+		reply.Err = w.setPlayerMuted(req.PlayerId, req.Command == AdminCmdMutePlayer)
+
+	default:
+		reply.Err = WorldErrorUnknownCommand
+	}
+
+	return reply
+}
+
+// Sends the notice to every player in the world
+func (w *World) broadcastNotice(notice string) {
+	msg := MsgCreateNotice(notice)
+	for p, _ := range w.players {
+		p.SendToPlayer(msg)
+	}
+}
+
+// Mutes or unmutes the player's chat, and lets the player know. The
+// mute is kept by the player's account, so it applies to all of the
+// account's players, including when they reconnect.
+func (w *World) setPlayerMuted(id PlayerId, muted bool) error {
+	key := ""
+	for p, info := range w.players {
+		if p.GetId() == id {
+			key = info.muteKey(p)
+			break
+		}
+	}
+	if len(key) == 0 {
+		return WorldErrorPlayerNotRegistered
+	}
+
+	log.Println("Admin set player", id, "muted", muted)
+	if muted {
+		w.muted[key] = true
+	} else {
+		delete(w.muted, key)
+	}
+	notice := "You have been muted by an admin"
+	if !muted {
+		notice = "You are no longer muted"
+	}
+	for p, info := range w.players {
+		if info.muteKey(p) == key {
+			info.Muted = muted
+			p.SendToPlayer(MsgCreateNotice(notice))
+		}
+	}
+	return nil
+}
+
+// Returns the complete current state of the game. Safe to call from
+// any goroutine. Nil is returned if the game has quit.
+func (g *Game) Inspect() *GameInspection {
+	reply := make(chan *GameInspection, 1)
+	select {
+	case g.inspect <- reply:
+	case <-g.quit:
+		return nil
+	}
+	return <-reply
+}
+
+// Pauses, resumes, or stops the game. Safe to call from any goroutine.
+// Returns false if the game has quit.
+func (g *Game) Control(ctrl GameControl) bool {
+	select {
+	case g.control <- ctrl:
+		return true
+	case <-g.quit:
+		return false
+	}
+}
+
+// Builds the inspection of the game's current state
+func (g *Game) inspection() *GameInspection {
+	i := &GameInspection{
+		GameSummary: GameSummary{
+			Id:            g.id,
+			Type:          g.gameType.Name,
+			State:         g.state.String(),
+			Round:         g.round,
+			NumPlayers:    len(g.players),
+			NumSpectators: len(g.spectators),
+			MaxPlayers:    g.gameType.Players,
+			Uptime:        int64(time.Since(g.created) / time.Second),
+		},
+		Seed:       g.seed,
+		Tick:       g.tick,
+		Seq:        g.seq,
+		Players:    adminPlayerInfos(g.playerInfoList()),
+		Spectators: adminPlayerInfos(g.spectatorInfoList()),
+	}
+	if g.board != nil {
+		msg := MsgCreateGameUpdate()
+		msg.AddEntityUpdates(g.board.GetEntityArray())
+		i.Entities = msg.Es
+	}
+	return i
+}
+
+// Processes the admin's control of the game. Paused games don't step
+// their simulation or accept player actions until they are resumed.
+// Stopped games are removed from the world.
+func (g *Game) procControl(ctrl GameControl) {
+	switch ctrl {
+	case GameControlPause:
+		if g.state == GameStateStopped || g.state == GameStatePaused {
+			return
+		}
+		g.resumeState = g.state
+		g.state = GameStatePaused
+		log.Println("Admin paused game", g.id)
+
+		msg := MsgCreateGameUpdate()
+		msg.AddRound(g)
+		g.broadcastUpdate(msg)
+
+	case GameControlResume:
+		if g.state != GameStatePaused {
+			return
+		}
+		g.state = g.resumeState
+		log.Println("Admin resumed game", g.id)
+
+		msg := MsgCreateGameUpdate()
+		msg.AddRound(g)
+		g.broadcastUpdate(msg)
+
+	case GameControlStop:
+		log.Println("Admin stopped game", g.id)
+		g.stopGame()
+		g.notifyEnded(GameEndReasonStopped)
+
+	case GameControlDrain:
+		g.draining = true
+		if g.state != GameStateRunning {
+			g.endDrained()
+		}
+	}
+}
+
+func adminPlayerInfos(infos []*GamePlayerInfo) []AdminPlayerInfo {
+	admin := make([]AdminPlayerInfo, len(infos))
+	for i, info := range infos {
+		admin[i] = AdminPlayerInfo{
+			Id:        info.PlayerId,
+			Name:      info.Name,
+			Score:     info.Score,
+			SelcColor: info.SelcColor,
+			Selected:  make([]EntityId, len(info.Selected)),
+		}
+		for j, e := range info.Selected {
+			admin[i].Selected[j] = e.GetId()
+		}
+	}
+	return admin
+}
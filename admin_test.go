@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGameStateNames(t *testing.T) {
+	names := map[GameState]string{
+		GameStateRunning:   "running",
+		GameStateCountdown: "countdown",
+		GameStateStopped:   "stopped",
+		GameStateEnded:     "results",
+		GameStatePaused:    "paused",
+	}
+	for state, name := range names {
+		if state.String() != name {
+			t.Error("Expected", name, "got", state.String())
+		}
+	}
+}
+
+func TestAdminRequestAfterShutdown(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	close(w.done)
+
+	replied := make(chan *AdminReply, 1)
+	go func() { replied <- w.adminRequest(&AdminRequest{Command: AdminCmdListGames}) }()
+	select {
+	case reply := <-replied:
+		if reply.Err != WorldErrorShuttingDown {
+			t.Fatal("Expected shutting down, got", reply.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Admin request blocked after the world shut down")
+	}
+}
+
+func TestAdminKickThenConnLost(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	conn := &testConn{}
+	p := NewPlayer(1, &Account{Guest: true}, conn, DefaultPlayerLimits)
+	if err := w.registerPlayer(p, conn, "", true); err != nil {
+		t.Fatal("Failed to register player,", err)
+	}
+
+	reply := w.procAdminRequest(&AdminRequest{Command: AdminCmdKickPlayer, PlayerId: 1})
+	if reply.Err != nil {
+		t.Fatal("Failed to kick player,", reply.Err)
+	}
+	if conn.kickCode != CloseCodeKicked {
+		t.Fatal("Expected the kicked close code, got", conn.kickCode)
+	}
+
+	// The kicked connection closing follows the kick
+	if err := w.playerConnLost(p, conn); err != nil {
+		t.Fatal("Expected losing a kicked player's connection to do nothing, got", err)
+	}
+}
+
+func TestRegisterUnknownGameType(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	conn := &testConn{}
+	p := NewPlayer(1, &Account{Guest: true}, conn, DefaultPlayerLimits)
+	if err := w.registerPlayer(p, conn, "no-such-type", false); err != WorldErrorUnknownGameType {
+		t.Fatal("Expected unknown game type, got", err)
+	}
+	if conn.kickCode != CloseCodeUnknownType || len(conn.kickReason) == 0 {
+		t.Fatal("Expected the connection to be closed with a reason, got", conn.kickCode, conn.kickReason)
+	}
+}
+
+// Returns the state of the last round update queued to the player
+func lastRoundState(p *Player) GameState {
+	state := GameState(-1)
+	for _, item := range popQueued(p) {
+		if msg, ok := item.(*MsgGameUpdate); ok && msg.Rd != nil {
+			state = GameState(msg.Rd.St)
+		}
+	}
+	return state
+}
+
+func TestGamePauseAndResume(t *testing.T) {
+	g := NewGame(0, NewGameTypeRegistry().Default(), 1, nil)
+	p := newTestPlayer(1)
+	g.addPlayer(p)
+	popQueued(p)
+	remaining := g.phaseRemaining()
+
+	g.procControl(GameControlPause)
+	if g.state != GameStatePaused || lastRoundState(p) != GameStatePaused {
+		t.Fatal("Expected the players to be told the game is paused, got", g.state)
+	}
+	if err := g.procPlayerCtrl(&PlayerAction{Player: p}, g.players[p]); err != GameErrorNotYourTurn {
+		t.Fatal("Expected the paused game to reject actions, got", err)
+	}
+
+	g.procControl(GameControlResume)
+	if g.state != GameStateCountdown || lastRoundState(p) != GameStateCountdown {
+		t.Fatal("Expected the game to resume its countdown, got", g.state)
+	}
+	if g.phaseRemaining() != remaining {
+		t.Fatal("Expected the countdown to be kept while paused")
+	}
+
+	g.procControl(GameControlResume)
+	if g.state != GameStateCountdown {
+		t.Fatal("Expected resuming a running game to be ignored, got", g.state)
+	}
+}
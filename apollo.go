@@ -1,7 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var addr = flag.String("a", "", "IP address the server is to run on")
@@ -9,24 +19,189 @@ var port = flag.Uint("p", 0, "Port address to run the server on")
 var wsport = flag.Uint("wsport", 0, "Port the client will connect to the websockets on")
 var rootURLPath = flag.String("r", "", "URL Path root of the webapp")
 var servceStatic = flag.Bool("s", false, "Set if apollo should service up static content")
-var wsConnType = flag.String("w", "gn", "Sets the websocket library to use, 'gn' for go.net, and 'gb' for garyburd/websocket")
+var wsConnType = flag.String("w", "gorilla", "Sets the websocket library to use, 'gorilla' for gorilla/websocket")
 var tlsCrtFile = flag.String("crt", "", "Sets the TLS crt file path name")
 var tlsKeyFile = flag.String("key", "", "Sets the TLS key file path name")
+var gameTypesFile = flag.String("gt", "", "Sets the JSON file game types are loaded from")
+var replayDir = flag.String("replays", "", "Sets the directory game replays are recorded to, and served from")
+var queueHighWater = flag.Int("queue", DefaultQueueLimits.HighWater, "Messages queued to a player before their game updates are coalesced into a snapshot")
+var queueEvictAfter = flag.Uint("evict", uint(DefaultQueueLimits.EvictAfter/time.Second), "Seconds a player's queue can stay over its high water mark before they are disconnected")
+var gameActionRate = flag.Float64("gamerate", DefaultActionLimits.GameRate, "Game actions a player can send per second")
+var worldActionRate = flag.Float64("worldrate", DefaultActionLimits.WorldRate, "World actions a player can send per second")
+var sessionGrace = flag.Uint("grace", 30, "Seconds a disconnected player's session is held for them to resume it, 0 disables resuming")
+var drainTime = flag.Uint("drain", 60, "Seconds running rounds are given to finish when the server is shutting down")
+var adminToken = flag.String("admintoken", "", "Sets the token required by the admin API, the API is disabled if not set")
+var profilesFile = flag.String("profiles", "", "Sets the file player profiles are stored in, profiles are disabled if not set")
+var leaderboardsFile = flag.String("leaderboards", "", "Sets the file leaderboards are stored in, leaderboards are only kept in memory if not set")
+var hashPassword = flag.String("hashpassword", "", "Prints a password store entry for the user with the password read from stdin, and exits")
+var configFile = flag.String("config", os.Getenv("APOLLO_CONFIG"), "Sets the TOML file the server's config is loaded from")
 
 func main() {
 	flag.Parse()
 
+	if len(*hashPassword) != 0 {
+		printPasswordUser(*hashPassword)
+		return
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	users, err := cfg.PasswordStore()
+	if err != nil {
+		log.Fatal("Failed to load password store: ", err)
+	}
+
 	httpHndlr := &HttpHandler{
-		Addr:        *addr,
-		Port:        *port,
-		TlsCrt:      *tlsCrtFile,
-		TlsKey:      *tlsKeyFile,
-		WsPort:      *wsport,
-		RootURLPath: *rootURLPath,
-		ServeStatic: *servceStatic,
-		WsConnType:  *wsConnType,
+		Addr:        cfg.Server.Addr,
+		Port:        cfg.Server.Port,
+		TlsCrt:      cfg.Server.TlsCrt,
+		TlsKey:      cfg.Server.TlsKey,
+		WsPort:      cfg.Server.WsPort,
+		RootURLPath: cfg.Server.Root,
+		ServeStatic: cfg.Server.Static,
+		WsConnType:  cfg.Server.Websocket,
+		ReplayDir:   cfg.Server.Replays,
+		AdminToken:  cfg.Server.AdminToken,
+		ConnLimits:  cfg.ConnLimits(),
+		Guests:      cfg.Auth.Guests,
+		Tokens:      cfg.TokenAuthenticator(),
+		TokenTTL:    cfg.Auth.TokenTTL.Duration(),
+		Users:       users,
+	}
+
+	world := NewWorld(httpHndlr, nil)
+	world.ReplayDir = cfg.Server.Replays
+	if len(cfg.Server.Profiles) != 0 {
+		profiles, err := OpenProfileStore(cfg.Server.Profiles)
+		if err != nil {
+			log.Fatal("Failed to open profile store: ", err)
+		}
+		defer profiles.Close()
+		world.Profiles = profiles
+		httpHndlr.Profiles = profiles
+	}
+
+	leaderboards := NewLeaderboards()
+	if len(cfg.Server.Leaderboards) != 0 {
+		if leaderboards, err = OpenLeaderboards(cfg.Server.Leaderboards); err != nil {
+			log.Fatal("Failed to open leaderboards: ", err)
+		}
 	}
-	world := NewWorld(httpHndlr)
+	defer leaderboards.Close()
+	world.Leaderboards = leaderboards
+	httpHndlr.Leaderboards = leaderboards
+	if err := world.Configure(cfg); err != nil {
+		log.Fatal("Failed to configure world: ", err)
+	}
+
+	// Reload the config on SIGHUP. Drain the world on the first
+	// SIGTERM or interrupt, and exit immediately on the next.
+	go func() {
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+		shuttingDown := false
+		for sig := range sigs {
+			switch {
+			case sig == syscall.SIGHUP:
+				reloaded, err := loadConfig()
+				if err != nil {
+					log.Println("Failed to reload config,", err)
+					continue
+				}
+				if reloaded.Server != cfg.Server || reloaded.Connection != cfg.Connection || reloaded.Auth != cfg.Auth {
+					log.Println("Server, connection, and auth settings are only applied at startup")
+				}
+				log.Println("Reloading config")
+				cfg = reloaded
+				world.Reconfigure(cfg)
+
+			case shuttingDown:
+				log.Fatal("Shutdown interrupted")
+
+			default:
+				log.Println("Shutting down")
+				shuttingDown = true
+				world.Shutdown(cfg.Game.Drain.Duration())
+			}
+		}
+	}()
 
 	world.Run()
 }
+
+// Loads the config file, and environment variables, overrides them with
+// the flags which were set, and validates the config.
+func loadConfig() (*Config, error) {
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "a":
+			cfg.Server.Addr = *addr
+		case "p":
+			cfg.Server.Port = *port
+		case "wsport":
+			cfg.Server.WsPort = *wsport
+		case "r":
+			cfg.Server.Root = *rootURLPath
+		case "s":
+			cfg.Server.Static = *servceStatic
+		case "w":
+			cfg.Server.Websocket = *wsConnType
+		case "crt":
+			cfg.Server.TlsCrt = *tlsCrtFile
+		case "key":
+			cfg.Server.TlsKey = *tlsKeyFile
+		case "replays":
+			cfg.Server.Replays = *replayDir
+		case "admintoken":
+			cfg.Server.AdminToken = *adminToken
+		case "profiles":
+			cfg.Server.Profiles = *profilesFile
+		case "leaderboards":
+			cfg.Server.Leaderboards = *leaderboardsFile
+		case "gt":
+			cfg.GameTypes.File = *gameTypesFile
+		case "queue":
+			cfg.Limits.QueueHighWater = *queueHighWater
+		case "evict":
+			cfg.Limits.EvictAfter = Duration(time.Duration(*queueEvictAfter) * time.Second)
+		case "gamerate":
+			cfg.Limits.GameRate = *gameActionRate
+		case "worldrate":
+			cfg.Limits.WorldRate = *worldActionRate
+		case "grace":
+			cfg.Game.SessionGrace = Duration(time.Duration(*sessionGrace) * time.Second)
+		case "drain":
+			cfg.Game.Drain = Duration(time.Duration(*drainTime) * time.Second)
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Reads a password from stdin, and prints the password store entry of
+// the user with it.
+func printPasswordUser(user string) {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal("Failed to read password: ", err)
+	}
+	entry, err := NewPasswordUser(user, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Fatal("Failed to hash password: ", err)
+	}
+	encoded, err := json.MarshalIndent(entry, "", "    ")
+	if err != nil {
+		log.Fatal("Failed to encode password: ", err)
+	}
+	fmt.Println(string(encoded))
+}
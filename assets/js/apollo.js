@@ -5,7 +5,7 @@ var ApolloApp = (function(context){
     var board = null;
 
     function selected(id) {
-        if (!ws.conn) {
+        if (!ws.conn || ws.spectating) {
             return;
         }
 
@@ -17,7 +17,17 @@ var ApolloApp = (function(context){
                 }
             }
         };
-        ws.conn.send(JSON.stringify(entityRemove));
+        var reqId = ws.send(entityRemove);
+        ws.pendingSelects[reqId] = parseInt(id);
+    }
+
+    // Claims the blocks currently selected
+    function claim() {
+        if (!ws.conn || ws.spectating) {
+            return;
+        }
+
+        ws.send({Act: {G: {C: WsConn.PlayerGameCmd.claimSelection}}});
     }
 
 
@@ -39,6 +49,13 @@ var ApolloApp = (function(context){
         wnd.bind('resizeEnd', function() {
             board.resize(wnd.width(), wnd.height());
         })
+        $(document).keydown(function(e) {
+            // Enter or space claims the current selection
+            if (e.which === 13 || e.which === 32) {
+                claim();
+            }
+        });
+        $('#'+cfg.container).bind('dblclick', claim);
 
         ws = new WsConn(board);
         if (!ws.open(cfg.wsURL)) {
@@ -48,35 +65,321 @@ var ApolloApp = (function(context){
     }
 
 
+    // Encodes and decodes the compact binary messages. Each message starts
+    // with a tag byte. Integers are varints, signed integers are zig-zag
+    // encoded, strings and lists are prefixed by their length. Messages
+    // without a binary encoding are JSON following the JSON tag.
+    var BinCodec = {
+        name: 'apollo.bin',
+        tags: {json: 0, gameUpdate: 1, playerAction: 2},
+
+        supported: function() {
+            return !!(window.ArrayBuffer && window.Uint8Array);
+        },
+
+        encode: function(msg) {
+            var out = [];
+            var uint = function(v) {
+                while (v >= 128) {
+                    out.push((v % 128) | 128);
+                    v = Math.floor(v / 128);
+                }
+                out.push(v);
+            };
+            var int = function(v) { uint(v >= 0 ? v * 2 : -v * 2 - 1); };
+            var str = function(s) {
+                s = unescape(encodeURIComponent(s || ''));
+                uint(s.length);
+                for (var i = 0; i < s.length; i++) {
+                    out.push(s.charCodeAt(i));
+                }
+            };
+
+            if (!msg.Act) {
+                var json = unescape(encodeURIComponent(JSON.stringify(msg)));
+                out.push(BinCodec.tags.json);
+                for (var i = 0; i < json.length; i++) {
+                    out.push(json.charCodeAt(i));
+                }
+                return new Uint8Array(out).buffer;
+            }
+
+            out.push(BinCodec.tags.playerAction);
+            str(msg.ReqId);
+            uint((msg.Act.W ? 1 : 0) | (msg.Act.G ? 2 : 0) | (msg.Act.C ? 4 : 0));
+            if (msg.Act.W) {
+                int(msg.Act.W.C);
+                uint(msg.Act.W.G || 0);
+                str(msg.Act.W.T);
+                str(msg.Act.W.A);
+                int(msg.Act.W.L || 0);
+                int(msg.Act.W.O || 0);
+            }
+            if (msg.Act.G) {
+                int(msg.Act.G.C);
+                uint(msg.Act.G.E || 0);
+                uint(msg.Act.G.Sq || 0);
+            }
+            if (msg.Act.C) {
+                str(msg.Act.C.M);
+            }
+            return new Uint8Array(out).buffer;
+        },
+
+        decode: function(data) {
+            var buf = new Uint8Array(data);
+            var pos = 1;
+            var uint = function() {
+                var v = 0, mult = 1, b;
+                do {
+                    b = buf[pos++];
+                    v += (b & 127) * mult;
+                    mult *= 128;
+                } while (b & 128);
+                return v;
+            };
+            var int = function() {
+                var v = uint();
+                return v % 2 === 0 ? v / 2 : -(v + 1) / 2;
+            };
+            var bytes = function(len) {
+                var s = '';
+                for (var end = pos + len; pos < end; pos++) {
+                    s += String.fromCharCode(buf[pos]);
+                }
+                return decodeURIComponent(escape(s));
+            };
+            var str = function() { return bytes(uint()); };
+            var list = function(read) {
+                var l = [];
+                for (var n = uint(); n > 0; n--) {
+                    l.push(read());
+                }
+                return l;
+            };
+            var playerInfo = function() {
+                return {Id: uint(), St: int(), N: str(), Sc: int()};
+            };
+
+            if (buf[0] === BinCodec.tags.json) {
+                return JSON.parse(bytes(buf.length - 1));
+            }
+            if (buf[0] !== BinCodec.tags.gameUpdate) {
+                return {};
+            }
+
+            var msg = {GU: true};
+            var flags = uint();
+            msg.Sq = uint();
+            msg.Sn = !!(flags & 16);
+            if (flags & 1) {
+                msg.G = {Id: uint(), T: str(), P: int(), Mp: int(), S: int(), Sd: uint()};
+            }
+            if (flags & 2) {
+                msg.Gt = {N: str(), R: int(), C: int(), P: int(), Cs: int()};
+            }
+            if (flags & 4) {
+                msg.Rd = {N: int(), St: int(), T: int(), Ts: int()};
+            }
+            if (flags & 8) {
+                msg.Rs = {W: list(uint), Ps: list(playerInfo)};
+            }
+            msg.Ps = list(playerInfo);
+            msg.Ss = list(playerInfo);
+            var cAt = 0, uAt = 0;
+            msg.Es = list(function() {
+                var e = {Id: uint(), F: uint()};
+                var fields = e.F || 255;
+                if (fields & 1) { e.T = int(); }
+                if (fields & 2) { e.St = int(); }
+                if (fields & 4) { e.X = int(); }
+                if (fields & 8) { e.Y = int(); }
+                if (fields & 16) { e.C = int(); }
+                if (fields & 32) { e.Ttl = int(); }
+                if (fields & 64) { e.CAt = cAt += int(); }
+                if (fields & 128) { e.UAt = uAt += int(); }
+                return e;
+            });
+            return msg;
+        }
+    };
+
     // Webseocket wrapper object
     function WsConn(board) {
         this.conn = null;
         this.board = board
+        this.url = null;
+        this.session = null;
+        this.sessionGrace = 0;
+        this.sessionExpires = 0;
+        this.binary = false;
+        // Game state sequence, and the entities as of it
+        this.seq = 0;
+        this.synced = false;
+        this.awaitingSnapshot = false;
+        this.ackTO = null;
+        this.entities = {};
+        // Actions waiting for their replies
+        this.nextReqId = 1;
+        this.pendingSelects = {};
+        // Profiles received, by account id, and the last leaderboard page
+        this.profiles = {};
+        this.leaderboard = null;
+        // Chat lines of the game the player is in, or the lobby
+        this.chatGame = -1;
+        this.chatLines = [];
     };
-    WsConn.PlayerGameCmd = {selectEntity: 0};
+    WsConn.PlayerGameCmd = {selectEntity: 0, claimSelection: 1, ack: 2, snapshot: 3};
+    WsConn.ActionCodes = {ok: 0, unknownEntity: 1, notYourTurn: 2, wrongColor: 3, rateLimited: 4,
+        notInGame: 5, spectator: 6, invalidMatch: 7, gameNotFound: 8, gameFull: 9,
+        unknownGameType: 10, unknownCommand: 11, failed: 12, malformed: 13, invalid: 14, shuttingDown: 15,
+        noProfile: 16, notRanked: 17, muted: 18};
+    WsConn.EntityFields = ['T', 'St', 'X', 'Y', 'C', 'Ttl', 'CAt', 'UAt'];
+    WsConn.PlayerWorldCmd = {listGames: 0, joinGame: 1, leaveGame: 2, createGame: 3, spectateGame: 4, profile: 5,
+        leaderboard: 6, findGame: 7};
+    WsConn.LeaderboardWindows = {daily: 0, weekly: 1, allTime: 2};
+    WsConn.MaxChatLines = 100;
     WsConn.EntityUpdateTypes = {added: 0, present: 1, selected: 2, removed: 3};
     WsConn.PlayerUpdateTypes = {added: 0, present: 1, updated: 2, removed: 3};
     WsConn.EntityTypes = {block:0};
+    WsConn.GameStates = {running: 0, countdown: 1, stopped: 2, ended: 3, paused: 4};
+    WsConn.prototype.sendWorldAction = function(cmd, gameId, gameType, accountId, window, offset) {
+        if (!this.conn) {
+            return;
+        }
+        this.send({Act: {W: {C: cmd, G: gameId || 0, T: gameType || '', A: accountId || '',
+            L: window || 0, O: offset || 0}}});
+    };
+    // Requests the profile of the account, or the player's own if no
+    // account is given.
+    WsConn.prototype.requestProfile = function(accountId) {
+        this.sendWorldAction(WsConn.PlayerWorldCmd.profile, 0, '', accountId);
+    };
+    // Leaves the current game, and waits to be matched into a game of
+    // the type with players of a similar rating.
+    WsConn.prototype.findGame = function(gameType) {
+        this.sendWorldAction(WsConn.PlayerWorldCmd.findGame, 0, gameType);
+    };
+    // Requests a page of the game type's leaderboard in the window, from
+    // the offset, or around the account's entry if an account is given.
+    // The current game's type is used if no game type is given.
+    WsConn.prototype.requestLeaderboard = function(window, gameType, offset, accountId) {
+        this.sendWorldAction(WsConn.PlayerWorldCmd.leaderboard, 0, gameType, accountId, window, offset);
+    };
+    // Sends the chat message to the players in the current game, or the
+    // lobby if the player isn't in a game.
+    WsConn.prototype.sendChat = function(text) {
+        this.send({Act: {C: {M: text}}});
+    };
+    // Sends the message encoded with the codec negotiated with the server.
+    // Returns the request id the action's reply will echo.
+    WsConn.prototype.send = function(msg) {
+        if (!this.conn) {
+            return;
+        }
+        if (msg.Act && !msg.ReqId) {
+            msg.ReqId = String(this.nextReqId++);
+        }
+        this.conn.send(this.binary ? BinCodec.encode(msg) : JSON.stringify(msg));
+        return msg.ReqId;
+    };
+    // Handles the reply to an action. Selections the server rejected are
+    // reverted to the entity's last known state.
+    WsConn.prototype.onActionReply = function(msg) {
+        var entityId = this.pendingSelects[msg.R];
+        delete this.pendingSelects[msg.R];
+        if (msg.E === WsConn.ActionCodes.ok) {
+            return;
+        }
+        console.log('Action', msg.R, 'rejected,', msg.E, msg.M);
+        if (entityId !== undefined && this.entities[entityId]) {
+            this.board.updateEntity($.extend({}, this.entities[entityId]));
+        }
+    };
     WsConn.prototype.open = function(url) {
         if (window["WebSocket"]) {
-            var conn = this.conn = new WebSocket(url);
+            this.url = url;
+            if (this.session) {
+                // Resume the session instead of joining as a new player
+                url += (url.indexOf('?') === -1 ? '?' : '&') + 'session=' + encodeURIComponent(this.session);
+            }
+            // Prefer the compact binary encoding if the browser can decode it
+            var protocols = BinCodec.supported() ? [BinCodec.name, 'apollo.json'] : ['apollo.json'];
+            var conn = this.conn = new WebSocket(url, protocols);
+            conn.binaryType = 'arraybuffer';
             var ws = this;
+            conn.onopen = function(evt) { ws.onOpen(evt); };
             conn.onclose = function(evt) { ws.onClose(evt); };
             conn.onmessage = function(evt) { ws.onMessage(evt); };
             return true;
         }
         return false
     };
+    WsConn.prototype.onOpen = function(evt) {
+        this.binary = this.conn.protocol === BinCodec.name;
+        this.sessionExpires = 0;
+    };
     WsConn.prototype.onClose = function(evt) {
+        if (this.session && !this.sessionExpires) {
+            this.sessionExpires = new Date().getTime() + this.sessionGrace;
+        }
         console.log('Connection Closed,', evt);
         this.conn = null
+        // Try to resume the session while the server is still holding it
+        if (this.session && new Date().getTime() < this.sessionExpires) {
+            var ws = this;
+            setTimeout(function() { ws.open(ws.url); }, 1000);
+        }
     };
     WsConn.prototype.onMessage = function(evt) {
         // console.log(evt.data);
-        var msg = JSON.parse(evt.data);
+        var msg = typeof evt.data === 'string' ? JSON.parse(evt.data) : BinCodec.decode(evt.data);
+        if (msg.SU) { // Session
+            this.session = msg.S;
+            this.sessionGrace = msg.Gr;
+        }
+        if (msg.AR) { // Action reply
+            this.onActionReply(msg);
+        }
+        if (msg.PF) { // Profile
+            this.profiles[msg.A] = msg;
+        }
+        if (msg.LB) { // Leaderboard page
+            this.leaderboard = msg;
+        }
+        if (msg.CH) { // Chat lines
+            this.onChat(msg);
+        }
+        if (msg.NU) { // Server notice
+            this.showNotice(msg.M);
+        }
+        if (msg.SD) { // Server shutting down
+            // The session won't survive the server, so don't try to resume it
+            this.session = null;
+            this.showShutdown(msg.T);
+        }
+        if (msg.WU) { // World update
+            this.games = msg.Gs || [];
+            this.spectating = msg.Sp;
+            this.queued = msg.Q;
+            if (msg.G !== this.chatGame) {
+                this.chatGame = msg.G;
+                this.chatLines = [];
+            }
+            if (msg.G === -1) {
+                board.reset();
+                this.synced = false;
+                this.entities = {};
+            }
+        }
+        if (msg.GU && !this.inSequence(msg)) {
+            return;
+        }
         if (msg.GU) { // Game board update
             var gameType = msg.Gt;
             if (gameType) {
+                // A game type is only sent when joining a game
+                board.reset();
                 board.setGameType(gameType)
             }
             var entities = msg.Es;
@@ -87,12 +390,117 @@ var ApolloApp = (function(context){
             if (players) {
                 this.processPlayerUpdate(players)
             }
+            if (msg.Rs) {
+                this.showResults(msg.Rs);
+            } else if (msg.Rd) {
+                this.showRound(msg.Rd);
+            }
+        }
+    };
+    WsConn.prototype.showRound = function(round) {
+        var status = $('#game-status');
+        if (round.St === WsConn.GameStates.paused) {
+            status.text('Game paused').removeClass('hidden');
+        } else if (round.St === WsConn.GameStates.countdown && round.T > 0) {
+            status.text('Round '+round.N+' starts in '+Math.ceil(round.T/1000)+'s').removeClass('hidden');
+            setTimeout(function() { status.addClass('hidden'); }, round.T);
+        } else {
+            status.addClass('hidden');
         }
     };
+    // Keeps the chat lines of the player's current channel. History
+    // replaces the lines, since it is sent when joining a channel.
+    WsConn.prototype.onChat = function(msg) {
+        if (msg.H || msg.G !== this.chatGame) {
+            this.chatGame = msg.G;
+            this.chatLines = [];
+        }
+        this.chatLines = this.chatLines.concat(msg.Ls || []).slice(-WsConn.MaxChatLines);
+    };
+    WsConn.prototype.showNotice = function(notice) {
+        var status = $('#game-status');
+        status.text('Notice: '+notice).removeClass('hidden');
+        setTimeout(function() { status.addClass('hidden'); }, 10000);
+    };
+    WsConn.prototype.showShutdown = function(remaining) {
+        var status = $('#game-status');
+        var ends = new Date().getTime() + remaining;
+        var update = function() {
+            var left = Math.max(0, Math.ceil((ends - new Date().getTime())/1000));
+            status.text('Server shutting down in '+left+'s').removeClass('hidden');
+            if (left > 0) {
+                setTimeout(update, 1000);
+            }
+        };
+        update();
+    };
+    WsConn.prototype.showResults = function(results) {
+        var text = 'Round over! ';
+        if (results.W && results.W.length > 0) {
+            text += 'Winner: P '+results.W.join(', P ')+'. ';
+        }
+        var pLen = results.Ps ? results.Ps.length : 0;
+        for (var idx=0; idx < pLen; idx++) {
+            text += (idx+1)+'. P '+results.Ps[idx].Id+' - '+results.Ps[idx].Sc+' ';
+        }
+        $('#game-status').text(text).removeClass('hidden');
+    };
+    // Checks the game update is the next in the game's sequence. If an
+    // update was missed a snapshot of the game is requested, and updates
+    // are ignored until it arrives. Updates received are acknowledged so
+    // the server only sends what changed since.
+    WsConn.prototype.inSequence = function(msg) {
+        if (msg.Sn) {
+            this.synced = true;
+            this.awaitingSnapshot = false;
+            this.entities = {};
+        } else if (this.synced) {
+            if (this.awaitingSnapshot) {
+                return false;
+            }
+            if (msg.Sq !== this.seq + 1) {
+                console.log('Missed game updates', this.seq, msg.Sq);
+                this.awaitingSnapshot = true;
+                this.send({Act: {G: {C: WsConn.PlayerGameCmd.snapshot}}});
+                return false;
+            }
+        }
+        this.seq = msg.Sq;
+
+        if (this.synced && !this.ackTO) {
+            var ws = this;
+            this.ackTO = setTimeout(function() {
+                ws.ackTO = null;
+                ws.send({Act: {G: {C: WsConn.PlayerGameCmd.ack, Sq: ws.seq}}});
+            }, 250);
+        }
+        return true;
+    };
+    // Merges the entity update with the entity's known state. Only the
+    // flagged fields are included in a delta, all fields otherwise.
+    WsConn.prototype.mergeEntity = function(update) {
+        var known = (update.F && this.entities[update.Id]) || {};
+        var entity = {Id: update.Id};
+        for (var i = 0; i < WsConn.EntityFields.length; i++) {
+            var field = WsConn.EntityFields[i];
+            if (update.F && !(update.F & (1 << i))) {
+                entity[field] = known[field];
+            } else {
+                entity[field] = update[field] || 0;
+            }
+        }
+        if (entity.St === WsConn.EntityUpdateTypes.removed) {
+            delete this.entities[entity.Id];
+        } else {
+            this.entities[entity.Id] = entity;
+        }
+        // The board changes its entities as they are selected
+        return $.extend({}, entity);
+    };
     WsConn.prototype.processEntityUpdate = function(entities) {
         var eLen = entities.length;
         for (var idx=0; idx < eLen; idx++) {
-            var entity = entities[idx];
+            var entity = this.mergeEntity(entities[idx]);
             switch(entity.St) {
                 case WsConn.EntityUpdateTypes.added:
                     this.board.addEntity(entity);
@@ -137,7 +545,7 @@ var ApolloApp = (function(context){
     }
 
     function newGameBoard(container, startWidth, startHeight) {
-        var entityColors = ['red', 'blue', 'green', 'gray', 'orange'];
+        var entityColors = ['red', 'blue', 'green', 'gray', 'orange', 'purple', 'yellow', 'cyan'];
         var contNode = document.getElementById(container);
         var stage = null,
             playerLayer = null,
@@ -315,6 +723,18 @@ var ApolloApp = (function(context){
             entLayer.draw();
         }
 
+        // Clears all players and entities from the board
+        function reset() {
+            for (var id in entities) {
+                if (entities.hasOwnProperty(id)) { removeEntity(id); }
+            }
+            while (players.length > 0) {
+                removePlayer(players[players.length-1].p.Id);
+            }
+            entities = [];
+            entGrid = [];
+        }
+
         function setGameType(gt) {
             gameType.rows = gt.R;
             gameType.cols = gt.C;
@@ -388,6 +808,7 @@ var ApolloApp = (function(context){
 
         return {
             setGameType:  setGameType,
+            reset:        reset,
             addPlayer:    addPlayer,
             removePlayer: removePlayer,
             updatePlayer: updatePlayer,
@@ -400,5 +821,6 @@ var ApolloApp = (function(context){
 
     return {
         runApp: runApp,
+        claim:  claim,
     };
 })(this);
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuthError struct {
+	AuthErrorString string
+}
+
+func (a *AuthError) Error() string { return a.AuthErrorString }
+
+var (
+	AuthErrorNoCredentials = &AuthError{"No credentials"}
+	AuthErrorInvalidToken  = &AuthError{"Invalid token"}
+	AuthErrorExpiredToken  = &AuthError{"Token has expired"}
+	AuthErrorInvalidLogin  = &AuthError{"Invalid username or password"}
+	AuthErrorInvalidStore  = &AuthError{"Password store users must have a user name, salt, hash, and iterations"}
+	AuthErrorRateLimited   = &AuthError{"Too many login attempts"}
+	AuthErrorBusy          = &AuthError{"Too many logins in progress"}
+)
+
+const (
+	// Iterations of the password hash used for new passwords
+	passwordHashIterations = 100000
+	passwordSaltLen        = 16
+	passwordHashLen        = 32
+
+	// Time an address's login attempts are remembered after its last
+	loginLimiterIdle = 10 * time.Minute
+)
+
+// Limits of password logins, checked before the password is hashed
+type LoginLimits struct {
+	Rate       float64 // Login attempts per second from an address
+	Burst      int     // Login attempts from an address at once
+	Concurrent int     // Passwords hashed at once
+}
+
+var (
+	DefaultLoginLimits = LoginLimits{
+		Rate:       1,
+		Burst:      5,
+		Concurrent: 4,
+	}
+)
+
+// Identity a player connected as. Guests have no account id.
+type Account struct {
+	Id    string
+	Name  string // Display name
+	Guest bool
+}
+
+// Authenticates the websocket upgrade requests of players.
+// AuthErrorNoCredentials is returned if the request has no credentials
+// the authenticator understands, any other error means the request's
+// credentials are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Account, error)
+}
+
+// Tries each authenticator in turn, until one finds credentials in the
+// request it understands.
+type AuthChain []Authenticator
+
+func (c AuthChain) Authenticate(r *http.Request) (*Account, error) {
+	for _, auth := range c {
+		account, err := auth.Authenticate(r)
+		if err != AuthErrorNoCredentials {
+			return account, err
+		}
+	}
+	return nil, AuthErrorNoCredentials
+}
+
+// Accepts every request as a guest
+type GuestAuthenticator struct{}
+
+func (g GuestAuthenticator) Authenticate(r *http.Request) (*Account, error) {
+	return &Account{Guest: true}, nil
+}
+
+// Authenticates requests carrying a bearer token signed with the
+// secret. Browsers can't set the headers of websocket requests, so the
+// token may also be sent as the "token" query parameter.
+type TokenAuthenticator struct {
+	Secret []byte
+}
+
+// Claims of a signed token
+type authToken struct {
+	Id   string
+	Name string
+	Exp  int64 // Unix time the token expires at
+}
+
+// Returns a token for the account, signed with the authenticator's
+// secret, and valid for the ttl. Tokens are the base64 JSON claims,
+// and their HMAC-SHA256 signature separated by a period.
+func (t *TokenAuthenticator) Issue(account *Account, ttl time.Duration) (string, error) {
+	claims, err := json.Marshal(&authToken{
+		Id:   account.Id,
+		Name: account.Name,
+		Exp:  time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload)), nil
+}
+
+func (t *TokenAuthenticator) Authenticate(r *http.Request) (*Account, error) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if len(token) == 0 {
+		return nil, AuthErrorNoCredentials
+	}
+
+	dot := strings.IndexByte(token, '.')
+	if dot == -1 {
+		return nil, AuthErrorInvalidToken
+	}
+	payload := token[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(sig, t.sign(payload)) {
+		return nil, AuthErrorInvalidToken
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, AuthErrorInvalidToken
+	}
+	var tok authToken
+	if err := json.Unmarshal(claims, &tok); err != nil || len(tok.Id) == 0 {
+		return nil, AuthErrorInvalidToken
+	}
+	if time.Now().Unix() >= tok.Exp {
+		return nil, AuthErrorExpiredToken
+	}
+
+	return &Account{Id: tok.Id, Name: tok.Name}, nil
+}
+
+func (t *TokenAuthenticator) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// User in the local password store. Passwords are hashed with
+// PBKDF2-HMAC-SHA256.
+type PasswordUser struct {
+	User       string
+	Name       string // Display name, the user name if empty
+	Salt       string // Base64 encoded
+	Hash       string // Base64 encoded
+	Iterations int
+}
+
+// Local store of users, and their password hashes, loaded from a JSON
+// file. Authenticates requests with HTTP basic auth.
+type PasswordStore struct {
+	users   map[string]*PasswordUser
+	limiter *LoginLimiter
+}
+
+// Password store file format
+type passwordStoreConfig struct {
+	Users []*PasswordUser
+}
+
+// Loads the password store from the JSON file
+func LoadPasswordStore(path string) (*PasswordStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cfg passwordStoreConfig
+	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	s := &PasswordStore{
+		users:   make(map[string]*PasswordUser, len(cfg.Users)),
+		limiter: NewLoginLimiter(DefaultLoginLimits),
+	}
+	for _, u := range cfg.Users {
+		if len(u.User) == 0 || len(u.Salt) == 0 || len(u.Hash) == 0 || u.Iterations <= 0 {
+			return nil, AuthErrorInvalidStore
+		}
+		s.users[u.User] = u
+	}
+	return s, nil
+}
+
+// Returns the account of the user if the password is correct. The
+// request's login attempt is limited before the password is hashed.
+func (s *PasswordStore) LoginRequest(r *http.Request, user, password string) (*Account, error) {
+	if err := s.limiter.Acquire(r); err != nil {
+		return nil, err
+	}
+	defer s.limiter.Release()
+
+	return s.Login(user, password)
+}
+
+// Returns the account of the user if the password is correct. Not
+// limited, use LoginRequest for requests.
+func (s *PasswordStore) Login(user, password string) (*Account, error) {
+	u := s.users[user]
+	if u == nil {
+		// Hash anyway, so unknown users take as long as wrong passwords
+		pbkdf2.Key(sha256.New, password, []byte(user), passwordHashIterations, passwordHashLen)
+		return nil, AuthErrorInvalidLogin
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(u.Salt)
+	if err != nil {
+		return nil, AuthErrorInvalidLogin
+	}
+	hash, err := base64.StdEncoding.DecodeString(u.Hash)
+	if err != nil {
+		return nil, AuthErrorInvalidLogin
+	}
+	computed, err := pbkdf2.Key(sha256.New, password, salt, u.Iterations, len(hash))
+	if err != nil || subtle.ConstantTimeCompare(computed, hash) != 1 {
+		return nil, AuthErrorInvalidLogin
+	}
+
+	name := u.Name
+	if len(name) == 0 {
+		name = u.User
+	}
+	return &Account{Id: "local:" + u.User, Name: name}, nil
+}
+
+func (s *PasswordStore) Authenticate(r *http.Request) (*Account, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, AuthErrorNoCredentials
+	}
+	return s.LoginRequest(r, user, password)
+}
+
+// Creates a new password store entry for the user with the password
+func NewPasswordUser(user, password string) (*PasswordUser, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordHashLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordUser{
+		User:       user,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Hash:       base64.StdEncoding.EncodeToString(hash),
+		Iterations: passwordHashIterations,
+	}, nil
+}
+
+// Limits login attempts by the address they are made from, and how
+// many passwords are hashed at once. Safe for use by multiple
+// goroutines.
+type LoginLimiter struct {
+	limits LoginLimits
+	mu     sync.Mutex
+	addrs  map[string]*loginAddr
+	pruned time.Time
+	slots  chan bool
+}
+
+// Login attempts made from an address
+type loginAddr struct {
+	bucket *TokenBucket
+	seen   time.Time
+}
+
+// Creates a new login limiter, with no attempts made
+func NewLoginLimiter(limits LoginLimits) *LoginLimiter {
+	return &LoginLimiter{
+		limits: limits,
+		addrs:  make(map[string]*loginAddr),
+		pruned: time.Now(),
+		slots:  make(chan bool, limits.Concurrent),
+	}
+}
+
+// Takes a login attempt for the request's address, and a slot to hash
+// the password in. AuthErrorRateLimited is returned if the address made
+// too many attempts, and AuthErrorBusy if too many passwords are being
+// hashed. Release must be called once the password is hashed.
+func (l *LoginLimiter) Acquire(r *http.Request) error {
+	if !l.allow(r) {
+		return AuthErrorRateLimited
+	}
+	select {
+	case l.slots <- true:
+		return nil
+	default:
+		return AuthErrorBusy
+	}
+}
+
+// Releases the slot taken by Acquire
+func (l *LoginLimiter) Release() {
+	<-l.slots
+}
+
+// Takes a login attempt for the request's address. Addresses which
+// haven't attempted to log in for a while are forgotten.
+func (l *LoginLimiter) allow(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) >= loginLimiterIdle {
+		for addr, a := range l.addrs {
+			if now.Sub(a.seen) >= loginLimiterIdle {
+				delete(l.addrs, addr)
+			}
+		}
+		l.pruned = now
+	}
+
+	a := l.addrs[host]
+	if a == nil {
+		a = &loginAddr{bucket: NewTokenBucket(l.limits.Rate, l.limits.Burst)}
+		l.addrs[host] = a
+	}
+	a.seen = now
+	return a.bucket.Allow()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// PBKDF2-HMAC-SHA256 test vectors of "password" salted with "salt"
+var pbkdf2TestVectors = []struct {
+	iterations int
+	key        string
+}{
+	{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+	{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+	{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+}
+
+func TestPasswordHashKnownAnswers(t *testing.T) {
+	for _, v := range pbkdf2TestVectors {
+		key, err := pbkdf2.Key(sha256.New, "password", []byte("salt"), v.iterations, passwordHashLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != v.key {
+			t.Errorf("%d iterations, expected %s got %x", v.iterations, v.key, key)
+		}
+
+		// The store checks passwords against the same hashes
+		expected, _ := hex.DecodeString(v.key)
+		s := &PasswordStore{
+			users: map[string]*PasswordUser{"jo": {
+				User:       "jo",
+				Salt:       base64.StdEncoding.EncodeToString([]byte("salt")),
+				Hash:       base64.StdEncoding.EncodeToString(expected),
+				Iterations: v.iterations,
+			}},
+		}
+		if account, err := s.Login("jo", "password"); err != nil || account.Id != "local:jo" {
+			t.Errorf("%d iterations, expected the login to succeed, got %v", v.iterations, err)
+		}
+		if _, err := s.Login("jo", "Password"); err != AuthErrorInvalidLogin {
+			t.Errorf("%d iterations, expected a wrong password to fail, got %v", v.iterations, err)
+		}
+	}
+}
+
+func TestNewPasswordUser(t *testing.T) {
+	u, err := NewPasswordUser("jo", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &PasswordStore{users: map[string]*PasswordUser{"jo": u}}
+	if _, err := s.Login("jo", "hunter2"); err != nil {
+		t.Fatal("Expected the password to be accepted, got", err)
+	}
+	if _, err := s.Login("al", "hunter2"); err != AuthErrorInvalidLogin {
+		t.Fatal("Expected an unknown user to fail, got", err)
+	}
+}
+
+func TestTokenSignatureKnownAnswer(t *testing.T) {
+	auth := &TokenAuthenticator{Secret: []byte("key")}
+	sig := auth.sign("The quick brown fox jumps over the lazy dog")
+	if hex.EncodeToString(sig) != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Fatalf("Unexpected HMAC-SHA256 signature %x", sig)
+	}
+}
+
+// Returns a websocket request carrying the token
+func tokenRequest(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestTokenIssueAndAuthenticate(t *testing.T) {
+	auth := &TokenAuthenticator{Secret: []byte("secret")}
+	token, err := auth.Issue(&Account{Id: "local:jo", Name: "Jo"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := auth.Authenticate(tokenRequest(token))
+	if err != nil || account.Id != "local:jo" || account.Name != "Jo" || account.Guest {
+		t.Fatalf("Expected the token's account, got %+v %v", account, err)
+	}
+
+	r, _ := http.NewRequest("GET", "/ws?token="+token, nil)
+	if _, err := auth.Authenticate(r); err != nil {
+		t.Fatal("Expected the token query parameter to be accepted, got", err)
+	}
+
+	// Claiming another account invalidates the signature
+	dot := strings.IndexByte(token, '.')
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"Id":"local:al","Name":"Al","Exp":9999999999}`))
+	if _, err := auth.Authenticate(tokenRequest(claims + token[dot:])); err != AuthErrorInvalidToken {
+		t.Fatal("Expected a tampered token to fail, got", err)
+	}
+
+	other := &TokenAuthenticator{Secret: []byte("other")}
+	if _, err := other.Authenticate(tokenRequest(token)); err != AuthErrorInvalidToken {
+		t.Fatal("Expected a token signed with another secret to fail, got", err)
+	}
+	if _, err := auth.Authenticate(tokenRequest("garbage")); err != AuthErrorInvalidToken {
+		t.Fatal("Expected a malformed token to fail, got", err)
+	}
+	r, _ = http.NewRequest("GET", "/ws", nil)
+	if _, err := auth.Authenticate(r); err != AuthErrorNoCredentials {
+		t.Fatal("Expected a request without a token to have no credentials, got", err)
+	}
+
+	expired, _ := auth.Issue(&Account{Id: "local:jo"}, -time.Second)
+	if _, err := auth.Authenticate(tokenRequest(expired)); err != AuthErrorExpiredToken {
+		t.Fatal("Expected an expired token to fail, got", err)
+	}
+}
+
+// Returns a request made from the address
+func loginRequest(addr string) *http.Request {
+	return &http.Request{RemoteAddr: addr + ":4321", Header: http.Header{}}
+}
+
+func TestLoginLimiterRate(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{Rate: 0.001, Burst: 2, Concurrent: 4})
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(loginRequest("10.0.0.1")); err != nil {
+			t.Fatal("Expected the burst to be allowed, got", err)
+		}
+		l.Release()
+	}
+	if err := l.Acquire(loginRequest("10.0.0.1")); err != AuthErrorRateLimited {
+		t.Fatal("Expected the address to be rate limited, got", err)
+	}
+	if err := l.Acquire(loginRequest("10.0.0.2")); err != nil {
+		t.Fatal("Expected other addresses to be allowed, got", err)
+	}
+	l.Release()
+}
+
+func TestLoginLimiterConcurrency(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{Rate: 100, Burst: 100, Concurrent: 2})
+	l.Acquire(loginRequest("10.0.0.1"))
+	l.Acquire(loginRequest("10.0.0.2"))
+	if err := l.Acquire(loginRequest("10.0.0.3")); err != AuthErrorBusy {
+		t.Fatal("Expected too many hashes at once to be refused, got", err)
+	}
+	l.Release()
+	if err := l.Acquire(loginRequest("10.0.0.3")); err != nil {
+		t.Fatal("Expected a released slot to be reused, got", err)
+	}
+}
+
+func TestPasswordStoreLimitsBasicAuth(t *testing.T) {
+	s := &PasswordStore{
+		users:   map[string]*PasswordUser{},
+		limiter: NewLoginLimiter(LoginLimits{Rate: 0.001, Burst: 1, Concurrent: 1}),
+	}
+	r := loginRequest("10.0.0.1")
+	r.SetBasicAuth("jo", "wrong")
+	if _, err := s.Authenticate(r); err != AuthErrorInvalidLogin {
+		t.Fatal("Expected the first attempt to be checked, got", err)
+	}
+	if _, err := s.Authenticate(r); err != AuthErrorRateLimited {
+		t.Fatal("Expected the second attempt to be limited, got", err)
+	}
+}
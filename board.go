@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"math/rand"
+	"sort"
 	"time"
 )
 
@@ -22,9 +23,9 @@ func NewBoard(rows, cols int) *Board {
 	}
 }
 
-// Adds a single entity to the board
-func (b *Board) AddEntity(e *Entity) {
-	e.createdAt = time.Now().UTC()
+// Adds a single entity to the board, created at the time provided
+func (b *Board) AddEntity(e *Entity, now time.Time) {
+	e.createdAt = now
 	e.updatedAt = e.createdAt
 	b.entities[e.id] = e
 }
@@ -43,7 +44,8 @@ func (b *Board) GetEntities() EntityMap {
 	return b.entities
 }
 
-// Returns an array of the current entities
+// Returns an array of the current entities, ordered by id so
+// that the order is the same for every call.
 func (b *Board) GetEntityArray() []*Entity {
 	if len(b.entities) == 0 {
 		return nil
@@ -56,10 +58,18 @@ func (b *Board) GetEntityArray() []*Entity {
 		entities[i] = e
 		i++
 	}
+	sort.Sort(entitiesById(entities))
 
 	return entities
 }
 
+// Sorts a list of entities by their id
+type entitiesById []*Entity
+
+func (l entitiesById) Len() int           { return len(l) }
+func (l entitiesById) Less(i, j int) bool { return l[i].id < l[j].id }
+func (l entitiesById) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
 // Returns an entity at the id specified
 func (b *Board) GetEntityById(id EntityId) *Entity {
 	return b.entities[id]
@@ -80,25 +90,12 @@ func (b *Board) RemoveEntityById(id EntityId) *Entity {
 	return nil
 }
 
-// Returns an random entity
-func (b *Board) GetRandomEntity() *Entity {
-	i := 0
-	r := 0
-	n := len(b.entities)
-	if n <= 0 {
+// Returns an random entity picked using the random number generator
+func (b *Board) GetRandomEntity(rng *rand.Rand) *Entity {
+	entities := b.GetEntityArray()
+	if len(entities) == 0 {
 		return nil
-	} else if n == 1 {
-		r = n
-	} else {
-		r = rand.Intn(n - 1)
 	}
 
-	for _, e := range b.entities {
-		if i == r {
-			return e
-		}
-		i++
-	}
-
-	return nil
+	return entities[rng.Intn(len(entities))]
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ChatError struct {
+	ChatErrorString string
+	CodeNum         ActionCode
+}
+
+func (c *ChatError) Error() string    { return c.ChatErrorString }
+func (c *ChatError) Code() ActionCode { return c.CodeNum }
+
+var (
+	ChatErrorEmpty   = &ChatError{"Chat message is empty", ActionCodeInvalid}
+	ChatErrorTooLong = &ChatError{"Chat message is too long", ActionCodeInvalid}
+	ChatErrorMuted   = &ChatError{"Player is muted", ActionCodeMuted}
+)
+
+// Settings of the lobby, and game chat channels
+type ChatSettings struct {
+	MaxLength int      // Longest message, in characters
+	History   int      // Recent messages sent to players joining a channel
+	Filter    []string // Words masked in messages
+}
+
+const (
+	// Bytes of a chat action besides its text, with the longest request id
+	maxChatEnvelopeLen = 128
+)
+
+var (
+	DefaultChatSettings = ChatSettings{
+		MaxLength: 200,
+		History:   20,
+	}
+)
+
+// Returns the size of the largest chat action players can send with
+// the max length, if every character takes 4 bytes.
+func (s ChatSettings) MaxActionSize() int64 {
+	return int64(4*s.MaxLength + maxChatEnvelopeLen)
+}
+
+// Chat channels of the lobby, and each game. Messages are only sent to
+// the players in the channel they were sent in, and each channel keeps
+// its recent messages for the players who join it. Only used by the
+// world's event loop.
+type Chat struct {
+	settings ChatSettings
+	filter   map[string]bool
+	channels map[*Game][]MsgPartChatLine // Lobby's channel is the nil game
+}
+
+// Creates a new chat with empty channels
+func NewChat(settings ChatSettings) *Chat {
+	c := &Chat{channels: make(map[*Game][]MsgPartChatLine)}
+	c.SetSettings(settings)
+	return c
+}
+
+// Replaces the chat's settings. Histories longer than the new history
+// length are trimmed.
+func (c *Chat) SetSettings(settings ChatSettings) {
+	c.settings = settings
+	c.filter = make(map[string]bool, len(settings.Filter))
+	for _, word := range settings.Filter {
+		if word = strings.ToLower(strings.TrimSpace(word)); len(word) != 0 {
+			c.filter[word] = true
+		}
+	}
+	for g, lines := range c.channels {
+		c.channels[g] = trimChatHistory(lines, settings.History)
+	}
+}
+
+// Adds the player's message to the game's channel, or the lobby's if
+// the game is nil. Control characters are replaced by spaces, and
+// filtered words are masked. The line to send to the channel's players
+// is returned.
+func (c *Chat) Post(g *Game, p *Player, text string, now time.Time) (*MsgPartChatLine, error) {
+	text = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text))
+	if len(text) == 0 {
+		return nil, ChatErrorEmpty
+	}
+	if utf8.RuneCountInString(text) > c.settings.MaxLength {
+		return nil, ChatErrorTooLong
+	}
+
+	line := MsgPartChatLine{
+		Id: uint64(p.GetId()),
+		N:  p.GetName(),
+		M:  c.Filter(text),
+		T:  now.UnixNano() / int64(time.Millisecond),
+	}
+	c.channels[g] = trimChatHistory(append(c.channels[g], line), c.settings.History)
+	return &line, nil
+}
+
+// Returns the recent messages of the game's channel, oldest first
+func (c *Chat) History(g *Game) []MsgPartChatLine {
+	return c.channels[g]
+}
+
+// Removes the game's channel, and its history
+func (c *Chat) RemoveChannel(g *Game) {
+	delete(c.channels, g)
+}
+
+// Returns the text with each filtered word replaced by asterisks.
+// Words are matched whole, ignoring case.
+func (c *Chat) Filter(text string) string {
+	if len(c.filter) == 0 {
+		return text
+	}
+
+	out := make([]rune, 0, len(text))
+	word := make([]rune, 0, 16)
+	flush := func() {
+		if c.filter[strings.ToLower(string(word))] {
+			for i := 0; i < len(word); i++ {
+				out = append(out, '*')
+			}
+		} else {
+			out = append(out, word...)
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		out = append(out, r)
+	}
+	flush()
+	return string(out)
+}
+
+// Returns the last max lines of the history
+func trimChatHistory(lines []MsgPartChatLine, max int) []MsgPartChatLine {
+	if len(lines) <= max {
+		return lines
+	}
+	trimmed := make([]MsgPartChatLine, max)
+	copy(trimmed, lines[len(lines)-max:])
+	return trimmed
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatPost(t *testing.T) {
+	c := NewChat(ChatSettings{MaxLength: 10, History: 2, Filter: []string{" Darn "}})
+	p := newTestPlayer(1)
+	now := time.Unix(100, 0)
+
+	tests := []struct {
+		text string
+		line string
+		err  error
+	}{
+		{"hello", "hello", nil},
+		{"  a\tb\x00c  ", "a b c", nil},
+		{"darn it", "**** it", nil},
+		{"DARN,darns", "****,darns", nil},
+		{"éééééééééé", "éééééééééé", nil},
+		{"   ", "", ChatErrorEmpty},
+		{"12345678901", "", ChatErrorTooLong},
+	}
+	for _, test := range tests {
+		line, err := c.Post(nil, p, test.text, now)
+		if err != test.err {
+			t.Errorf("%q expected error %v got %v", test.text, test.err, err)
+		} else if err == nil && line.M != test.line {
+			t.Errorf("%q expected %q got %q", test.text, test.line, line.M)
+		}
+	}
+
+	history := c.History(nil)
+	if len(history) != 2 || history[1].M != strings.Repeat("é", 10) {
+		t.Fatalf("Expected the last 2 lines, %+v", history)
+	}
+	if len(c.History(&Game{})) != 0 {
+		t.Fatal("Expected games to have their own channel")
+	}
+}
+
+func TestChatActionFitsMessageSize(t *testing.T) {
+	// Longest request id, and every character 4 bytes
+	text := strings.Repeat("\U0001F600", DefaultChatSettings.MaxLength)
+	action, _ := json.Marshal(map[string]interface{}{
+		"ReqId": strings.Repeat("9", maxReqIdLen),
+		"Act":   map[string]interface{}{"C": map[string]interface{}{"M": text}},
+	})
+	if int64(len(action)) > DefaultChatSettings.MaxActionSize() {
+		t.Fatalf("Chat action of %d bytes is larger than %d", len(action), DefaultChatSettings.MaxActionSize())
+	}
+	if DefaultConnLimits.MaxMessageSize < DefaultChatSettings.MaxActionSize() {
+		t.Fatal("Default max message size doesn't fit the longest chat message")
+	}
+	if _, err := NewChat(DefaultChatSettings).Post(nil, newTestPlayer(1), text, time.Now()); err != nil {
+		t.Fatal("Expected the longest chat message to be accepted, got", err)
+	}
+
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Expected the default config to be valid, got", err)
+	}
+	cfg.Chat.MaxLength = 300
+	if err := cfg.Validate(); err != ConfigErrorChatSize {
+		t.Fatal("Expected a max length the message size can't fit to fail, got", err)
+	}
+	cfg.Connection.MaxMessageSize = 4096
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Expected a larger message size to fit, got", err)
+	}
+}
+
+// Registers a player of the account with the world, and returns their
+// instance
+func registerTestPlayer(t *testing.T, w *World, id PlayerId, account *Account) (*Player, *PlayerInstance) {
+	conn := &testConn{}
+	p := NewPlayer(id, account, conn, DefaultPlayerLimits)
+	if err := w.registerPlayer(p, conn, "", true); err != nil {
+		t.Fatal("Failed to register player,", err)
+	}
+	return p, w.players[p]
+}
+
+func TestMuteKeptByAccount(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	account := &Account{Id: "local:jo", Name: "Jo"}
+	p, info := registerTestPlayer(t, w, 1, account)
+
+	if err := w.setPlayerMuted(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.procChat(p, info, "hi"); err != ChatErrorMuted {
+		t.Fatal("Expected the muted player's chat to be refused, got", err)
+	}
+
+	// Reconnecting as the same account keeps the mute
+	w.unregisterPlayer(p)
+	p, info = registerTestPlayer(t, w, 2, account)
+	if !info.Muted {
+		t.Fatal("Expected the mute to be applied when the account reconnects")
+	}
+	if err := w.procChat(p, info, "hi"); err != ChatErrorMuted {
+		t.Fatal("Expected the reconnected player's chat to be refused, got", err)
+	}
+
+	// Every player of the account is unmuted
+	other, otherInfo := registerTestPlayer(t, w, 3, account)
+	if err := w.setPlayerMuted(3, false); err != nil {
+		t.Fatal(err)
+	}
+	if info.Muted || otherInfo.Muted {
+		t.Fatal("Expected all of the account's players to be unmuted")
+	}
+	if err := w.procChat(other, otherInfo, "hi"); err != nil {
+		t.Fatal("Expected the unmuted player to chat, got", err)
+	}
+}
+
+func TestMuteGuestForSession(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	w.SessionGrace = time.Minute
+	guest := &Account{Guest: true}
+	p, info := registerTestPlayer(t, w, 1, guest)
+	w.setPlayerMuted(1, true)
+
+	// Resuming the session keeps the same instance, and so the mute
+	if w.playerConnLost(p, info.Conn); !info.Muted {
+		t.Fatal("Expected the detached guest to stay muted")
+	}
+
+	// Other guests aren't muted, and the guest's mute is forgotten once
+	// their session ends
+	if _, other := registerTestPlayer(t, w, 2, guest); other.Muted {
+		t.Fatal("Expected other guests not to be muted")
+	}
+	w.unregisterPlayer(p)
+	if len(w.muted) != 0 {
+		t.Fatal("Expected the guest's mute to be dropped with their session, got", w.muted)
+	}
+}
+
+func TestMuteUnknownPlayer(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	if err := w.setPlayerMuted(1, true); err != WorldErrorPlayerNotRegistered {
+		t.Fatal("Expected an unknown player to fail, got", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+)
+
+// Source of the current time used by a game's simulation
+type Clock interface {
+	// Returns the clock's current time
+	Now() time.Time
+	// Moves the clock forward by the duration. Clocks which follow
+	// the wall clock ignore this.
+	Advance(d time.Duration)
+}
+
+// Clock following the system's wall clock
+type WallClock struct{}
+
+func (c WallClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (c WallClock) Advance(d time.Duration) {}
+
+// Clock which only moves forward when advanced. Games use this so
+// the simulation's time is derived from the number of steps taken
+// instead of the wall clock, making the game reproducible.
+type StepClock struct {
+	now time.Time
+}
+
+// Creates a new step clock starting at the time provided
+func NewStepClock(start time.Time) *StepClock {
+	return &StepClock{now: start}
+}
+
+func (c *StepClock) Now() time.Time {
+	return c.now
+}
+
+func (c *StepClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+)
+
+type CodecError struct {
+	CodecErrorString string
+}
+
+func (c *CodecError) Error() string { return c.CodecErrorString }
+
+var (
+	CodecErrorShortFrame = &CodecError{"Binary frame ended before the message was read"}
+	CodecErrorUnknownTag = &CodecError{"Binary frame has an unknown message tag"}
+)
+
+// Encodes the messages sent to a connection, and decodes the messages
+// received from it. The codec used by a connection is negotiated with
+// the client by websocket subprotocol, using the codec's name.
+type Codec interface {
+	// Name of the websocket subprotocol the codec is selected with
+	Name() string
+	// Websocket message type encoded messages are sent as
+	MessageType() int
+	// Encodes the message to be sent to the client
+	Encode(msg interface{}) ([]byte, error)
+	// Decodes a message received from the client
+	Decode(data []byte, msg *MessageIn) error
+}
+
+const (
+	CodecJSON   = "apollo.json"
+	CodecBinary = "apollo.bin"
+)
+
+var (
+	// Codecs in the order the server prefers them
+	codecs = []Codec{&BinaryCodec{}, &JSONCodec{}}
+)
+
+// Adds a new codec clients can negotiate, replacing any existing codec
+// with the same name. New codecs are preferred the least.
+func RegisterCodec(codec Codec) {
+	for i, c := range codecs {
+		if c.Name() == codec.Name() {
+			codecs[i] = codec
+			return
+		}
+	}
+	codecs = append(codecs, codec)
+}
+
+// Returns the names of the codecs in the order the server prefers them,
+// to be offered as websocket subprotocols.
+func CodecNames() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// Returns the codec with the name. Clients which don't request a
+// subprotocol are sent JSON, so it is returned if the name is unknown.
+func GetCodec(name string) Codec {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return &JSONCodec{}
+}
+
+// Codec encoding the messages as JSON text
+type JSONCodec struct{}
+
+func (c JSONCodec) Name() string     { return CodecJSON }
+func (c JSONCodec) MessageType() int { return websocket.TextMessage }
+
+func (c JSONCodec) Encode(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (c JSONCodec) Decode(data []byte, msg *MessageIn) error {
+	return json.Unmarshal(data, msg)
+}
+
+// Tags identifying the message in a binary frame
+const (
+	binTagJSON         = byte(0) // JSON encoded message follows
+	binTagGameUpdate   = byte(1)
+	binTagPlayerAction = byte(2)
+)
+
+// Flags of the optional parts of a binary message
+const (
+	binFlagGameInfo = 1 << iota
+	binFlagGameType
+	binFlagRound
+	binFlagRoundResults
+	binFlagSnapshot
+)
+
+// All fields of an entity
+const binEntityFieldsAll = MsgEntityFieldType | MsgEntityFieldState |
+	MsgEntityFieldX | MsgEntityFieldY | MsgEntityFieldColor |
+	MsgEntityFieldTtl | MsgEntityFieldCreatedAt | MsgEntityFieldUpdatedAt
+
+// Flags of the parts of a binary player action
+const (
+	binFlagActionWorld = 1 << iota
+	binFlagActionGame
+	binFlagActionChat
+)
+
+// Codec encoding game updates and player actions in a compact binary
+// format. Each frame starts with a tag byte identifying the message.
+// Integers are varints, signed integers are zig-zag encoded, strings and
+// lists are prefixed by their length, and the times entities were created
+// and updated at are the difference from the previous entity's. Game
+// seeds are never negative, and are sent unsigned so they stay within
+// 53 bits. Entities only include the fields flagged in them, or all
+// fields if none are. Messages without a binary encoding are sent as
+// JSON following the JSON tag.
+type BinaryCodec struct{}
+
+func (c BinaryCodec) Name() string     { return CodecBinary }
+func (c BinaryCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (c BinaryCodec) Encode(msg interface{}) ([]byte, error) {
+	w := &binWriter{}
+	switch m := msg.(type) {
+	case *MsgGameUpdate:
+		w.byte(binTagGameUpdate)
+		w.gameUpdate(m)
+	default:
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		w.byte(binTagJSON)
+		w.buf = append(w.buf, data...)
+	}
+	return w.buf, nil
+}
+
+func (c BinaryCodec) Decode(data []byte, msg *MessageIn) error {
+	if len(data) == 0 {
+		return CodecErrorShortFrame
+	}
+
+	switch data[0] {
+	case binTagJSON:
+		return json.Unmarshal(data[1:], msg)
+	case binTagPlayerAction:
+		r := &binReader{buf: data[1:]}
+		r.playerAction(msg)
+		return r.err
+	}
+	return CodecErrorUnknownTag
+}
+
+// Appends binary encoded values to a buffer
+type binWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *binWriter) uint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binWriter) int(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binWriter) bool(b bool) {
+	if b {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+}
+
+func (w *binWriter) str(s string) {
+	w.uint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binWriter) gameUpdate(m *MsgGameUpdate) {
+	var flags uint64
+	if m.G != nil {
+		flags |= binFlagGameInfo
+	}
+	if m.Gt != nil {
+		flags |= binFlagGameType
+	}
+	if m.Rd != nil {
+		flags |= binFlagRound
+	}
+	if m.Rs != nil {
+		flags |= binFlagRoundResults
+	}
+	if m.Sn {
+		flags |= binFlagSnapshot
+	}
+	w.uint(flags)
+	w.uint(m.Sq)
+
+	if m.G != nil {
+		w.uint(m.G.Id)
+		w.str(m.G.T)
+		w.int(int64(m.G.P))
+		w.int(int64(m.G.Mp))
+		w.int(int64(m.G.S))
+		w.uint(uint64(m.G.Sd))
+	}
+	if m.Gt != nil {
+		w.str(m.Gt.N)
+		w.int(int64(m.Gt.R))
+		w.int(int64(m.Gt.C))
+		w.int(int64(m.Gt.P))
+		w.int(int64(m.Gt.Cs))
+	}
+	if m.Rd != nil {
+		w.int(int64(m.Rd.N))
+		w.int(int64(m.Rd.St))
+		w.int(m.Rd.T)
+		w.int(int64(m.Rd.Ts))
+	}
+	if m.Rs != nil {
+		w.uint(uint64(len(m.Rs.W)))
+		for _, id := range m.Rs.W {
+			w.uint(id)
+		}
+		w.playerInfos(m.Rs.Ps)
+	}
+	w.playerInfos(m.Ps)
+	w.playerInfos(m.Ss)
+
+	w.uint(uint64(len(m.Es)))
+	var cAt, uAt int64
+	for _, e := range m.Es {
+		fields := e.F
+		if fields == 0 {
+			fields = binEntityFieldsAll
+		}
+		w.uint(e.Id)
+		w.uint(uint64(e.F))
+		if fields&MsgEntityFieldType != 0 {
+			w.int(int64(e.T))
+		}
+		if fields&MsgEntityFieldState != 0 {
+			w.int(int64(e.St))
+		}
+		if fields&MsgEntityFieldX != 0 {
+			w.int(int64(e.X))
+		}
+		if fields&MsgEntityFieldY != 0 {
+			w.int(int64(e.Y))
+		}
+		if fields&MsgEntityFieldColor != 0 {
+			w.int(int64(e.C))
+		}
+		if fields&MsgEntityFieldTtl != 0 {
+			w.int(e.Ttl)
+		}
+		if fields&MsgEntityFieldCreatedAt != 0 {
+			w.int(e.CAt - cAt)
+			cAt = e.CAt
+		}
+		if fields&MsgEntityFieldUpdatedAt != 0 {
+			w.int(e.UAt - uAt)
+			uAt = e.UAt
+		}
+	}
+}
+
+func (w *binWriter) playerInfos(infos []MsgPartPlayerInfo) {
+	w.uint(uint64(len(infos)))
+	for _, p := range infos {
+		w.uint(p.Id)
+		w.int(int64(p.St))
+		w.str(p.N)
+		w.int(int64(p.Sc))
+	}
+}
+
+// Reads binary encoded values from a buffer. The first error is kept,
+// and all reads after it return zero values.
+type binReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = CodecErrorShortFrame
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = CodecErrorShortFrame
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binReader) str() string {
+	l := r.uint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.buf)) < l {
+		r.err = CodecErrorShortFrame
+		return ""
+	}
+	s := string(r.buf[:l])
+	r.buf = r.buf[l:]
+	return s
+}
+
+// Reads a player action, and the world, game, and chat parts flagged in it
+func (r *binReader) playerAction(msg *MessageIn) {
+	msg.ReqId = r.str()
+	flags := r.uint()
+
+	msg.Act = &MsgPlayerAction{}
+	if flags&binFlagActionWorld != 0 {
+		msg.Act.W = &MsgPartActionWorld{
+			C: int(r.int()),
+			G: r.uint(),
+			T: r.str(),
+			A: r.str(),
+			L: int(r.int()),
+			O: int(r.int()),
+		}
+	}
+	if flags&binFlagActionGame != 0 {
+		msg.Act.G = &MsgPartActionGame{
+			C:  int(r.int()),
+			E:  r.uint(),
+			Sq: r.uint(),
+		}
+	}
+	if flags&binFlagActionChat != 0 {
+		msg.Act.C = &MsgPartActionChat{M: r.str()}
+	}
+}
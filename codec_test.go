@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryVarints(t *testing.T) {
+	uints := []uint64{0, 1, 127, 128, 300, math.MaxUint32, 1<<53 - 1, math.MaxUint64}
+	ints := []int64{0, 1, -1, 63, -64, 64, -65, math.MaxInt32, math.MinInt32, math.MaxInt64, math.MinInt64}
+	strs := []string{"", "a", "héllo", "日本語", string(make([]byte, 300))}
+
+	w := &binWriter{}
+	for _, v := range uints {
+		w.uint(v)
+	}
+	for _, v := range ints {
+		w.int(v)
+	}
+	for _, s := range strs {
+		w.str(s)
+	}
+
+	r := &binReader{buf: w.buf}
+	for _, v := range uints {
+		if got := r.uint(); got != v {
+			t.Error("Expected uint", v, "got", got)
+		}
+	}
+	for _, v := range ints {
+		if got := r.int(); got != v {
+			t.Error("Expected int", v, "got", got)
+		}
+	}
+	for _, s := range strs {
+		if got := r.str(); got != s {
+			t.Errorf("Expected string %q got %q", s, got)
+		}
+	}
+	if r.err != nil || len(r.buf) != 0 {
+		t.Fatal("Expected the buffer to be read exactly,", r.err, len(r.buf))
+	}
+	if r.uint(); r.err != CodecErrorShortFrame {
+		t.Fatal("Expected a short frame reading past the end, got", r.err)
+	}
+}
+
+func TestBinaryZigZag(t *testing.T) {
+	// Encoded the same as apollo.js, 2n for positive and -2n-1 for negative
+	cases := map[int64][]byte{0: {0}, -1: {1}, 1: {2}, -2: {3}, 63: {126}, -64: {127}, 64: {128, 1}}
+	for v, expected := range cases {
+		w := &binWriter{}
+		w.int(v)
+		if !reflect.DeepEqual(w.buf, expected) {
+			t.Error("Expected", v, "encoded as", expected, "got", w.buf)
+		}
+	}
+}
+
+// Encodes the action the same way apollo.js does
+func encodeTestAction(msg *MessageIn) []byte {
+	w := &binWriter{}
+	w.byte(binTagPlayerAction)
+	w.str(msg.ReqId)
+	var flags uint64
+	if msg.Act.W != nil {
+		flags |= binFlagActionWorld
+	}
+	if msg.Act.G != nil {
+		flags |= binFlagActionGame
+	}
+	if msg.Act.C != nil {
+		flags |= binFlagActionChat
+	}
+	w.uint(flags)
+	if a := msg.Act.W; a != nil {
+		w.int(int64(a.C))
+		w.uint(a.G)
+		w.str(a.T)
+		w.str(a.A)
+		w.int(int64(a.L))
+		w.int(int64(a.O))
+	}
+	if a := msg.Act.G; a != nil {
+		w.int(int64(a.C))
+		w.uint(a.E)
+		w.uint(a.Sq)
+	}
+	if a := msg.Act.C; a != nil {
+		w.str(a.M)
+	}
+	return w.buf
+}
+
+func TestBinaryPlayerActions(t *testing.T) {
+	actions := []*MessageIn{
+		{ReqId: "1", Act: &MsgPlayerAction{W: &MsgPartActionWorld{C: int(PlayerCmdWorldListGames)}}},
+		{ReqId: "2", Act: &MsgPlayerAction{W: &MsgPartActionWorld{
+			C: int(PlayerCmdWorldLeaderboard),
+			G: math.MaxUint64,
+			T: "duel",
+			A: "account-é",
+			L: int(LeaderboardAllTime),
+			O: -5,
+		}}},
+		{ReqId: "3", Act: &MsgPlayerAction{G: &MsgPartActionGame{C: int(PlayerCmdGameSelectEntity), E: math.MaxUint64}}},
+		{ReqId: "", Act: &MsgPlayerAction{G: &MsgPartActionGame{C: int(PlayerCmdGameAck), Sq: math.MaxUint64}}},
+		{ReqId: "5", Act: &MsgPlayerAction{C: &MsgPartActionChat{M: "gg 日本"}}},
+		{ReqId: "6", Act: &MsgPlayerAction{
+			W: &MsgPartActionWorld{C: -1},
+			G: &MsgPartActionGame{C: -1},
+			C: &MsgPartActionChat{},
+		}},
+	}
+
+	codec := BinaryCodec{}
+	for _, expected := range actions {
+		var msg MessageIn
+		if err := codec.Decode(encodeTestAction(expected), &msg); err != nil {
+			t.Fatal("Failed to decode", expected.ReqId, err)
+		}
+		if !reflect.DeepEqual(&msg, expected) {
+			t.Errorf("Expected %+v got %+v", expected.Act, msg.Act)
+		}
+	}
+}
+
+func TestBinaryPlayerActionBytes(t *testing.T) {
+	// Bytes apollo.js sends for {ReqId: "7", Act: {C: {M: "hi"}}}, and
+	// for a selection of entity 300
+	var msg MessageIn
+	if err := (BinaryCodec{}).Decode([]byte{2, 1, '7', 4, 2, 'h', 'i'}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ReqId != "7" || msg.Act.C == nil || msg.Act.C.M != "hi" || msg.Act.W != nil || msg.Act.G != nil {
+		t.Fatalf("Unexpected chat action %+v", msg.Act)
+	}
+
+	msg = MessageIn{}
+	if err := (BinaryCodec{}).Decode([]byte{2, 0, 2, 0, 172, 2, 0}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Act.G == nil || msg.Act.G.E != 300 || msg.Act.G.C != int(PlayerCmdGameSelectEntity) {
+		t.Fatalf("Unexpected game action %+v", msg.Act)
+	}
+}
+
+func TestBinaryDecodeErrors(t *testing.T) {
+	codec := BinaryCodec{}
+	frames := map[string][]byte{
+		"empty":       {},
+		"unknown tag": {9},
+		"no flags":    {binTagPlayerAction, 1, 'a'},
+		"short str":   {binTagPlayerAction, 5, 'a'},
+		"short world": {binTagPlayerAction, 0, binFlagActionWorld, 0},
+		"short chat":  {binTagPlayerAction, 0, binFlagActionChat, 3, 'a'},
+		"bad varint":  {binTagPlayerAction, 0, binFlagActionGame, 0x80},
+	}
+	for name, frame := range frames {
+		var msg MessageIn
+		if err := codec.Decode(frame, &msg); err == nil {
+			t.Error("Expected", name, "frame to fail")
+		}
+	}
+
+	var msg MessageIn
+	data := append([]byte{binTagJSON}, `{"ReqId":"8","Act":{"C":{"M":"hi"}}}`...)
+	if err := codec.Decode(data, &msg); err != nil || msg.Act.C.M != "hi" {
+		t.Fatal("Failed to decode JSON in a binary frame,", err)
+	}
+}
+
+// Decodes a binary game update the same way apollo.js does
+func decodeTestGameUpdate(t *testing.T, data []byte) *MsgGameUpdate {
+	if data[0] != binTagGameUpdate {
+		t.Fatal("Expected the game update tag, got", data[0])
+	}
+	r := &binReader{buf: data[1:]}
+	playerInfos := func() []MsgPartPlayerInfo {
+		n := r.uint()
+		if n == 0 {
+			return nil
+		}
+		infos := make([]MsgPartPlayerInfo, n)
+		for i := range infos {
+			infos[i] = MsgPartPlayerInfo{Id: r.uint(), St: int(r.int()), N: r.str(), Sc: int(r.int())}
+		}
+		return infos
+	}
+
+	m := &MsgGameUpdate{GU: true}
+	flags := r.uint()
+	m.Sq = r.uint()
+	m.Sn = flags&binFlagSnapshot != 0
+	if flags&binFlagGameInfo != 0 {
+		m.G = &MsgPartGameInfo{Id: r.uint(), T: r.str(), P: int(r.int()), Mp: int(r.int()), S: int(r.int()), Sd: int64(r.uint())}
+	}
+	if flags&binFlagGameType != 0 {
+		m.Gt = &MsgPartGameType{N: r.str(), R: int(r.int()), C: int(r.int()), P: int(r.int()), Cs: int(r.int())}
+	}
+	if flags&binFlagRound != 0 {
+		m.Rd = &MsgPartRound{N: int(r.int()), St: int(r.int()), T: r.int(), Ts: int(r.int())}
+	}
+	if flags&binFlagRoundResults != 0 {
+		m.Rs = &MsgPartRoundResults{W: make([]uint64, r.uint())}
+		for i := range m.Rs.W {
+			m.Rs.W[i] = r.uint()
+		}
+		m.Rs.Ps = playerInfos()
+	}
+	m.Ps = playerInfos()
+	m.Ss = playerInfos()
+
+	if n := r.uint(); n != 0 {
+		m.Es = make([]MsgPartEntity, n)
+	}
+	var cAt, uAt int64
+	for i := range m.Es {
+		e := MsgPartEntity{Id: r.uint(), F: int(r.uint())}
+		fields := e.F
+		if fields == 0 {
+			fields = binEntityFieldsAll
+		}
+		if fields&MsgEntityFieldType != 0 {
+			e.T = int(r.int())
+		}
+		if fields&MsgEntityFieldState != 0 {
+			e.St = int(r.int())
+		}
+		if fields&MsgEntityFieldX != 0 {
+			e.X = int(r.int())
+		}
+		if fields&MsgEntityFieldY != 0 {
+			e.Y = int(r.int())
+		}
+		if fields&MsgEntityFieldColor != 0 {
+			e.C = int(r.int())
+		}
+		if fields&MsgEntityFieldTtl != 0 {
+			e.Ttl = r.int()
+		}
+		if fields&MsgEntityFieldCreatedAt != 0 {
+			cAt += r.int()
+			e.CAt = cAt
+		}
+		if fields&MsgEntityFieldUpdatedAt != 0 {
+			uAt += r.int()
+			e.UAt = uAt
+		}
+		m.Es[i] = e
+	}
+	if r.err != nil || len(r.buf) != 0 {
+		t.Fatal("Game update not read exactly,", r.err, len(r.buf))
+	}
+	return m
+}
+
+func TestBinaryGameUpdates(t *testing.T) {
+	updates := []*MsgGameUpdate{
+		{GU: true},
+		{GU: true, Sq: math.MaxUint64, Sn: true,
+			G:  &MsgPartGameInfo{Id: math.MaxUint64, T: "duel", P: 2, Mp: 2, S: 1, Sd: maxGameSeed},
+			Gt: &MsgPartGameType{N: "duel", R: 7, C: 7, P: 2, Cs: 4},
+			Rd: &MsgPartRound{N: 3, St: int(GameStatePaused), T: -1, Ts: 50},
+			Rs: &MsgPartRoundResults{
+				W:  []uint64{math.MaxUint64},
+				Ps: []MsgPartPlayerInfo{{Id: math.MaxUint64, St: 3, N: "Pläyer", Sc: -10}},
+			},
+			Ps: []MsgPartPlayerInfo{{Id: 1, N: "a", Sc: math.MaxInt32}, {Id: 2, St: 2, N: "", Sc: math.MinInt32}},
+			Ss: []MsgPartPlayerInfo{{Id: 3, N: "spectator"}},
+		},
+		{GU: true, Sq: 9, Es: []MsgPartEntity{
+			{Id: 0, T: 0, St: 1, X: 6, Y: 0, C: 3, Ttl: 5000, CAt: 1700000000, UAt: 1700000005},
+			{Id: math.MaxUint64, St: 3, X: -1, Y: -2, C: -3, Ttl: -1, CAt: 1600000000, UAt: 0},
+			{Id: 5, F: MsgEntityFieldState, St: 2},
+			{Id: 6, F: MsgEntityFieldUpdatedAt | MsgEntityFieldX, X: 2, UAt: math.MaxInt32},
+			{Id: 7, F: MsgEntityFieldCreatedAt, CAt: -1},
+		}},
+	}
+
+	codec := BinaryCodec{}
+	for _, expected := range updates {
+		data, err := codec.Encode(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeTestGameUpdate(t, data); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %+v\ngot %+v", expected, got)
+		}
+	}
+}
+
+func TestBinaryGameUpdateBytes(t *testing.T) {
+	// An acknowledgeable update of a single selected entity, as apollo.js
+	// expects it byte for byte
+	update := &MsgGameUpdate{GU: true, Sq: 200, Es: []MsgPartEntity{{Id: 1, F: MsgEntityFieldState, St: 2}}}
+	data, err := (BinaryCodec{}).Encode(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{binTagGameUpdate, 0, 200, 1, 0, 0, 1, 1, MsgEntityFieldState, 4}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatal("Expected", expected, "got", data)
+	}
+}
+
+func TestJSONTaggedMessages(t *testing.T) {
+	messages := []interface{}{
+		MsgCreateActionReply("1", WorldErrorGameFull),
+		&MsgWorldUpdate{WU: true, G: -1, Q: true, Gs: []MsgPartGameInfo{{Id: math.MaxUint32, T: "duel", Sd: maxGameSeed}}},
+		&MsgSession{SU: true, S: "token", Id: 5, N: "name", A: "account", Gr: 30000, R: true},
+		MsgCreateNotice("notice"),
+		MsgCreateShutdown(-1),
+		&MsgProfile{PF: true, A: "a", N: "n", Gp: 1, W: 1, Ts: -3, Rt: 1500},
+		&MsgLeaderboard{LB: true, T: "duel", W: 2, N: 1, Es: []MsgPartLeaderboardEntry{{R: 1, A: "a", Sc: 10}}},
+		&MsgChat{CH: true, G: -1, H: true, Ls: []MsgPartChatLine{{Id: math.MaxUint32, N: "n", M: "日本", T: 1}}},
+	}
+
+	for _, codec := range []Codec{BinaryCodec{}, JSONCodec{}} {
+		for _, expected := range messages {
+			data, err := codec.Encode(expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.Name() == CodecBinary {
+				if data[0] != binTagJSON {
+					t.Fatal("Expected the JSON tag, got", data[0])
+				}
+				data = data[1:]
+			}
+			got := reflect.New(reflect.TypeOf(expected).Elem()).Interface()
+			if err := json.Unmarshal(data, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: expected %+v got %+v", codec.Name(), expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type ConfigError struct {
+	ConfigErrorString string
+}
+
+func (c *ConfigError) Error() string { return c.ConfigErrorString }
+
+var (
+	ConfigErrorWsConnType     = &ConfigError{"Unknown websocket library, only gorilla is supported"}
+	ConfigErrorConnection     = &ConfigError{"Connection timeouts and message size must be positive, and pings sent more often than the read timeout"}
+	ConfigErrorGame           = &ConfigError{"Game step must be positive, and the session grace and drain time can't be negative"}
+	ConfigErrorLimits         = &ConfigError{"Queue and action limits must be positive, and queue max items at least the queue high water"}
+	ConfigErrorEnvUnsupported = &ConfigError{"Setting can't be set by an environment variable"}
+	ConfigErrorNoAuth         = &ConfigError{"Guests must be allowed if neither a token secret nor users file is set"}
+	ConfigErrorTokenTTL       = &ConfigError{"Token ttl must be positive"}
+	ConfigErrorMatchmaking    = &ConfigError{"Matchmaking band, band growth, and max wait can't be negative"}
+	ConfigErrorChat           = &ConfigError{"Chat max length must be positive, and history can't be negative"}
+	ConfigErrorChatSize       = &ConfigError{"Connection max message size must fit a chat message of the chat max length, at 4 bytes a character"}
+)
+
+// Prefix of the environment variables which override config settings
+const configEnvPrefix = "APOLLO_"
+
+// Duration in a config file, written as a string such as "250ms"
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration { return time.Duration(d) }
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Configuration of the server. The server, connection, and auth settings
+// are only applied when the server starts, the rest are reloaded when the
+// server receives SIGHUP.
+type Config struct {
+	Server      ServerConfig
+	Connection  ConnectionConfig
+	Game        GameConfig
+	Limits      LimitsConfig
+	GameTypes   GameTypesConfig
+	Auth        AuthConfig
+	Matchmaking MatchmakingConfig
+	Chat        ChatConfig
+}
+
+type ServerConfig struct {
+	Addr         string // IP address the server listens on
+	Port         uint   // Port the server listens on
+	WsPort       uint   // Port the websockets are served on
+	Root         string // URL path root of the webapp
+	Static       bool   // Serve the static assets
+	Websocket    string // Websocket library
+	TlsCrt       string
+	TlsKey       string
+	Replays      string // Directory games are recorded to
+	AdminToken   string // Token required by the admin API, disabled if empty
+	Profiles     string // File player profiles are stored in, disabled if empty
+	Leaderboards string // File leaderboards are stored in, kept in memory if empty
+}
+
+type ConnectionConfig struct {
+	ReadTimeout    Duration
+	PingPeriod     Duration
+	WriteTimeout   Duration
+	MaxMessageSize int64
+}
+
+// Settings of new games, and players' sessions
+type GameConfig struct {
+	Step         Duration // Time between simulation steps
+	SessionGrace Duration // Time a disconnected player's session is held
+	Drain        Duration // Time rounds are given to finish when shutting down
+}
+
+// Limits of new players
+type LimitsConfig struct {
+	QueueHighWater int
+	QueueMaxItems  int
+	EvictAfter     Duration
+	GameRate       float64
+	GameBurst      int
+	WorldRate      float64
+	WorldBurst     int
+	ChatRate       float64
+	ChatBurst      int
+	Strikes        int
+}
+
+// Game types added to the presets. Game types are loaded from the JSON
+// file first if one is set, then the types defined in the config.
+type GameTypesConfig struct {
+	File    string
+	Default string
+	Types   []*GameType
+}
+
+// How waiting players are placed in games by rating. Applied to the
+// players already waiting on reload.
+type MatchmakingConfig struct {
+	Band       float64  // Rating difference accepted when a player starts waiting
+	BandGrowth float64  // Rating difference the band widens by each second
+	MaxWait    Duration // Longest a player waits for a game in their band
+}
+
+// Settings of the lobby, and game chat. Applied to the existing chat
+// channels on reload.
+type ChatConfig struct {
+	MaxLength int      // Longest message, in characters
+	History   int      // Recent messages sent to players joining a channel
+	Filter    []string // Words masked in messages
+}
+
+// How players are authenticated. Only applied when the server starts.
+type AuthConfig struct {
+	Guests      bool     // Allow players without credentials to connect as guests
+	TokenSecret string   // Secret bearer tokens are signed with, tokens are disabled if empty
+	TokenTTL    Duration // Time tokens issued by the login endpoint are valid for
+	UsersFile   string   // JSON password store file, disabled if empty
+}
+
+// Returns the config with the default settings
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Websocket: "gorilla",
+		},
+		Connection: ConnectionConfig{
+			ReadTimeout:    Duration(DefaultConnLimits.ReadWait),
+			PingPeriod:     Duration(DefaultConnLimits.PingPeriod),
+			WriteTimeout:   Duration(DefaultConnLimits.WriteWait),
+			MaxMessageSize: DefaultConnLimits.MaxMessageSize,
+		},
+		Game: GameConfig{
+			Step:         Duration(delayBetweenSimStep),
+			SessionGrace: Duration(30 * time.Second),
+			Drain:        Duration(60 * time.Second),
+		},
+		Limits: LimitsConfig{
+			QueueHighWater: DefaultQueueLimits.HighWater,
+			QueueMaxItems:  DefaultQueueLimits.MaxItems,
+			EvictAfter:     Duration(DefaultQueueLimits.EvictAfter),
+			GameRate:       DefaultActionLimits.GameRate,
+			GameBurst:      DefaultActionLimits.GameBurst,
+			WorldRate:      DefaultActionLimits.WorldRate,
+			WorldBurst:     DefaultActionLimits.WorldBurst,
+			ChatRate:       DefaultActionLimits.ChatRate,
+			ChatBurst:      DefaultActionLimits.ChatBurst,
+			Strikes:        DefaultActionLimits.Strikes,
+		},
+		Auth: AuthConfig{
+			Guests:   true,
+			TokenTTL: Duration(24 * time.Hour),
+		},
+		Matchmaking: MatchmakingConfig{
+			Band:       DefaultMatchmakingRules.Band,
+			BandGrowth: DefaultMatchmakingRules.BandGrowth,
+			MaxWait:    Duration(DefaultMatchmakingRules.MaxWait),
+		},
+		Chat: ChatConfig{
+			MaxLength: DefaultChatSettings.MaxLength,
+			History:   DefaultChatSettings.History,
+		},
+	}
+}
+
+// Loads the config from the TOML file over the default settings, and
+// overrides the settings set by environment variables. If the path is
+// empty only the environment variables are applied. Keys in the file
+// are the settings' names in snake case, eg. "max_message_size".
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tree := make(map[string]interface{})
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+
+		// Decoded as JSON so game types are decoded the same way as
+		// game type files are. JSON matches keys to fields ignoring
+		// case, so only the underscores need removing.
+		encoded, err := json.Marshal(configKeys(tree))
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(encoded))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Returns the value with the underscores removed from all table keys
+func configKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			keys[strings.Replace(key, "_", "", -1)] = configKeys(item)
+		}
+		return keys
+	case []interface{}:
+		for i, item := range v {
+			v[i] = configKeys(item)
+		}
+	case []map[string]interface{}:
+		// Arrays of tables
+		tables := make([]interface{}, len(v))
+		for i, item := range v {
+			tables[i] = configKeys(item)
+		}
+		return tables
+	}
+	return value
+}
+
+// Overrides the settings with the environment variables set for them.
+// Variables are named by the section and setting, eg. the server's port
+// is APOLLO_SERVER_PORT. Lists of words are separated by commas. Game
+// types can't be set by environment variables, other than the default
+// and file.
+func (c *Config) applyEnv() error {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := configEnvPrefix + configEnvName(sections.Type().Field(i).Name) + "_"
+
+		for j := 0; j < section.NumField(); j++ {
+			name := prefix + configEnvName(section.Type().Field(j).Name)
+			value := os.Getenv(name)
+			if len(value) == 0 {
+				continue
+			}
+			if err := setConfigValue(section.Field(j), value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the setting's name as an environment variable, eg. WsPort
+// is WS_PORT.
+func configEnvName(field string) string {
+	name := make([]rune, 0, len(field)+4)
+	prevLower := false
+	for _, r := range field {
+		if unicode.IsUpper(r) && prevLower {
+			name = append(name, '_')
+		}
+		prevLower = unicode.IsLower(r)
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
+
+// Parses the text, and sets the setting to it
+func setConfigValue(field reflect.Value, text string) error {
+	if field.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint:
+		u, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return ConfigErrorEnvUnsupported
+		}
+		field.Set(reflect.ValueOf(strings.Split(text, ",")))
+	default:
+		return ConfigErrorEnvUnsupported
+	}
+	return nil
+}
+
+// Validates the settings, and that the game types can be loaded
+func (c *Config) Validate() error {
+	if c.Server.Websocket != "gorilla" && len(c.Server.Websocket) != 0 {
+		return ConfigErrorWsConnType
+	}
+
+	conn := c.Connection
+	if conn.ReadTimeout <= 0 || conn.PingPeriod <= 0 || conn.WriteTimeout <= 0 ||
+		conn.MaxMessageSize <= 0 || conn.PingPeriod >= conn.ReadTimeout {
+		return ConfigErrorConnection
+	}
+
+	if c.Game.Step <= 0 || c.Game.SessionGrace < 0 || c.Game.Drain < 0 {
+		return ConfigErrorGame
+	}
+
+	l := c.Limits
+	if l.QueueHighWater <= 0 || l.QueueMaxItems < l.QueueHighWater || l.EvictAfter <= 0 || l.GameRate <= 0 || l.GameBurst <= 0 ||
+		l.WorldRate <= 0 || l.WorldBurst <= 0 || l.ChatRate <= 0 || l.ChatBurst <= 0 || l.Strikes <= 0 {
+		return ConfigErrorLimits
+	}
+
+	if !c.Auth.Guests && len(c.Auth.TokenSecret) == 0 && len(c.Auth.UsersFile) == 0 {
+		return ConfigErrorNoAuth
+	}
+	if c.Auth.TokenTTL <= 0 {
+		return ConfigErrorTokenTTL
+	}
+	m := c.Matchmaking
+	if m.Band < 0 || m.BandGrowth < 0 || m.MaxWait < 0 {
+		return ConfigErrorMatchmaking
+	}
+	if c.Chat.MaxLength <= 0 || c.Chat.History < 0 {
+		return ConfigErrorChat
+	}
+	if conn.MaxMessageSize < c.ChatSettings().MaxActionSize() {
+		return ConfigErrorChatSize
+	}
+	_, err := c.GameTypeRegistry()
+	return err
+}
+
+// Creates the registry of the game type presets, and configured types
+func (c *Config) GameTypeRegistry() (*GameTypeRegistry, error) {
+	types := c.GameTypes.Types
+	defaultName := c.GameTypes.Default
+
+	if len(c.GameTypes.File) != 0 {
+		r, err := LoadGameTypeRegistry(c.GameTypes.File)
+		if err != nil {
+			return nil, err
+		}
+		types = append(r.List(), types...)
+		if len(defaultName) == 0 {
+			defaultName = r.Default().Name
+		}
+	}
+
+	return NewGameTypeRegistryWith(defaultName, types)
+}
+
+// Returns the token authenticator, or nil if tokens are disabled
+func (c *Config) TokenAuthenticator() *TokenAuthenticator {
+	if len(c.Auth.TokenSecret) == 0 {
+		return nil
+	}
+	return &TokenAuthenticator{Secret: []byte(c.Auth.TokenSecret)}
+}
+
+// Loads the password store, nil is returned if there is none
+func (c *Config) PasswordStore() (*PasswordStore, error) {
+	if len(c.Auth.UsersFile) == 0 {
+		return nil, nil
+	}
+	return LoadPasswordStore(c.Auth.UsersFile)
+}
+
+// Returns the limits of new websocket connections
+func (c *Config) ConnLimits() ConnLimits {
+	return ConnLimits{
+		ReadWait:       c.Connection.ReadTimeout.Duration(),
+		PingPeriod:     c.Connection.PingPeriod.Duration(),
+		WriteWait:      c.Connection.WriteTimeout.Duration(),
+		MaxMessageSize: c.Connection.MaxMessageSize,
+	}
+}
+
+// Returns the rules of the matchmaker
+func (c *Config) MatchmakingRules() MatchmakingRules {
+	return MatchmakingRules{
+		Band:       c.Matchmaking.Band,
+		BandGrowth: c.Matchmaking.BandGrowth,
+		MaxWait:    c.Matchmaking.MaxWait.Duration(),
+	}
+}
+
+// Returns the settings of the chat
+func (c *Config) ChatSettings() ChatSettings {
+	return ChatSettings{
+		MaxLength: c.Chat.MaxLength,
+		History:   c.Chat.History,
+		Filter:    c.Chat.Filter,
+	}
+}
+
+// Returns the limits of new players
+func (c *Config) PlayerLimits() PlayerLimits {
+	return PlayerLimits{
+		Queue: QueueLimits{
+			HighWater:  c.Limits.QueueHighWater,
+			MaxItems:   c.Limits.QueueMaxItems,
+			EvictAfter: c.Limits.EvictAfter.Duration(),
+		},
+		Actions: ActionLimits{
+			GameRate:   c.Limits.GameRate,
+			GameBurst:  c.Limits.GameBurst,
+			WorldRate:  c.Limits.WorldRate,
+			WorldBurst: c.Limits.WorldBurst,
+			ChatRate:   c.Limits.ChatRate,
+			ChatBurst:  c.Limits.ChatBurst,
+			Strikes:    c.Limits.Strikes,
+		},
+	}
+}
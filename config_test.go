@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Writes the config to a temporary file, and loads it
+func loadTestConfig(t *testing.T, data string) (*Config, error) {
+	path := filepath.Join(t.TempDir(), "apollo.toml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	cfg, err := LoadConfig("apollo.example.toml")
+	if err != nil {
+		t.Fatal("Failed to load the example config,", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Example config is invalid,", err)
+	}
+
+	defaults := DefaultConfig()
+	defaults.GameTypes = cfg.GameTypes
+	if len(cfg.Chat.Filter) == 0 {
+		// The example sets an empty filter
+		defaults.Chat.Filter = cfg.Chat.Filter
+	}
+	if !reflect.DeepEqual(cfg, defaults) {
+		t.Fatalf("Example config differs from the defaults,\n%+v\n%+v", cfg, defaults)
+	}
+
+	types, _ := cfg.GameTypeRegistry()
+	duel := types.Get("duel")
+	if duel == nil || duel.Players != 2 || duel.Match.MinGroupSize != 3 {
+		t.Fatalf("Expected the duel game type, %+v", duel)
+	}
+	if solo := types.Get("solo-practice"); solo == nil || solo.Round.TargetScore != 50 {
+		t.Fatalf("Expected the solo practice game type, %+v", solo)
+	}
+}
+
+func TestLoadConfigKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		check func(cfg *Config) bool // Nil if loading should fail
+	}{
+		{"snake case keys", "[connection]\nmax_message_size = 2048",
+			func(cfg *Config) bool { return cfg.Connection.MaxMessageSize == 2048 }},
+		{"integers and floats", "[server]\nport = 8080\n[limits]\ngame_rate = 2.5",
+			func(cfg *Config) bool { return cfg.Server.Port == 8080 && cfg.Limits.GameRate == 2.5 }},
+		{"durations", "[game]\nstep = \"100ms\"",
+			func(cfg *Config) bool { return cfg.Game.Step.Duration() == 100*time.Millisecond }},
+		{"invalid duration", "[game]\nstep = \"soon\"", nil},
+		{"arrays", "[chat]\nfilter = [\"darn\", \"heck\"]",
+			func(cfg *Config) bool { return reflect.DeepEqual(cfg.Chat.Filter, []string{"darn", "heck"}) }},
+		{"unknown key", "[server]\nno_such_setting = 1", nil},
+		{"wrong type", "[server]\nport = \"80\"", nil},
+		{"array of tables", "[[game_types.types]]\nname = \"a\"\nrows = 3\ncols = 3\nplayers = 1\n" +
+			"[[game_types.types]]\nname = \"b\"\nrows = 4\ncols = 4\nplayers = 2",
+			func(cfg *Config) bool {
+				types := cfg.GameTypes.Types
+				return len(types) == 2 && types[0].Name == "a" && types[1].Players == 2
+			}},
+	}
+
+	for _, test := range tests {
+		cfg, err := loadTestConfig(t, test.data)
+		if test.check == nil {
+			if err == nil {
+				t.Error(test.name, "expected an error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.name, "failed,", err)
+			continue
+		}
+		if !test.check(cfg) {
+			t.Errorf("%s decoded wrong, %+v", test.name, cfg)
+		}
+	}
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	t.Setenv("APOLLO_SERVER_PORT", "9090")
+	t.Setenv("APOLLO_GAME_STEP", "100ms")
+	t.Setenv("APOLLO_CHAT_FILTER", "darn,heck")
+
+	cfg, err := loadTestConfig(t, "[server]\nport = 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9090 || cfg.Game.Step.Duration() != 100*time.Millisecond ||
+		!reflect.DeepEqual(cfg.Chat.Filter, []string{"darn", "heck"}) {
+		t.Fatalf("Expected the environment to override the file, %+v", cfg)
+	}
+
+	t.Setenv("APOLLO_SERVER_PORT", "http")
+	if _, err := loadTestConfig(t, ""); err == nil {
+		t.Fatal("Expected an invalid port to fail")
+	}
+}
+
+func TestValidateLeavesPasswordStore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.UsersFile = filepath.Join(t.TempDir(), "missing.json")
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Expected the password store to only be loaded when used, got", err)
+	}
+	if _, err := cfg.PasswordStore(); err == nil {
+		t.Fatal("Expected loading a missing password store to fail")
+	}
+}
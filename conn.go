@@ -1,11 +1,7 @@
 package main
 
 import (
-	gnws "code.google.com/p/go.net/websocket"
-	"encoding/json"
-	gbws "github.com/garyburd/go-websocket/websocket"
-	"io"
-	"io/ioutil"
+	"github.com/gorilla/websocket"
 	"log"
 	"time"
 )
@@ -18,7 +14,6 @@ func (c *ConnError) Error() string { return c.ConnErrorString }
 
 var (
 	ConnErrorSendClosed = &ConnError{"Connection's send chan already closed"}
-	ConnErrorReadClosed = &ConnError{"Connection's reader chan already closed"}
 )
 
 type Connection interface {
@@ -28,239 +23,216 @@ type Connection interface {
 	ReadPump()
 	WritePump()
 	Close()
+	// Closes the client's connection with the close code and reason.
+	// Unlike the other methods it is safe to call from any goroutine.
+	Kick(code int, reason string)
 }
 
+// Close codes sent to clients when their connection is kicked.
+// Codes from 4000 are specific to Apollo.
 const (
-	readWait       = 60 * time.Second
-	pingPeriod     = 25 * time.Second
-	writeWait      = 10 * time.Second
-	maxMessageSize = 512
+	CloseCodeSlowClient  = 4000 // Client couldn't keep up with its messages
+	CloseCodeFlooding    = 4001 // Client sent too many actions
+	CloseCodeBadMessages = 4002 // Client sent too many invalid messages
+	CloseCodeKicked      = 4003 // Client was kicked by an admin
+	CloseCodeUnknownType = 4004 // Client requested a game type which doesn't exist
+	CloseCodeShutdown    = websocket.CloseGoingAway
 )
 
-// Creates a new instance of the ws
-func NewGbWsConn(id uint64, ws *gbws.Conn) *GbWsConn {
-	return &GbWsConn{
-		id:   id,
-		send: make(chan []byte, 256),
-		ws:   ws,
+// Timeouts, and limits of a websocket connection
+type ConnLimits struct {
+	ReadWait       time.Duration // Time allowed between reading messages, or pongs
+	PingPeriod     time.Duration // Time between pings, must be less than the read wait
+	WriteWait      time.Duration // Time allowed to write a message
+	MaxMessageSize int64         // Largest message read from the client
+}
+
+var (
+	DefaultConnLimits = ConnLimits{
+		ReadWait:       60 * time.Second,
+		PingPeriod:     25 * time.Second,
+		WriteWait:      10 * time.Second,
+		MaxMessageSize: 1024,
+	}
+)
+
+// Creates a new instance of the gorilla websocket connection. Messages
+// are encoded with the codec negotiated as the websocket's subprotocol.
+func NewWsConn(id uint64, ws *websocket.Conn, limits ConnLimits) *WsConn {
+	return &WsConn{
+		id:     id,
+		limits: limits,
+		send:   make(chan []byte, 256),
+		closed: make(chan bool),
+		done:   make(chan bool),
+		ws:     ws,
+		codec:  GetCodec(ws.Subprotocol()),
 	}
 }
 
-type GbWsConn struct {
-	id uint64
+// Connection object for use with the gorilla websocket
+type WsConn struct {
+	id     uint64
+	limits ConnLimits
 
 	// The websocket connection.
-	ws *gbws.Conn
+	ws *websocket.Conn
+
+	// Encodes and decodes the messages sent over the websocket
+	codec Codec
 
 	// Buffered channel of outbound messages.
 	send chan []byte
 
-	// Buffered channel for readers
+	// Closed when the connection is closed, so the read pump stops
+	// forwarding messages to the reader.
+	closed chan bool
+
+	// Closed when the write pump terminates, so sends don't block
+	// once nothing is writing to the client.
+	done chan bool
+
+	// Channel incoming messages are forwarded to
 	reader chan MessageIn
 }
 
 // Returns the connection's id
-func (c GbWsConn) GetId() uint64 {
+func (c WsConn) GetId() uint64 {
 	return c.id
 }
 
-// Sets the channel the connection should forward incomming messages to
-func (c *GbWsConn) AttachReader(reader chan MessageIn) {
+// Sets the channel the connection should forward incomming messages to.
+// The read pump closes the reader when the client's connection is lost.
+func (c *WsConn) AttachReader(reader chan MessageIn) {
 	c.reader = reader
 }
 
 // Serializes an object and sends it across the the wire
-func (c *GbWsConn) Send(msg interface{}) error {
+func (c *WsConn) Send(msg interface{}) error {
 	if c.send == nil {
 		return ConnErrorSendClosed
 	}
 
-	marshaled, err := json.Marshal(msg)
+	marshaled, err := c.codec.Encode(msg)
 	if err != nil {
 		log.Println("ERROR", "Connection", c.id, "Failed to marshal data to send to client")
 		return err
 	}
-	c.send <- marshaled
+	select {
+	case c.send <- marshaled:
+	case <-c.done:
+		return ConnErrorSendClosed
+	}
 	return nil
 }
 
-// Closes the send and attached reader channels
-func (c *GbWsConn) Close() {
+// Sends the client a close message with the code and reason, and closes
+// the websocket. The read and write pumps will fail and terminate.
+func (c *WsConn) Kick(code int, reason string) {
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(c.limits.WriteWait))
+	c.ws.Close()
+}
+
+// Closes the connection, the write pump will send the client a close
+// message, and the read pump will stop forwarding messages.
+func (c *WsConn) Close() {
 	if c.send != nil {
 		close(c.send)
-	}
-	if c.reader != nil {
-		close(c.reader)
+		close(c.closed)
 	}
 
 	c.send = nil
-	c.reader = nil
 }
 
 // Handler furnction for periodic reading from the input socks.
-// Handles closing of the socket, of the connection drops
-func (c *GbWsConn) ReadPump() {
-	defer c.ws.Close()
-	for {
-		c.ws.SetReadDeadline(time.Now().Add(readWait))
-		op, r, err := c.ws.NextReader()
-		if err != nil {
-			log.Println("Error getting next reader", err)
-			return
-		}
-		if op != gbws.OpText {
-			continue
+// Handles closing of the socket, of the connection drops. Messages
+// larger than the read limit are rejected with a close message by
+// the websocket library.
+func (c *WsConn) ReadPump() {
+	reader := c.reader
+	defer func() {
+		log.Println("Connection ", c.id, "read pump terminating")
+		c.ws.Close()
+		if reader != nil {
+			close(reader)
 		}
-		lr := io.LimitedReader{R: r, N: maxMessageSize + 1}
-		message, err := ioutil.ReadAll(&lr)
+	}()
+
+	c.ws.SetReadLimit(c.limits.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(c.limits.ReadWait))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(c.limits.ReadWait))
+		return nil
+	})
+
+	for {
+		_, message, err := c.ws.ReadMessage()
 		if err != nil {
-			log.Println("Error reading message", err)
-			return
-		}
-		if lr.N <= 0 {
-			log.Println("No data received from message, closing")
-			c.ws.WriteControl(gbws.OpClose,
-				gbws.FormatCloseMessage(gbws.CloseMessageTooBig, ""),
-				time.Now().Add(time.Second))
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Failed to read from ws, ", err, "id", c.id)
+			}
 			return
 		}
+		serverMetrics.MessagesIn.Inc()
+		serverMetrics.BytesIn.Add(uint64(len(message)))
 
+		// Messages which can't be decoded are still forwarded, so
+		// the reader can report them to the client.
 		var unmarshaled MessageIn
-		json.Unmarshal(message, &unmarshaled)
+		if err := c.codec.Decode(message, &unmarshaled); err != nil {
+			log.Println("Failed to decode message, ", err, "id", c.id)
+			unmarshaled = MessageIn{Err: err}
+		}
 
-		if c.reader == nil {
-			log.Println("GbWsConn failed to send to reader because chan closed")
+		if reader == nil {
+			continue
+		}
+		select {
+		case reader <- unmarshaled:
+		case <-c.closed:
 			return
 		}
-
-		c.reader <- unmarshaled
 	}
 }
 
-// write writes a message with the given opCode and payload.
-func (c *GbWsConn) write(opCode int, payload []byte) error {
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-	w, err := c.ws.NextWriter(opCode)
-	if err != nil {
-		log.Println("Failed to get next writer", err)
-		return err
-	}
-	if _, err := w.Write(payload); err != nil {
-		log.Println("Failed to write payload", err)
-		w.Close()
-		return err
-	}
-	return w.Close()
+// write writes a message with the given message type and payload.
+func (c *WsConn) write(msgType int, payload []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
+	return c.ws.WriteMessage(msgType, payload)
 }
 
-// writePump pumps messages from the hub to the websocket connection.
-func (c *GbWsConn) WritePump() {
-	defer c.ws.Close()
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
+// Write event loop, terminates when writes to the client fails, or the
+// connection is closed. Pings the client periodically so the read
+// deadline of both ends is extended while the connection is idle.
+func (c *WsConn) WritePump() {
+	ticker := time.NewTicker(c.limits.PingPeriod)
+	defer func() {
+		log.Println("Connection ", c.id, "write pump terminating")
+		ticker.Stop()
+		close(c.done)
+		c.ws.Close()
+	}()
 	for {
 		select {
 		case message, ok := <-c.send:
 			if !ok {
-				c.write(gbws.OpClose, []byte{})
+				c.ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(c.limits.WriteWait))
 				return
 			}
-			if err := c.write(gbws.OpText, message); err != nil {
+			if err := c.write(c.codec.MessageType(), message); err != nil {
+				log.Println("Failed to write to ws, ", err, "id", c.id)
 				return
 			}
+			serverMetrics.MessagesOut.Inc()
+			serverMetrics.BytesSent.Add(uint64(len(message)))
 		case <-ticker.C:
-			if err := c.write(gbws.OpPing, []byte{}); err != nil {
+			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
 		}
 	}
 }
-
-// Create a new instance of the go.net websocket
-func NewGnWsConn(id uint64, ws *gnws.Conn) *GnWsConn {
-	return &GnWsConn{
-		id:   id,
-		send: make(chan interface{}, 256),
-		ws:   ws,
-	}
-}
-
-// Connection object for use with the go.net websocket
-type GnWsConn struct {
-	id     uint64
-	reader chan MessageIn
-	send   chan interface{}
-	ws     *gnws.Conn
-}
-
-// Returns the connection's id
-func (c GnWsConn) GetId() uint64 {
-	return c.id
-}
-
-// Adds a new reader to the go.net websocket connection
-// This channel will be notified when a message is received
-// from a connection.
-func (c *GnWsConn) AttachReader(reader chan MessageIn) {
-	c.reader = reader
-}
-
-// Sends an object which will be serialized and sent to the connection
-func (c *GnWsConn) Send(msg interface{}) error {
-	if c.send == nil {
-		return ConnErrorSendClosed
-	}
-
-	c.send <- msg
-	return nil
-}
-
-// Read event loop, terminates when read from client fails
-func (c *GnWsConn) ReadPump() {
-	defer func() { log.Println("Connection ", c.id, "read pump terminating") }()
-	for {
-		var msg MessageIn
-		err := gnws.JSON.Receive(c.ws, &msg)
-		if err != nil {
-			log.Println("Failed to read from ws, ", err, "id", c.id)
-			return
-		}
-
-		c.reader <- msg
-	}
-}
-
-// Write event loop, termintes when writes to the client fails, or the send to conn
-// channel is closed.
-func (c *GnWsConn) WritePump() {
-	defer func() { log.Println("Connection ", c.id, "write pump terminating") }()
-	for {
-		select {
-		case msg, ok := <-c.send:
-			if !ok {
-				log.Println("WS send chan closed id", c.id)
-				return
-			}
-
-			err := gnws.JSON.Send(c.ws, msg)
-			if err != nil {
-				log.Println("Failed to write to ws, ", err, "id", c.id)
-				return
-			}
-		}
-	}
-}
-
-// Closes all channels on the connection, and invalidates
-// their reference.
-func (c *GnWsConn) Close() {
-	if c.send != nil {
-		close(c.send)
-	}
-	if c.reader != nil {
-		close(c.reader)
-	}
-
-	c.send = nil
-	c.reader = nil
-}
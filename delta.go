@@ -0,0 +1,107 @@
+package main
+
+const (
+	// Most updates which can be waiting for a player to acknowledge them.
+	// If the player falls further behind than this their baseline is
+	// dropped, and they are sent complete entities until they catch up.
+	maxPendingUpdates = 64
+)
+
+// Entity state a player has acknowledged receiving. Updates sent to the
+// player only include the entity fields which differ from it, so every
+// update the player hasn't acknowledged yet repeats the changes made since
+// their last acknowledgement. Fields which differ from the latest state
+// sent to the player are also included, since the player merges each
+// update onto the latest state, and a field changed back to its
+// acknowledged value by an update the player hasn't acknowledged would
+// otherwise be left out. Updates are kept until they are acknowledged,
+// and are then folded into the acknowledged state.
+type EntityBaseline struct {
+	acked   uint64 // Last sequence the player acknowledged
+	base    map[uint64]MsgPartEntity
+	latest  map[uint64]MsgPartEntity // Base with the pending updates applied
+	pending []pendingUpdate
+}
+
+// Entities sent to the player in an update they haven't acknowledged
+type pendingUpdate struct {
+	seq uint64
+	es  []MsgPartEntity
+}
+
+// Creates a new baseline starting from the snapshot sent to the player.
+// The snapshot's entities become the baseline once it is acknowledged.
+func NewEntityBaseline(seq uint64, snapshot []MsgPartEntity) *EntityBaseline {
+	b := &EntityBaseline{
+		base:    make(map[uint64]MsgPartEntity),
+		latest:  make(map[uint64]MsgPartEntity),
+		pending: []pendingUpdate{{seq: seq, es: snapshot}},
+	}
+	applyEntities(b.latest, snapshot)
+	return b
+}
+
+// Records the complete entities sent to the player in an update, and
+// returns the entities the player needs to be sent. Entities the player
+// hasn't acknowledged are sent complete, otherwise only the fields which
+// changed since the acknowledged, or latest state sent are. Entities which
+// haven't changed at all are left out.
+func (b *EntityBaseline) Delta(seq uint64, es []MsgPartEntity) []MsgPartEntity {
+	if len(b.pending) >= maxPendingUpdates {
+		// The player isn't acknowledging updates, start over
+		b.base = make(map[uint64]MsgPartEntity)
+		b.latest = make(map[uint64]MsgPartEntity)
+		b.pending = b.pending[0:0]
+	}
+	b.pending = append(b.pending, pendingUpdate{seq: seq, es: es})
+
+	delta := make([]MsgPartEntity, 0, len(es))
+	for _, e := range es {
+		known, ok := b.base[e.Id]
+		if !ok {
+			delta = append(delta, e)
+			continue
+		}
+
+		fields := e.DiffFrom(&known).F
+		if last, ok := b.latest[e.Id]; ok {
+			fields |= e.DiffFrom(&last).F
+		}
+		if fields != 0 {
+			delta = append(delta, e.WithFields(fields))
+		}
+	}
+	applyEntities(b.latest, es)
+	return delta
+}
+
+// Folds all updates up to and including the sequence into the
+// acknowledged state. Acknowledgements of sequences already acknowledged,
+// or after the latest update are ignored.
+func (b *EntityBaseline) Ack(seq uint64) {
+	if seq <= b.acked {
+		return
+	}
+	if len(b.pending) == 0 || seq > b.pending[len(b.pending)-1].seq {
+		return
+	}
+	b.acked = seq
+
+	n := 0
+	for ; n < len(b.pending) && b.pending[n].seq <= seq; n++ {
+		applyEntities(b.base, b.pending[n].es)
+	}
+	b.pending = append(b.pending[0:0], b.pending[n:]...)
+}
+
+// Applies the complete entities to the state, removed entities are
+// deleted from it.
+func applyEntities(state map[uint64]MsgPartEntity, es []MsgPartEntity) {
+	for _, e := range es {
+		if EntityState(e.St) == EntityStateRemoved {
+			delete(state, e.Id)
+			continue
+		}
+		state[e.Id] = e
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Merges the update's entities onto the client's state the way
+// apollo.js does, only the flagged fields of partial entities are set.
+func mergeTestUpdate(state map[uint64]MsgPartEntity, es []MsgPartEntity) {
+	for _, e := range es {
+		if EntityState(e.St) == EntityStateRemoved && (e.F == 0 || e.F&MsgEntityFieldState != 0) {
+			delete(state, e.Id)
+			continue
+		}
+		if e.F == 0 {
+			state[e.Id] = e
+			continue
+		}
+		merged := state[e.Id]
+		for f := MsgEntityFieldType; f <= MsgEntityFieldUpdatedAt; f <<= 1 {
+			if e.F&f != 0 {
+				merged = mergeTestField(merged, e, f)
+			}
+		}
+		merged.Id, merged.F = e.Id, 0
+		state[e.Id] = merged
+	}
+}
+
+func mergeTestField(into, from MsgPartEntity, field int) MsgPartEntity {
+	switch field {
+	case MsgEntityFieldType:
+		into.T = from.T
+	case MsgEntityFieldState:
+		into.St = from.St
+	case MsgEntityFieldX:
+		into.X = from.X
+	case MsgEntityFieldY:
+		into.Y = from.Y
+	case MsgEntityFieldColor:
+		into.C = from.C
+	case MsgEntityFieldTtl:
+		into.Ttl = from.Ttl
+	case MsgEntityFieldCreatedAt:
+		into.CAt = from.CAt
+	case MsgEntityFieldUpdatedAt:
+		into.UAt = from.UAt
+	}
+	return into
+}
+
+func TestDeltaRevertedFieldWhileUnacked(t *testing.T) {
+	present := MsgPartEntity{Id: 1, St: int(EntityStatePresent), X: 2, Y: 3, C: 1}
+	selected := present
+	selected.St = int(EntityStateSelected)
+
+	client := make(map[uint64]MsgPartEntity)
+	b := NewEntityBaseline(1, []MsgPartEntity{present})
+	mergeTestUpdate(client, []MsgPartEntity{present})
+	b.Ack(1)
+
+	mergeTestUpdate(client, b.Delta(2, []MsgPartEntity{selected}))
+	if EntityState(client[1].St) != EntityStateSelected {
+		t.Fatal("Expected the client to see the entity selected")
+	}
+
+	// Update 2 is not acknowledged, and the entity goes back to the
+	// acknowledged state.
+	delta := b.Delta(3, []MsgPartEntity{present})
+	if len(delta) != 1 || delta[0].F&MsgEntityFieldState == 0 {
+		t.Fatalf("Expected the state to be sent, %+v", delta)
+	}
+	mergeTestUpdate(client, delta)
+	if !reflect.DeepEqual(client[1], present) {
+		t.Fatalf("Client's entity %+v, expected %+v", client[1], present)
+	}
+
+	// Nothing changed since, but update 3 isn't acknowledged either
+	b.Ack(2)
+	if delta = b.Delta(4, []MsgPartEntity{present}); len(delta) != 1 {
+		t.Fatalf("Expected the unacknowledged change to be repeated, %+v", delta)
+	}
+	b.Ack(4)
+	if delta = b.Delta(5, []MsgPartEntity{present}); len(delta) != 0 {
+		t.Fatalf("Expected no change once acknowledged, %+v", delta)
+	}
+}
+
+func TestDeltaClientMatchesServer(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	server := make(map[uint64]MsgPartEntity)
+	for id := uint64(1); id <= 8; id++ {
+		server[id] = MsgPartEntity{Id: id, St: int(EntityStatePresent), X: int(id)}
+	}
+	snapshot := func() []MsgPartEntity {
+		es := make([]MsgPartEntity, 0, len(server))
+		for _, e := range server {
+			es = append(es, e)
+		}
+		return es
+	}
+
+	client := make(map[uint64]MsgPartEntity)
+	b := NewEntityBaseline(1, snapshot())
+	mergeTestUpdate(client, snapshot())
+	nextId := uint64(9)
+
+	for seq := uint64(2); seq < 500; seq++ {
+		changed := make([]MsgPartEntity, 0)
+		for id, e := range server {
+			switch r.Intn(10) {
+			case 0:
+				e.St = int(EntityStatePresent) + r.Intn(2)
+			case 1:
+				e.Y = r.Intn(3)
+			case 2:
+				e.St = int(EntityStateRemoved)
+				delete(server, id)
+				changed = append(changed, e)
+				continue
+			default:
+				continue
+			}
+			server[id] = e
+			changed = append(changed, e)
+		}
+		if r.Intn(3) == 0 {
+			e := MsgPartEntity{Id: nextId, St: int(EntityStateAdded)}
+			server[e.Id] = e
+			changed = append(changed, e)
+			nextId++
+		}
+
+		mergeTestUpdate(client, b.Delta(seq, changed))
+		if !reflect.DeepEqual(client, server) {
+			t.Fatalf("Client differs from the server after update %d,\n%+v\n%+v", seq, client, server)
+		}
+		if r.Intn(4) == 0 {
+			// Acknowledgements arrive late
+			b.Ack(seq - uint64(r.Intn(3)))
+		}
+	}
+}
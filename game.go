@@ -1,51 +1,103 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"math/rand"
 	"time"
 )
 
 const (
+	// Default time between simulation steps
 	delayBetweenSimStep = (250 * time.Millisecond)
+	// Largest seed of a game's random number generator. Seeds fit in
+	// 53 bits so clients can hold them exactly as JavaScript numbers.
+	maxGameSeed = 1<<53 - 1
 )
 
 type GamePlayerCtrl chan *PlayerAction
 type GameState int
 type GamePlayerState int
-type GameType struct {
-	Rows, Cols, Players int
-}
+type GameEndReason int
 
 var (
 	// Game state
-	GameStateRunning = GameState(0)
-	GameStatePaused  = GameState(1)
-	GameStateStopped = GameState(2)
+	GameStateRunning   = GameState(0)
+	GameStateCountdown = GameState(1)
+	GameStateStopped   = GameState(2)
+	GameStateEnded     = GameState(3)
+	GameStatePaused    = GameState(4)
 	// Game Player State 
 	GamePlayerStateAdded   = GamePlayerState(0)
 	GamePlayerStatePresent = GamePlayerState(1)
 	GamePlayerStateUpdated = GamePlayerState(2)
 	GamePlayerStateRemoved = GamePlayerState(3)
-	// Game Types
-	GameTypeMobileSmall = &GameType{Rows: 7, Cols: 5, Players: 5}
+	// Game end reasons
+	GameEndReasonEmpty   = GameEndReason(0)
+	GameEndReasonStopped = GameEndReason(1)
+	GameEndReasonDrained = GameEndReason(2)
+)
+
+type GameError struct {
+	GameErrorString string
+	CodeNum         ActionCode
+}
+
+func (g *GameError) Error() string    { return g.GameErrorString }
+func (g *GameError) Code() ActionCode { return g.CodeNum }
+
+var (
+	GameErrorUnknownEntity  = &GameError{"Entity does not exist", ActionCodeUnknownEntity}
+	GameErrorNotYourTurn    = &GameError{"Round is not running", ActionCodeNotYourTurn}
+	GameErrorWrongColor     = &GameError{"Entity is not the color of the selection", ActionCodeWrongColor}
+	GameErrorNotInGame      = &GameError{"Player is not in the game", ActionCodeNotInGame}
+	GameErrorSpectator      = &GameError{"Spectators can not play the game", ActionCodeSpectator}
+	GameErrorUnknownCommand = &GameError{"Unknown game command", ActionCodeUnknownCommand}
 )
 
 // Definition of the game object
 type Game struct {
-	id         uint64
-	gameType   *GameType
-	sim        *Simulation
-	board      *Board
-	state      GameState
-	players    map[*Player]*GamePlayerInfo
-	playerCtrl GamePlayerCtrl
-	AddPlayer  chan *Player
-	RmPlayer   chan *Player
+	id           uint64
+	gameType     *GameType
+	sim          *Simulation
+	board        *Board
+	state        GameState
+	resumeState  GameState // Resumed once unpaused by an admin
+	draining     bool      // Ends once the current round is over
+	created      time.Time
+	seed         int64
+	rng          *rand.Rand
+	clock        Clock
+	stepDelay    time.Duration
+	tick         uint64
+	seq          uint64
+	round        int
+	phaseEnds    uint64
+	recorder     *ReplayRecorder
+	profiles     ProfileStore
+	leaderboards *Leaderboards
+	players      map[*Player]*GamePlayerInfo
+	spectators   map[*Player]*GamePlayerInfo
+	playerCtrl   GamePlayerCtrl
+	AddPlayer    chan *Player
+	RmPlayer     chan *Player
+	AddSpectator chan *Player
+	Resync       chan *Player
+	inspect      chan chan *GameInspection
+	control      chan GameControl
+	quit         chan bool
+	stopped      chan bool
+	ended        chan<- *GameEnded
 	// Cache
 	pInfoUpdates []*GamePlayerInfo
 }
 
+// Notification sent from a game to the world when the game no
+// longer has any players, or has ended.
+type GameEnded struct {
+	Game   *Game
+	Reason GameEndReason
+}
+
 type GamePlayerInfo struct {
 	PlayerId  PlayerId
 	State     GamePlayerState
@@ -53,20 +105,42 @@ type GamePlayerInfo struct {
 	Score     int
 	SelcColor EntityColor
 	Selected  []*Entity
+	Spectator bool
+	baseline  *EntityBaseline
+	// Stats not yet recorded to the player's profile
+	recordedAt    uint64 // Tick the stats were last recorded at
+	recordedScore int    // Score of the round already recorded
+	claimed       int    // Blocks claimed
 }
 
 // Initalization of the game object.game  It s being done in the package's
 // global scope so the network event handler will have access to it when
-// receiving new player connections.
-func NewGame(id uint64, gameType *GameType) *Game {
+// receiving new player connections. All of the game's randomness comes
+// from the seed, and its simulation time from a clock advanced once per
+// simulation step, so a game can be reproduced from its seed and the
+// ordered list of player actions.
+func NewGame(id uint64, gameType *GameType, seed int64, ended chan<- *GameEnded) *Game {
 	g := &Game{
-		id:         id,
-		gameType:   gameType,
-		state:      GameStateStopped,
-		players:    make(map[*Player]*GamePlayerInfo),
-		playerCtrl: make(GamePlayerCtrl),
-		AddPlayer:  make(chan *Player),
-		RmPlayer:   make(chan *Player),
+		id:           id,
+		gameType:     gameType,
+		state:        GameStateStopped,
+		created:      time.Now(),
+		seed:         seed,
+		rng:          rand.New(rand.NewSource(seed)),
+		clock:        NewStepClock(time.Unix(0, 0).UTC()),
+		stepDelay:    delayBetweenSimStep,
+		players:      make(map[*Player]*GamePlayerInfo),
+		spectators:   make(map[*Player]*GamePlayerInfo),
+		playerCtrl:   make(GamePlayerCtrl),
+		AddPlayer:    make(chan *Player),
+		RmPlayer:     make(chan *Player),
+		AddSpectator: make(chan *Player),
+		Resync:       make(chan *Player),
+		inspect:      make(chan chan *GameInspection),
+		control:      make(chan GameControl),
+		quit:         make(chan bool),
+		stopped:      make(chan bool),
+		ended:        ended,
 		// Cache
 		pInfoUpdates: make([]*GamePlayerInfo, 10),
 	}
@@ -78,6 +152,41 @@ func (g Game) GetId() uint64 {
 	return g.id
 }
 
+// Returns the seed of the game's random number generator
+func (g Game) GetSeed() int64 {
+	return g.seed
+}
+
+// Replaces the clock used by the game's simulation. Must be called
+// before the game is run.
+func (g *Game) SetClock(clock Clock) {
+	g.clock = clock
+}
+
+// Sets the time between the steps of the game's simulation. Must be
+// called before the game is run.
+func (g *Game) SetStepDelay(delay time.Duration) {
+	g.stepDelay = delay
+}
+
+// Sets the recorder the game's player actions and updates will be
+// written to. Must be called before the game is run.
+func (g *Game) SetRecorder(recorder *ReplayRecorder) {
+	g.recorder = recorder
+}
+
+// Sets the store the stats of the game's players are recorded to.
+// Must be called before the game is run.
+func (g *Game) SetProfileStore(profiles ProfileStore) {
+	g.profiles = profiles
+}
+
+// Sets the leaderboards the results of the game's rounds are recorded
+// to. Must be called before the game is run.
+func (g *Game) SetLeaderboards(leaderboards *Leaderboards) {
+	g.leaderboards = leaderboards
+}
+
 // Returns if the game has reached its limit of players
 func (g *Game) IsFull() bool {
 	if g.gameType.Players <= len(g.players) {
@@ -90,36 +199,111 @@ func (g *Game) IsFull() bool {
 // Event receiver to processing messages between the simulation and
 // the players.  If players are connected to the game the simulation
 // will be started, but as soon as the last player drops out the
-// simulation will be terminated.
+// simulation will be terminated, and the world notified. The event
+// loop runs until the game is told to quit.
 func (g *Game) Run() {
-	ticker := time.NewTicker(delayBetweenSimStep)
+	ticker := time.NewTicker(g.stepDelay)
 	defer func() {
 		log.Println("Game ", g.id, " event loop terminating")
 		ticker.Stop()
+		for p, pInfo := range g.players {
+			g.recordProfile(p, pInfo, nil)
+		}
+		if g.recorder != nil {
+			g.recorder.Close()
+		}
+		close(g.stopped)
 	}()
 	for {
 		select {
+		case <-g.quit:
+			return
+
 		case <-ticker.C:
-			if g.state != GameStateRunning {
+			if g.state == GameStateStopped || g.state == GameStatePaused {
 				continue
 			}
-			g.simulate()
+			started := time.Now()
+			g.step()
+			serverMetrics.TickDuration.Observe(time.Since(started).Seconds())
+
+		case reply := <-g.inspect:
+			reply <- g.inspection()
+
+		case ctrl := <-g.control:
+			g.procControl(ctrl)
 
 		case p := <-g.AddPlayer:
 			log.Printf("Adding player %d to game %d", p.GetId(), g.id)
+			if g.recorder != nil {
+				g.recorder.RecordPlayerAdded(g.tick, p)
+			}
 			g.addPlayer(p)
 
+		case p := <-g.AddSpectator:
+			log.Printf("Adding spectator %d to game %d", p.GetId(), g.id)
+			g.addSpectator(p)
+
+		case p := <-g.Resync:
+			// Player resumed their session, bring them up to date
+			if pInfo := g.playerOrSpectator(p); pInfo != nil {
+				g.sendSnapshot(p, pInfo)
+			}
+
 		case p := <-g.RmPlayer:
 			log.Printf("Removing player %d from game %d", p.GetId(), g.id)
+			if g.recorder != nil {
+				g.recorder.RecordPlayerRemoved(g.tick, p)
+			}
 			g.removePlayer(p)
 
 		case ctrl := <-g.playerCtrl:
+			if g.procSyncCtrl(ctrl) {
+				continue
+			}
 			var pInfo *GamePlayerInfo
 			if pInfo = g.players[ctrl.Player]; pInfo == nil {
-				// Ignore players we don't know about, TODO should we disconnect them?
+				err := GameErrorNotInGame
+				if g.spectators[ctrl.Player] != nil {
+					log.Println("Rejecting game action from spectator", ctrl.Player.GetId())
+					err = GameErrorSpectator
+				}
+				ReplyToAction(ctrl, err)
 				continue
 			}
-			g.procPlayerCtrl(ctrl, pInfo)
+			if g.recorder != nil {
+				g.recorder.RecordAction(g.tick, ctrl)
+			}
+			ReplyToAction(ctrl, g.procPlayerCtrl(ctrl, pInfo))
+		}
+	}
+}
+
+// Advances the game one step. Rounds move from their countdown,
+// to running, to showing the results, and back to the countdown
+// of the next round as each phase's time runs out.
+func (g *Game) step() {
+	g.tick++
+	phaseOver := g.phaseEnds != 0 && g.tick >= g.phaseEnds
+
+	switch g.state {
+	case GameStateCountdown:
+		if phaseOver {
+			g.beginRound()
+		}
+
+	case GameStateRunning:
+		g.clock.Advance(g.stepDelay)
+		g.simulate()
+		if phaseOver || g.targetScoreReached() {
+			g.endRound()
+		}
+
+	case GameStateEnded:
+		if phaseOver && g.draining {
+			g.endDrained()
+		} else if phaseOver {
+			g.newRound()
 		}
 	}
 }
@@ -131,6 +315,8 @@ func (g *Game) simulate() {
 		g.pInfoUpdates = g.pInfoUpdates[0:0] // reinit the update cache
 
 		// Searching over the changes for removed items someone has selected.
+		// The selection is claimed when one of its blocks expires, or released
+		// if the selection isn't a valid match.
 		for _, e := range toA {
 			if e.state == EntityStateRemoved && e.Owner != nil {
 				// Search through the players finding selections if there were any.
@@ -141,18 +327,15 @@ func (g *Game) simulate() {
 					continue
 				}
 
-				// Update the player's score and remove the selected entities.
-				for _, selc := range pInfo.Selected {
-					if selc != nil {
-						g.board.RemoveEntityById(selc.GetId())
+				changed, err := g.claimSelection(pInfo)
+				if err != nil {
+					changed = g.releaseSelection(pInfo)
+				}
+				for _, selc := range changed {
+					if selc != e {
 						toA = append(toA, selc)
 					}
 				}
-				if len(pInfo.Selected) > 1 {
-					pInfo.Score += len(pInfo.Selected) - 1
-				}
-				pInfo.Selected = pInfo.Selected[0:0] // Clear this player's selection list
-				pInfo.SelcColor = EntityNoColor
 
 				g.pInfoUpdates = append(g.pInfoUpdates, pInfo)
 			}
@@ -172,143 +355,429 @@ func (g *Game) addPlayer(p *Player) {
 		State:     GamePlayerStateAdded,
 		PlayerId:  p.GetId(),
 		Score:     0,
-		Name:      fmt.Sprintf("Player %d", p.GetId()),
+		Name:      p.GetName(),
 		Selected:  make([]*Entity, 10),
 		SelcColor: EntityNoColor,
 	}
 	pInfo.Selected = pInfo.Selected[0:0]
-	if g.state != GameStateRunning {
+	if g.state == GameStateStopped {
 		g.startGame()
 	}
+	pInfo.recordedAt = g.tick
 
 	// Update the current player with the current state of the game
-	msg := MsgCreateGameUpdate()
-	msg.AddGameType(g.gameType)
-	// Let the new player know about the existing player list
-	infos := make([]*GamePlayerInfo, len(g.players))
-	i := 0
-	for _, info := range g.players {
-		infos[i] = info
-		i++
-	}
-	msg.AddPlayerGameInfos(infos)
-	// Get the entities and add them to the game if ther are any
-	if toP := g.board.GetEntityArray(); toP != nil {
-		msg.AddEntityUpdates(toP)
-	}
-	// send the message to the player
-	g.playerUpdate(p, msg)
+	g.sendSnapshot(p, pInfo)
 
 	g.players[p] = pInfo
-	p.SetGameCtrl(&g.playerCtrl)
+	p.SetGameCtrl(&g.playerCtrl, g.quit)
 
 	// Let all players now about the new player
-	msg = MsgCreateGameUpdate()
+	msg := MsgCreateGameUpdate()
 	msg.AddPlayerGameInfo(pInfo, -1)
 	g.broadcastUpdate(msg)
 }
 
-// Removes the passed in player from the game, and stops the game
-// if that is the last player to be removed.
+// Adds a new spectator to the game. Spectators receive the same updates
+// as players, but do not count towards the game's player limit, and
+// their game actions are rejected.
+func (g *Game) addSpectator(p *Player) {
+	pInfo := &GamePlayerInfo{
+		State:     GamePlayerStateAdded,
+		PlayerId:  p.GetId(),
+		Name:      p.GetName(),
+		Selected:  make([]*Entity, 0),
+		SelcColor: EntityNoColor,
+		Spectator: true,
+	}
+
+	g.sendSnapshot(p, pInfo)
+
+	g.spectators[p] = pInfo
+	p.SetGameCtrl(&g.playerCtrl, g.quit)
+
+	msg := MsgCreateGameUpdate()
+	msg.AddSpectatorInfo(pInfo)
+	g.broadcastUpdate(msg)
+}
+
+// Builds an update containing the complete current state of the
+// game, used to bring new players up to date.
+func (g *Game) snapshotUpdate() *MsgGameUpdate {
+	msg := MsgCreateGameUpdate()
+	msg.Sq = g.seq
+	msg.Sn = true
+	msg.AddGameType(g.gameType)
+	msg.AddGameInfo(g)
+	msg.AddRound(g)
+	// Let the new player know about the existing player list
+	msg.AddPlayerGameInfos(g.playerInfoList())
+	msg.AddSpectatorInfos(g.spectatorInfoList())
+	// Get the entities and add them to the game if ther are any
+	if g.board != nil {
+		if toP := g.board.GetEntityArray(); toP != nil {
+			msg.AddEntityUpdates(toP)
+		}
+	}
+	return msg
+}
+
+// Removes the passed in player or spectator from the game, and stops
+// the game if that is the last player to be removed.
 func (g *Game) removePlayer(p *Player) {
+	if pInfo := g.spectators[p]; pInfo != nil {
+		delete(g.spectators, p)
+		p.SetGameCtrl(nil, nil)
+
+		pInfo.State = GamePlayerStateRemoved
+		msg := MsgCreateGameUpdate()
+		msg.AddSpectatorInfo(pInfo)
+		g.broadcastUpdate(msg)
+	}
 	if pInfo := g.players[p]; pInfo != nil {
 		delete(g.players, p)
-		p.SetGameCtrl(nil)
+		p.SetGameCtrl(nil, nil)
 
 		// Clear the ownership of these entities if there were any
-		for _, e := range pInfo.Selected {
-			if e == nil {
-				continue
-			}
-			e.Owner = nil
-			e.state = EntityStatePresent
-		}
+		released := g.releaseSelection(pInfo)
+		g.recordProfile(p, pInfo, nil)
 
 		// Let everyone else know the player left, and everything they had
 		// is now unselected
 		pInfo.State = GamePlayerStateRemoved
 		msg := MsgCreateGameUpdate()
 		msg.AddPlayerGameInfo(pInfo, -1)
-		msg.AddEntityUpdates(pInfo.Selected)
+		msg.AddEntityUpdates(released)
 		g.broadcastUpdate(msg)
 	}
-	if len(g.players) == 0 {
+	if len(g.players) == 0 && g.state != GameStateStopped {
 		g.stopGame()
+		g.notifyEnded(GameEndReasonEmpty)
 	}
 }
 
-// Processes the player's control in relation to the game.
-func (g *Game) procPlayerCtrl(ctrl *PlayerAction, pInfo *GamePlayerInfo) {
-	if ctrl.Game.Command == PlayerCmdGameSelectEntity {
-		// TODO do matching based on what the player selected previously
-		pInfo.State = GamePlayerStateUpdated
-		e := g.board.GetEntityById(ctrl.Game.EntityId)
-		if e == nil { // the id wasn't found so ignore
-			return
+// Sends the player a snapshot of the game, and starts the player's
+// entity baseline over from it.
+func (g *Game) sendSnapshot(p *Player, pInfo *GamePlayerInfo) {
+	msg := g.snapshotUpdate()
+	pInfo.baseline = NewEntityBaseline(msg.Sq, msg.Es)
+	// Not sent as a player update, so a snapshot which is dropped
+	// doesn't trigger another.
+	p.SendToPlayer(msg)
+}
+
+// Processes the controls keeping the player in sync with the game,
+// acknowledging updates and requesting snapshots. These are accepted
+// from spectators, and while rounds aren't running. Returns false if
+// the control was not a sync control.
+func (g *Game) procSyncCtrl(ctrl *PlayerAction) bool {
+	switch ctrl.Game.Command {
+	case PlayerCmdGameAck:
+		if pInfo := g.playerOrSpectator(ctrl.Player); pInfo != nil {
+			pInfo.baseline.Ack(ctrl.Game.Seq)
 		}
 
-		// unselect if already selected
-		if e.state == EntityStateSelected {
-			e.state = EntityStatePresent
-			// remove tyhe old player's ref first
-			oldPInfo := g.players[e.Owner]
-			if oldPInfo != nil {
-				for i, selc := range oldPInfo.Selected {
-					if selc != nil && selc.GetId() == e.GetId() {
-						oldPInfo.Selected[i] = nil
-					}
-				}
-			}
-			e.Owner = nil
+	case PlayerCmdGameSnapshot:
+		pInfo := g.playerOrSpectator(ctrl.Player)
+		if pInfo == nil {
+			ReplyToAction(ctrl, GameErrorNotInGame)
+			break
+		}
+		log.Println("Player", ctrl.Player.GetId(), "requested a snapshot of game", g.id)
+		g.sendSnapshot(ctrl.Player, pInfo)
+		ReplyToAction(ctrl, nil)
 
-		} else if pInfo.SelcColor == e.color || pInfo.SelcColor == EntityNoColor {
-			e.state = EntityStateSelected
-			e.Owner = ctrl.Player
-			pInfo.SelcColor = e.color
-			pInfo.Selected = append(pInfo.Selected, e)
+	default:
+		return false
+	}
+	return true
+}
 
-		} else {
-			e.state = EntityStatePresent
+// Processes the player's control in relation to the game. Controls
+// are rejected while a round isn't running, or the game is paused.
+func (g *Game) procPlayerCtrl(ctrl *PlayerAction, pInfo *GamePlayerInfo) error {
+	if g.state != GameStateRunning {
+		return GameErrorNotYourTurn
+	}
+
+	switch ctrl.Game.Command {
+	case PlayerCmdGameSelectEntity:
+		return g.selectEntity(ctrl, pInfo)
+
+	case PlayerCmdGameClaimSelection:
+		return g.claimPlayerSelection(ctrl, pInfo)
+	}
+	return GameErrorUnknownCommand
+}
+
+// Toggles the selection of the entity the player picked. Entities
+// can only be added to a player's selection if they are the same
+// color as what the player already has selected.
+func (g *Game) selectEntity(ctrl *PlayerAction, pInfo *GamePlayerInfo) error {
+	e := g.board.GetEntityById(ctrl.Game.EntityId)
+	if e == nil {
+		return GameErrorUnknownEntity
+	}
+	pInfo.State = GamePlayerStateUpdated
+
+	// unselect if already selected
+	if e.state == EntityStateSelected {
+		e.state = EntityStatePresent
+		// remove tyhe old player's ref first
+		if oldPInfo := g.players[e.Owner]; oldPInfo != nil {
+			oldPInfo.removeSelected(e)
 		}
+		e.Owner = nil
 
-		msg := MsgCreateGameUpdate()
-		msg.AddPlayerGameInfo(pInfo, -1)
-		msg.AddEntityUpdate(e, -1)
-		g.broadcastUpdate(msg)
+	} else if pInfo.SelcColor == e.color || pInfo.SelcColor == EntityNoColor {
+		e.state = EntityStateSelected
+		e.Owner = ctrl.Player
+		pInfo.SelcColor = e.color
+		pInfo.Selected = append(pInfo.Selected, e)
 
+	} else {
 		pInfo.State = GamePlayerStatePresent
+		return GameErrorWrongColor
 	}
+
+	msg := MsgCreateGameUpdate()
+	msg.AddPlayerGameInfo(pInfo, -1)
+	msg.AddEntityUpdate(e, -1)
+	g.broadcastUpdate(msg)
+
+	pInfo.State = GamePlayerStatePresent
+	return nil
+}
+
+// Claims the player's selection, and lets all players know about
+// the claimed blocks, and the player's new score.
+func (g *Game) claimPlayerSelection(ctrl *PlayerAction, pInfo *GamePlayerInfo) error {
+	claimed, err := g.claimSelection(pInfo)
+	if err != nil {
+		log.Println("Player", ctrl.Player.GetId(), "claim rejected,", err)
+		return err
+	}
+
+	pInfo.State = GamePlayerStateUpdated
+	msg := MsgCreateGameUpdate()
+	msg.AddPlayerGameInfo(pInfo, -1)
+	msg.AddEntityUpdates(claimed)
+	g.broadcastUpdate(msg)
+
+	pInfo.State = GamePlayerStatePresent
+	return nil
+}
+
+// Validates the player's selection against the game type's match
+// rules. If the selection is a valid match the selected entities
+// are removed from the board, and the player awarded the points
+// for it. The claimed entities are returned.
+func (g *Game) claimSelection(pInfo *GamePlayerInfo) ([]*Entity, error) {
+	rules := g.gameType.GetMatchRules()
+	if err := rules.Validate(pInfo.Selected); err != nil {
+		return nil, err
+	}
+
+	claimed := pInfo.Selected
+	for _, e := range claimed {
+		e.Owner = nil
+		if g.board.GetEntityById(e.GetId()) != nil {
+			g.board.RemoveEntityById(e.GetId())
+		}
+	}
+	pInfo.Score += rules.Score(len(claimed))
+	pInfo.claimed += len(claimed)
+	pInfo.clearSelected()
+
+	return claimed, nil
+}
+
+// Releases all entities the player has selected back to the board.
+// The released entities are returned.
+func (g *Game) releaseSelection(pInfo *GamePlayerInfo) []*Entity {
+	released := pInfo.Selected
+	for _, e := range released {
+		e.Owner = nil
+		if e.state == EntityStateSelected {
+			e.state = EntityStatePresent
+		}
+	}
+	pInfo.clearSelected()
+
+	return released
 }
 
-// Processes an update from a player
+// Removes the entity from the player's selection. The player's
+// selection color is cleared when nothing remains selected.
+func (pInfo *GamePlayerInfo) removeSelected(e *Entity) {
+	for i, selc := range pInfo.Selected {
+		if selc.GetId() == e.GetId() {
+			pInfo.Selected = append(pInfo.Selected[:i], pInfo.Selected[i+1:]...)
+			break
+		}
+	}
+	if len(pInfo.Selected) == 0 {
+		pInfo.SelcColor = EntityNoColor
+	}
+}
+
+// Clears the player's selection. A new list is created so that
+// previous selections returned to the caller are not modified.
+func (pInfo *GamePlayerInfo) clearSelected() {
+	pInfo.Selected = make([]*Entity, 0, 10)
+	pInfo.SelcColor = EntityNoColor
+}
+
+// Sends an update to a player. If the player fell behind and their
+// queued updates were dropped they are sent a snapshot to catch up.
 func (g *Game) playerUpdate(p *Player, update interface{}) {
 	err := p.SendToPlayer(update)
-	if err != nil {
-		g.RmPlayer <- p
+	if err == PlayerErrorBehind {
+		if pInfo := g.playerOrSpectator(p); pInfo != nil {
+			g.sendSnapshot(p, pInfo)
+		}
+	} else if err != nil {
+		log.Println("Failed to send update to player", p.GetId(), err)
+	}
+}
+
+// Sends out an update to all players, and spectators. The update is
+// given the game's next sequence number, and each player is only sent
+// the entity changes they haven't acknowledged yet.
+func (g *Game) broadcastUpdate(update *MsgGameUpdate) {
+	g.seq++
+	update.Sq = g.seq
+	if g.recorder != nil {
+		g.recorder.RecordUpdate(g.tick, update)
+	}
+
+	for p, pInfo := range g.players {
+		g.playerUpdate(p, pInfo.deltaUpdate(update))
+	}
+	for p, pInfo := range g.spectators {
+		g.playerUpdate(p, pInfo.deltaUpdate(update))
 	}
 }
 
-// Sends out an update to all players
-func (g *Game) broadcastUpdate(update interface{}) {
-	for p, _ := range g.players {
-		g.playerUpdate(p, update)
+// Returns a copy of the update with only the entity changes the
+// player hasn't acknowledged.
+func (pInfo *GamePlayerInfo) deltaUpdate(update *MsgGameUpdate) *MsgGameUpdate {
+	if pInfo.baseline == nil {
+		return update
 	}
+	delta := *update
+	delta.Es = pInfo.baseline.Delta(update.Sq, update.Es)
+	return &delta
 }
 
-// Create the simulator, and start it running
+// Create the simulator, and start the first round
 func (g *Game) startGame() {
-	g.board = NewBoard(g.gameType.Rows, g.gameType.Cols)
-	g.sim = NewSimulation(g.board)
-	g.state = GameStateRunning
+	g.round = 0
+	g.newRound()
 }
 
-// Terminate the simulator, and remove its instance
+// Terminate the simulator, and remove its instance. The stats of the
+// players still in the game are recorded.
 func (g *Game) stopGame() {
+	for p, pInfo := range g.players {
+		g.recordProfile(p, pInfo, nil)
+	}
 	g.state = GameStateStopped
+	g.phaseEnds = 0
 	g.sim = nil
 	g.board = nil
 }
 
+// Records the player's stats since they were last recorded to their
+// profile, and the outcome of the round if they completed it. Guests,
+// games without a profile store, and players with nothing new to record
+// are not recorded.
+func (g *Game) recordProfile(p *Player, pInfo *GamePlayerInfo, outcome *roundOutcome) {
+	update := &ProfileUpdate{
+		Account:       p.GetAccount(),
+		Name:          pInfo.Name,
+		Score:         pInfo.Score - pInfo.recordedScore,
+		BlocksClaimed: pInfo.claimed,
+		TimePlayed:    time.Duration(g.tick-pInfo.recordedAt) * g.stepDelay,
+	}
+	completed := outcome != nil
+	if completed {
+		update.Completed = true
+		update.Won = outcome.won
+		update.RoundScore = pInfo.Score
+		update.Rated = outcome.rated
+		update.RatingChange = outcome.ratingChange
+	}
+	pInfo.recordedAt = g.tick
+	pInfo.recordedScore = pInfo.Score
+	pInfo.claimed = 0
+
+	if g.profiles == nil || update.Account.Guest || len(update.Account.Id) == 0 {
+		return
+	}
+	if !completed && update.Score == 0 && update.BlocksClaimed == 0 && update.TimePlayed == 0 {
+		return
+	}
+	if err := g.profiles.Record(update); err != nil {
+		log.Println("Failed to record profile of player", p.GetId(), err)
+	}
+}
+
+// Lets the world know the game has ended. This is done asynchronously
+// so the game's event loop is not blocked by the world, which might be
+// sending the game a new player at the same time.
+func (g *Game) notifyEnded(reason GameEndReason) {
+	if g.ended == nil {
+		return
+	}
+	go func(ended *GameEnded) { g.ended <- ended }(&GameEnded{Game: g, Reason: reason})
+}
+
+// Stops the game once it has been drained, and lets the world know
+func (g *Game) endDrained() {
+	log.Println("Game", g.id, "drained")
+	g.stopGame()
+	g.notifyEnded(GameEndReasonDrained)
+}
+
+// Terminates the game's event loop. No players should be added
+// or removed from the game after it has quit.
+func (g *Game) Quit() {
+	close(g.quit)
+}
+
+// Waits for the game's event loop to terminate after it has quit,
+// and its replay to be written.
+func (g *Game) Wait() {
+	<-g.stopped
+}
+
+// Returns the info of the player, or spectator. Nil is returned if the
+// player isn't in the game.
+func (g *Game) playerOrSpectator(p *Player) *GamePlayerInfo {
+	if pInfo := g.players[p]; pInfo != nil {
+		return pInfo
+	}
+	return g.spectators[p]
+}
+
+// Returns the list of player infos for all players in the game
+func (g *Game) playerInfoList() []*GamePlayerInfo {
+	infos := make([]*GamePlayerInfo, 0, len(g.players))
+	for _, info := range g.players {
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Returns the list of player infos for all spectators of the game
+func (g *Game) spectatorInfoList() []*GamePlayerInfo {
+	infos := make([]*GamePlayerInfo, 0, len(g.spectators))
+	for _, info := range g.spectators {
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 // Returns the current state of the game
 func (g Game) getState() GameState {
 	return g.state
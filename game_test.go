@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Connection which records the messages sent to it, and why it was kicked
+type testConn struct {
+	sent       []interface{}
+	kickCode   int
+	kickReason string
+}
+
+func (c *testConn) GetId() uint64                      { return 0 }
+func (c *testConn) AttachReader(reader chan MessageIn) {}
+func (c *testConn) Send(msg interface{}) error         { c.sent = append(c.sent, msg); return nil }
+func (c *testConn) ReadPump()                          {}
+func (c *testConn) WritePump()                         {}
+func (c *testConn) Close()                             {}
+func (c *testConn) Kick(code int, reason string)       { c.kickCode, c.kickReason = code, reason }
+
+func newTestPlayer(id PlayerId) *Player {
+	return NewPlayer(id, &Account{Guest: true}, &testConn{}, DefaultPlayerLimits)
+}
+
+// Takes the messages queued to the player off their queue
+func popQueued(p *Player) []interface{} {
+	queued := make([]interface{}, 0)
+	for {
+		select {
+		case <-p.toPlayer.Ready():
+			items, _ := p.toPlayer.Pop()
+			queued = append(queued, items...)
+		default:
+			return queued
+		}
+	}
+}
+
+// Result of a scripted game, compared between runs
+type scriptedGame struct {
+	Entities []MsgPartEntity
+	Score    int
+	Round    int
+}
+
+// Plays a game from the seed for the number of steps without the
+// game's event loop. Every few steps the player selects the lowest id
+// block with a neighbor of the same color, selects the neighbor, and
+// claims the pair.
+func playScriptedGame(seed int64, steps int) scriptedGame {
+	g := NewGame(0, NewGameTypeRegistry().Default(), seed, nil)
+	p := newTestPlayer(1)
+	g.addPlayer(p)
+	pInfo := g.players[p]
+
+	for i := 0; i < steps; i++ {
+		g.step()
+		popQueued(p)
+		if g.state != GameStateRunning || i%3 != 0 {
+			continue
+		}
+
+		for _, e := range g.board.GetEntityArray() {
+			n := sameColorNeighbor(g.board, e)
+			if n == nil {
+				continue
+			}
+			for _, id := range []EntityId{e.GetId(), n.GetId()} {
+				g.procPlayerCtrl(&PlayerAction{Player: p, Game: &PlayerGameAction{
+					Command:  PlayerCmdGameSelectEntity,
+					EntityId: id,
+				}}, pInfo)
+			}
+			claim := &PlayerAction{Player: p, Game: &PlayerGameAction{Command: PlayerCmdGameClaimSelection}}
+			if g.procPlayerCtrl(claim, pInfo) != nil {
+				g.releaseSelection(pInfo)
+			}
+			break
+		}
+	}
+
+	msg := MsgCreateGameUpdate()
+	msg.AddEntityUpdates(g.board.GetEntityArray())
+	return scriptedGame{Entities: msg.Es, Score: pInfo.Score, Round: g.round}
+}
+
+// Returns the entity's right or lower neighbor if it is the same color
+func sameColorNeighbor(b *Board, e *Entity) *Entity {
+	for _, n := range b.GetEntityArray() {
+		dx, dy := n.x-e.x, n.y-e.y
+		if n.color == e.color && ((dx == 1 && dy == 0) || (dx == 0 && dy == 1)) {
+			return n
+		}
+	}
+	return nil
+}
+
+func TestGameReproducibleFromSeed(t *testing.T) {
+	const steps = 2000
+	first := playScriptedGame(42, steps)
+	if len(first.Entities) == 0 {
+		t.Fatal("Expected blocks on the board")
+	}
+	if first.Score == 0 {
+		t.Fatal("Expected the player to score")
+	}
+
+	second := playScriptedGame(42, steps)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Games with the same seed differ,\n%+v\n%+v", first, second)
+	}
+
+	other := playScriptedGame(43, steps)
+	if reflect.DeepEqual(first.Entities, other.Entities) {
+		t.Fatal("Games with different seeds have the same board")
+	}
+}
+
+func TestGameSeedFitsJavaScriptNumber(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	g := w.addNewGame(w.gameTypes.Default())
+	defer g.Quit()
+	if g.GetSeed() < 0 || g.GetSeed() > maxGameSeed {
+		t.Fatal("Seed out of range,", g.GetSeed())
+	}
+}
+
+func TestGameActionAfterGameRemoved(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	p, info := newTestPlayer(1), &PlayerInstance{}
+	w.players[p] = info
+	g := w.addNewGame(w.gameTypes.Default())
+	w.movePlayerToGame(p, info, g, false)
+
+	// Bind the player to the game, as their event loop would
+	for p.gameCtrl == nil {
+		select {
+		case <-p.toPlayer.Ready():
+			items, _ := p.toPlayer.Pop()
+			for _, item := range items {
+				p.procQueued(item)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Player was never bound to the game")
+		}
+	}
+
+	// The player hasn't yet been told they left the game
+	w.removeGame(g)
+	g.Wait()
+
+	done := make(chan bool)
+	go func() {
+		p.procMessage(w, MessageIn{ReqId: "1", Act: &MsgPlayerAction{G: &MsgPartActionGame{C: int(PlayerCmdGameSelectEntity)}}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Game action blocked after the game was removed")
+	}
+
+	sent := p.conn.(*testConn).sent
+	reply, ok := sent[len(sent)-1].(*MsgActionReply)
+	if !ok || reply.E != int(ActionCodeNotInGame) {
+		t.Fatalf("Expected not in game to be replied, got %+v", sent[len(sent)-1])
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+type GameTypeError struct {
+	GameTypeErrorString string
+}
+
+func (g *GameTypeError) Error() string { return g.GameTypeErrorString }
+
+var (
+	GameTypeErrorInvalid        = &GameTypeError{"Game type must have a name, positive rows, cols, and players, and valid match, simulation, and round rules"}
+	GameTypeErrorUnknownDefault = &GameTypeError{"Default game type is not registered"}
+)
+
+// Defines the size of a game's board, the number of players
+// which can play in it at once, how selections are matched, the
+// rules the simulation uses, and how long rounds last.
+type GameType struct {
+	Name                string
+	Rows, Cols, Players int
+	Match               *MatchRules
+	Sim                 *SimConfig
+	Round               *RoundConfig
+}
+
+var (
+	// Game type presets
+	GameTypeMobileSmall  = &GameType{Name: "mobile-small", Rows: 7, Cols: 5, Players: 5}
+	GameTypeDesktopLarge = &GameType{Name: "desktop-large", Rows: 12, Cols: 18, Players: 8}
+	GameTypeDuel         = &GameType{Name: "duel", Rows: 7, Cols: 7, Players: 2}
+	GameTypeSoloPractice = &GameType{Name: "solo-practice", Rows: 7, Cols: 5, Players: 1}
+)
+
+// Returns if the game type's configuration is usable
+func (gt *GameType) Valid() bool {
+	return len(gt.Name) != 0 && gt.Rows > 0 && gt.Cols > 0 && gt.Players > 0 &&
+		(gt.Match == nil || gt.Match.Valid()) && (gt.Sim == nil || gt.Sim.Valid()) &&
+		(gt.Round == nil || gt.Round.Valid())
+}
+
+// Returns the match rules of the game type, or the default
+// match rules if the game type doesn't define any.
+func (gt *GameType) GetMatchRules() *MatchRules {
+	if gt.Match == nil {
+		return DefaultMatchRules
+	}
+	return gt.Match
+}
+
+// Returns the simulation config of the game type, or the default
+// simulation config if the game type doesn't define one.
+func (gt *GameType) GetSimConfig() *SimConfig {
+	if gt.Sim == nil {
+		return DefaultSimConfig
+	}
+	return gt.Sim
+}
+
+// Returns the round config of the game type, or the default
+// round config if the game type doesn't define one.
+func (gt *GameType) GetRoundConfig() *RoundConfig {
+	if gt.Round == nil {
+		return DefaultRoundConfig
+	}
+	return gt.Round
+}
+
+// Collection of game types players are able to select from.
+type GameTypeRegistry struct {
+	types       []*GameType
+	defaultType *GameType
+}
+
+// Game type config file format
+type gameTypeConfig struct {
+	Default string
+	Types   []*GameType
+}
+
+// Creates a new registry populated with the game type presets. The
+// small mobile game type is the default.
+func NewGameTypeRegistry() *GameTypeRegistry {
+	r := &GameTypeRegistry{
+		types: make([]*GameType, 0, 4),
+	}
+	r.Register(GameTypeMobileSmall)
+	r.Register(GameTypeDesktopLarge)
+	r.Register(GameTypeDuel)
+	r.Register(GameTypeSoloPractice)
+	r.defaultType = GameTypeMobileSmall
+
+	return r
+}
+
+// Creates a new registry with the game type presets, and adds the
+// game types defined in the JSON config file to it. Game types in
+// the file with the same name as a preset replace the preset.
+func LoadGameTypeRegistry(path string) (*GameTypeRegistry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cfg gameTypeConfig
+	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	return NewGameTypeRegistryWith(cfg.Default, cfg.Types)
+}
+
+// Creates a new registry with the game type presets, and adds the game
+// types to it. Game types with the same name as a preset replace the
+// preset. An empty default keeps the preset default.
+func NewGameTypeRegistryWith(defaultName string, types []*GameType) (*GameTypeRegistry, error) {
+	r := NewGameTypeRegistry()
+
+	for _, gt := range types {
+		if err := r.Register(gt); err != nil {
+			return nil, err
+		}
+	}
+	if len(defaultName) != 0 {
+		if err := r.SetDefault(defaultName); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Adds the game type to the registry, replacing any existing game
+// type with the same name.
+func (r *GameTypeRegistry) Register(gameType *GameType) error {
+	if gameType == nil || !gameType.Valid() {
+		return GameTypeErrorInvalid
+	}
+
+	for i, gt := range r.types {
+		if gt.Name == gameType.Name {
+			if r.defaultType == gt {
+				r.defaultType = gameType
+			}
+			r.types[i] = gameType
+			return nil
+		}
+	}
+	r.types = append(r.types, gameType)
+
+	return nil
+}
+
+// Sets the game type players will be placed in when they do not
+// request one.
+func (r *GameTypeRegistry) SetDefault(name string) error {
+	gt := r.Get(name)
+	if gt == nil {
+		return GameTypeErrorUnknownDefault
+	}
+	r.defaultType = gt
+	return nil
+}
+
+// Returns the game type matching the name, or nil if there is
+// no game type by that name. An empty name returns the default
+// game type.
+func (r *GameTypeRegistry) Get(name string) *GameType {
+	if len(name) == 0 {
+		return r.defaultType
+	}
+
+	for _, gt := range r.types {
+		if gt.Name == name {
+			return gt
+		}
+	}
+	return nil
+}
+
+// Returns the default game type
+func (r *GameTypeRegistry) Default() *GameType {
+	return r.defaultType
+}
+
+// Returns the list of registered game types
+func (r *GameTypeRegistry) List() []*GameType {
+	return r.types
+}
@@ -0,0 +1,8 @@
+module github.com/jasondelponte/Apollo
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/gorilla/websocket v1.5.3
+)
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Largest request body accepted by the admin API, and login endpoint
+	maxRequestBodyLen = 4096
+)
+
+// Body of the admin API's notice request
+type AdminNotice struct {
+	Message string
+}
+
+// Creates the handler for the admin API. The API is only served if an
+// admin token is set, and every request must carry the token as a
+// bearer token in its Authorization header. All responses are JSON.
+//
+//	GET  games                          List the games
+//	GET  games/{id}                     Inspect a game's board, and players
+//	POST games/{id}/{pause|resume|stop} Control a game
+//	POST players/{id}/kick              Kick a player from the server
+//	POST players/{id}/{mute|unmute}     Mute or unmute a player's chat
+//	POST notice                         Send all players a notice
+func (h *HttpHandler) initServeAdminHndlr(path string, world *World) {
+	if len(h.AdminToken) == 0 {
+		return
+	}
+
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !h.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			reportJSONError(w, ErrHttpUnauthorized)
+			return
+		}
+
+		if world.isDone() {
+			reportJSONError(w, ErrHttpUnavailable)
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path[len(path):], "/"), "/")
+		switch {
+		case parts[0] == "games" && len(parts) == 1:
+			h.adminListGames(w, r, world)
+		case parts[0] == "games" && len(parts) == 2:
+			h.adminInspectGame(w, r, world, parts[1])
+		case parts[0] == "games" && len(parts) == 3:
+			h.adminControlGame(w, r, world, parts[1], parts[2])
+		case parts[0] == "players" && len(parts) == 3 && parts[2] == "kick":
+			h.adminPlayerCommand(w, r, world, parts[1], AdminCmdKickPlayer)
+		case parts[0] == "players" && len(parts) == 3 && parts[2] == "mute":
+			h.adminPlayerCommand(w, r, world, parts[1], AdminCmdMutePlayer)
+		case parts[0] == "players" && len(parts) == 3 && parts[2] == "unmute":
+			h.adminPlayerCommand(w, r, world, parts[1], AdminCmdUnmutePlayer)
+		case parts[0] == "notice" && len(parts) == 1:
+			h.adminNotice(w, r, world)
+		default:
+			reportJSONError(w, ErrHttpResourceNotFound)
+		}
+	})
+}
+
+// Returns if the request carries the admin token
+func (h *HttpHandler) adminAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) == 1
+}
+
+// Lists the summaries of all games in the world
+func (h *HttpHandler) adminListGames(w http.ResponseWriter, r *http.Request, world *World) {
+	if r.Method != "GET" {
+		reportJSONError(w, ErrHttpMethodNotAllowed)
+		return
+	}
+	reply := world.adminRequest(&AdminRequest{Command: AdminCmdListGames})
+
+	summaries := make([]GameSummary, 0, len(reply.Games))
+	for _, g := range reply.Games {
+		if i := g.Inspect(); i != nil {
+			summaries = append(summaries, i.GameSummary)
+		}
+	}
+	writeJSONReply(w, summaries)
+}
+
+// Replies with the complete state of the game
+func (h *HttpHandler) adminInspectGame(w http.ResponseWriter, r *http.Request, world *World, id string) {
+	if r.Method != "GET" {
+		reportJSONError(w, ErrHttpMethodNotAllowed)
+		return
+	}
+	g := adminFindGame(world, id)
+	if g == nil {
+		reportJSONError(w, ErrHttpResourceNotFound)
+		return
+	}
+	i := g.Inspect()
+	if i == nil {
+		reportJSONError(w, ErrHttpResourceNotFound)
+		return
+	}
+	writeJSONReply(w, i)
+}
+
+// Pauses, resumes, or stops the game
+func (h *HttpHandler) adminControlGame(w http.ResponseWriter, r *http.Request, world *World, id, action string) {
+	if r.Method != "POST" {
+		reportJSONError(w, ErrHttpMethodNotAllowed)
+		return
+	}
+	var ctrl GameControl
+	switch action {
+	case "pause":
+		ctrl = GameControlPause
+	case "resume":
+		ctrl = GameControlResume
+	case "stop":
+		ctrl = GameControlStop
+	default:
+		reportJSONError(w, ErrHttpResourceNotFound)
+		return
+	}
+
+	g := adminFindGame(world, id)
+	if g == nil || !g.Control(ctrl) {
+		reportJSONError(w, ErrHttpResourceNotFound)
+		return
+	}
+	writeJSONReply(w, nil)
+}
+
+// Kicks, mutes, or unmutes the player
+func (h *HttpHandler) adminPlayerCommand(w http.ResponseWriter, r *http.Request, world *World, id string, cmd AdminCmd) {
+	if r.Method != "POST" {
+		reportJSONError(w, ErrHttpMethodNotAllowed)
+		return
+	}
+	playerId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		reportJSONError(w, ErrHttpBadRequeset)
+		return
+	}
+
+	reply := world.adminRequest(&AdminRequest{Command: cmd, PlayerId: PlayerId(playerId)})
+	switch reply.Err {
+	case WorldErrorPlayerNotRegistered:
+		reportJSONError(w, ErrHttpResourceNotFound)
+	case WorldErrorShuttingDown:
+		reportJSONError(w, ErrHttpUnavailable)
+	default:
+		writeJSONReply(w, nil)
+	}
+}
+
+// Sends the notice in the request's body to all players
+func (h *HttpHandler) adminNotice(w http.ResponseWriter, r *http.Request, world *World) {
+	if r.Method != "POST" {
+		reportJSONError(w, ErrHttpMethodNotAllowed)
+		return
+	}
+	var notice AdminNotice
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyLen)).Decode(&notice)
+	if err != nil || len(notice.Message) == 0 {
+		reportJSONError(w, ErrHttpBadRequeset)
+		return
+	}
+
+	reply := world.adminRequest(&AdminRequest{Command: AdminCmdNotice, Notice: notice.Message})
+	if reply.Err == WorldErrorShuttingDown {
+		reportJSONError(w, ErrHttpUnavailable)
+		return
+	}
+	writeJSONReply(w, nil)
+}
+
+// Returns the game with the id, or nil if the game doesn't exist
+func adminFindGame(world *World, id string) *Game {
+	gameId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	reply := world.adminRequest(&AdminRequest{Command: AdminCmdListGames})
+	for _, g := range reply.Games {
+		if g.GetId() == gameId {
+			return g
+		}
+	}
+	return nil
+}
+
+// Sends the request to the world, and waits for its reply. Once the
+// world has shut down WorldErrorShuttingDown is replied.
+func (w *World) adminRequest(req *AdminRequest) *AdminReply {
+	req.Reply = make(chan *AdminReply, 1)
+	select {
+	case w.admin <- req:
+	case <-w.done:
+		return &AdminReply{Err: WorldErrorShuttingDown}
+	}
+	return <-req.Reply
+}
+
+// Returns if the world has shut down
+func (w *World) isDone() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Writes the reply as JSON. A nil reply is written as an empty object.
+func writeJSONReply(w http.ResponseWriter, reply interface{}) {
+	if reply == nil {
+		reply = struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Failed to write reply,", err)
+	}
+}
+
+// Reports the error as a JSON object
+func reportJSONError(w http.ResponseWriter, err *HttpError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Code())
+	json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// Reply of the login endpoint
+type LoginReply struct {
+	Token string
+	Name  string
+}
+
+// Creates the authenticator of websocket connections. Bearer tokens are
+// tried first, then the password store's basic auth, and finally
+// players without credentials are let in as guests if guests are
+// allowed.
+func (h *HttpHandler) initAuthenticator() {
+	chain := make(AuthChain, 0, 3)
+	if h.Tokens != nil {
+		chain = append(chain, h.Tokens)
+	}
+	if h.Users != nil {
+		chain = append(chain, h.Users)
+	}
+	if h.Guests {
+		chain = append(chain, GuestAuthenticator{})
+	}
+	h.authenticator = chain
+}
+
+// Creates the login handler, which exchanges a user name and password
+// from the password store for a bearer token. Browsers can't use basic
+// auth with websockets, so they log in first, and connect with the
+// token. Only served if both tokens, and the password store are enabled.
+func (h *HttpHandler) initServeLoginHndlr(path string) {
+	if h.Tokens == nil || h.Users == nil {
+		return
+	}
+
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			reportJSONError(w, ErrHttpMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyLen)
+
+		account, err := h.Users.LoginRequest(r, r.PostFormValue("user"), r.PostFormValue("password"))
+		if err == AuthErrorRateLimited || err == AuthErrorBusy {
+			reportJSONError(w, ErrHttpTooManyRequests)
+			return
+		} else if err != nil {
+			log.Println("Login failed,", err)
+			reportJSONError(w, ErrHttpUnauthorized)
+			return
+		}
+		token, err := h.Tokens.Issue(account, h.TokenTTL)
+		if err != nil {
+			log.Println("Failed to issue token,", err)
+			reportJSONError(w, ErrHttpInternalError)
+			return
+		}
+		writeJSONReply(w, &LoginReply{Token: token, Name: account.Name})
+	})
+}
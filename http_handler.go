@@ -1,15 +1,20 @@
 package main
 
 import (
-	gnws "code.google.com/p/go.net/websocket"
+	"context"
 	"fmt"
-	gbws "github.com/garyburd/go-websocket/websocket"
+	"github.com/gorilla/websocket"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // HTTP Error Enumerables
@@ -26,7 +31,15 @@ var (
 	ErrHttpResourceNotFound = &HttpError{ErrorString: "Not found", CodeNum: 404}
 	ErrHttpMethodNotAllowed = &HttpError{ErrorString: "Method not allowed", CodeNum: 405}
 	ErrHttpBadRequeset      = &HttpError{ErrorString: "Bad request", CodeNum: 400}
+	ErrHttpUnauthorized     = &HttpError{ErrorString: "Unauthorized", CodeNum: 401}
+	ErrHttpTooManyRequests  = &HttpError{ErrorString: "Too many requests", CodeNum: 429}
 	ErrHttpInternalError    = &HttpError{ErrorString: "Internal failure", CodeNum: 500}
+	ErrHttpUnavailable      = &HttpError{ErrorString: "Server is shutting down", CodeNum: 503}
+)
+
+const (
+	// Time to wait for requests to finish when shutting down
+	shutdownWait = 5 * time.Second
 )
 
 type HttpHandler struct {
@@ -39,9 +52,24 @@ type HttpHandler struct {
 	ServeStatic    bool
 	templates      *template.Template
 	nextConnId     uint64
-	nextPlayerId   PlayerId
+	nextPlayerId   uint64
 	rootURLPathLen int
 	WsConnType     string
+	ReplayDir      string
+	ConnLimits     ConnLimits
+	AdminToken     string              // Token required by the admin API, disabled if empty
+	Guests         bool                // Allow players without credentials as guests
+	Tokens         *TokenAuthenticator // Bearer token authenticator, nil if disabled
+	TokenTTL       time.Duration       // Time tokens issued by the login endpoint are valid
+	Users          *PasswordStore      // Local password store, nil if disabled
+	Profiles       ProfileStore        // Store of player profiles, nil if disabled
+	Leaderboards   *Leaderboards       // Nil if disabled
+	authenticator  Authenticator
+	limitsMu       sync.Mutex
+	playerLimits   PlayerLimits
+	serversMu      sync.Mutex
+	servers        []*http.Server
+	draining       int32 // Set once new websockets are no longer accepted
 }
 
 // Configures the http connection and starts the listender
@@ -51,17 +79,25 @@ func (h *HttpHandler) HandleHttpConnection(world *World) {
 	h.loadTemplates()
 
 	h.initServeHomeHndlr(h.RootURLPath+"/", world)
+	h.initAuthenticator()
+	h.initServeLoginHndlr(h.RootURLPath + "/login")
 
 	// If the goapp is serving the static files
 	if h.ServeStatic {
 		h.initServeStaticHndlr(h.RootURLPath + "/assets/")
 	}
 
+	h.initServeAdminHndlr(h.RootURLPath+"/admin/", world)
+	h.initServeMetricsHndlr(h.RootURLPath + "/metrics")
+	h.initServeProfileHndlr(h.RootURLPath + "/profiles/")
+	h.initServeLeaderboardHndlr(h.RootURLPath + "/leaderboards/")
+
 	// Switch between the different go websocket libraries
-	if h.WsConnType == "gb" {
-		h.initServeGbWsHndlr(h.RootURLPath+"/ws", world)
-	} else {
-		h.initServeGnWsHndlr(h.RootURLPath+"/ws", world)
+	switch h.WsConnType {
+	case "gorilla", "":
+		h.initServeWsHndlr(h.RootURLPath+"/ws", world)
+	default:
+		log.Fatal("Unknown websocket library: ", h.WsConnType)
 	}
 
 	// Build the address with port if it's provided
@@ -71,22 +107,63 @@ func (h *HttpHandler) HandleHttpConnection(world *World) {
 	}
 
 	wsAddress := fmt.Sprintf("%s:%d", h.Addr, h.WsPort)
-	
+
+	server := &http.Server{Addr: address}
+	wsServer := &http.Server{Addr: wsAddress}
+	h.serversMu.Lock()
+	h.servers = []*http.Server{server, wsServer}
+	h.serversMu.Unlock()
+
 	// Start listening for static files and html content
-	go http.ListenAndServe(address, nil)
+	go server.ListenAndServe()
 
 	// Start listening for the websocket connections
 	if len(h.TlsCrt) != 0 && len(h.TlsKey) != 0 {
-		if err := http.ListenAndServeTLS(wsAddress, h.TlsCrt, h.TlsKey, nil); err != nil {
+		if err := wsServer.ListenAndServeTLS(h.TlsCrt, h.TlsKey); err != nil && err != http.ErrServerClosed {
 			log.Fatal("ListenAndServeTLS: ", err)
 		}
 	} else {
-		if err := http.ListenAndServe(wsAddress, nil); err != nil {
+		if err := wsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal("ListenAndServe: ", err)
 		}
 	}
 }
 
+// Sets the limits of new players. Players already connected keep the
+// limits they were created with.
+func (h *HttpHandler) SetPlayerLimits(limits PlayerLimits) {
+	h.limitsMu.Lock()
+	defer h.limitsMu.Unlock()
+	h.playerLimits = limits
+}
+
+func (h *HttpHandler) getPlayerLimits() PlayerLimits {
+	h.limitsMu.Lock()
+	defer h.limitsMu.Unlock()
+	return h.playerLimits
+}
+
+// Stops accepting new websocket connections. Existing connections are
+// not affected.
+func (h *HttpHandler) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Closes the listeners, and waits for the requests being served to
+// finish, up to a deadline. Websocket connections are not closed.
+func (h *HttpHandler) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+	defer cancel()
+
+	h.serversMu.Lock()
+	defer h.serversMu.Unlock()
+	for _, server := range h.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Failed to shutdown http server,", err)
+		}
+	}
+}
+
 // Load all the temmplates into memeory
 func (h *HttpHandler) loadTemplates() {
 	h.templates = template.Must(template.ParseFiles("templates/home.html"))
@@ -174,46 +251,146 @@ func (h *HttpHandler) initServeStaticHndlr(path string) {
 	})
 }
 
+// Serves the server's metrics in the Prometheus text format
+func (h *HttpHandler) initServeMetricsHndlr(path string) {
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			ErrHttpMethodNotAllowed.Report(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		serverMetrics.WriteText(w)
+	})
+}
+
 // creats the webocket http upgrade handler requests from the client.
-func (h *HttpHandler) initServeGbWsHndlr(path string, world *World) {
+func (h *HttpHandler) initServeWsHndlr(path string, world *World) {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    CodecNames(),
+		// The websockets may be served on a different port than the
+		// home page, so the origin's host won't match the request's.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
 	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			ErrHttpMethodNotAllowed.Report(w)
 			return
 		}
-		ws, err := gbws.Upgrade(w, r.Header, "", 1024, 1024)
+		if atomic.LoadInt32(&h.draining) != 0 {
+			ErrHttpUnavailable.Report(w)
+			return
+		}
+		account, err := h.authenticator.Authenticate(r)
+		if err == AuthErrorRateLimited || err == AuthErrorBusy {
+			ErrHttpTooManyRequests.Report(w)
+			return
+		} else if err != nil {
+			log.Println("Rejected websocket connection,", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			ErrHttpUnauthorized.Report(w)
+			return
+		}
+		// The upgrader replies to the client if the upgrade fails
+		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Unable to upgrade connection,", err)
-			ErrHttpBadRequeset.Report(w)
 			return
 		}
 
-		h.kickOffPlayer(NewGbWsConn(h.nextConnId, ws), world)
-		h.nextConnId++
+		connId := atomic.AddUint64(&h.nextConnId, 1) - 1
+		h.kickOffPlayer(NewWsConn(connId, ws, h.ConnLimits), account, r, world)
 	})
 }
 
-// Creates the websocket http upgrade using the go.net websocket version
-func (h *HttpHandler) initServeGnWsHndlr(path string, world *World) {
-	http.Handle(path, gnws.Handler(func(ws *gnws.Conn) {
-		h.kickOffPlayer(NewGnWsConn(h.nextConnId, ws), world)
-		h.nextConnId++
-	}))
-}
+// Creates the player for the connection as the account, and registers
+// it with the world. The game type the player would like to join can be
+// requested with the "type" query parameter of the websocket URL, and
+// setting the "spectate" query parameter will watch a game of that type
+// instead. If the "replay" query parameter is set the connection will be
+// sent the replay instead.
+func (h *HttpHandler) kickOffPlayer(conn Connection, account *Account, r *http.Request, world *World) {
+	if len(r.URL.Query().Get("replay")) != 0 {
+		h.kickOffReplay(conn, r)
+		return
+	}
+
+	go conn.WritePump()
 
-func (h *HttpHandler) kickOffPlayer(conn Connection, world *World) {
-	player := NewPlayer(h.nextPlayerId, conn)
-	h.nextPlayerId++
+	// Resume the player's session if they have one, otherwise
+	// register them as a new player.
+	var player *Player
+	if session := r.URL.Query().Get("session"); len(session) != 0 {
+		reply := make(chan *Player, 1)
+		world.resume <- &PlayerResume{Session: session, Account: account, Conn: conn, Reply: reply}
+		player = <-reply
+	}
+	if player == nil {
+		id := PlayerId(atomic.AddUint64(&h.nextPlayerId, 1) - 1)
+		player = NewPlayer(id, account, conn, h.getPlayerLimits())
+
+		world.register <- &PlayerRegistration{
+			Player:    player,
+			Conn:      conn,
+			GameType:  r.URL.Query().Get("type"),
+			Spectator: len(r.URL.Query().Get("spectate")) != 0,
+		}
+	}
 
 	defer func() {
-		log.Println("Player", player.GetId(), " connection closing, unregistering")
-		world.unregister <- player
+		log.Println("Player", player.GetId(), " connection closing")
+		world.connLost <- &PlayerConnLost{Player: player, Conn: conn}
 	}()
 
-	go conn.WritePump()
-	world.register <- player
-
 	// Read pump will hold the connection open until we are finished with it.
 	conn.ReadPump()
 
 }
+
+// Plays back the replay named by the "replay" query parameter to the
+// connection. The playback speed can be set with the "speed" query
+// parameter, where 2 is twice as fast as the game was recorded.
+func (h *HttpHandler) kickOffReplay(conn Connection, r *http.Request) {
+	query := r.URL.Query()
+	speed, err := strconv.ParseFloat(query.Get("speed"), 64)
+	if err != nil || speed <= 0 {
+		speed = 1
+	}
+
+	// Incoming messages are not used by replays, but still need to be read
+	reader := make(chan MessageIn)
+	conn.AttachReader(reader)
+	go func() {
+		for _ = range reader {
+		}
+	}()
+	go conn.WritePump()
+	defer conn.Close()
+
+	if len(h.ReplayDir) == 0 {
+		log.Println("Replay requested, but replays are not enabled")
+		return
+	}
+	replay, err := OpenReplay(filepath.Join(h.ReplayDir, filepath.Base(query.Get("replay"))))
+	if err != nil {
+		log.Println("Unable to open replay,", err)
+		return
+	}
+	defer replay.Close()
+
+	done := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		if err := replay.PlayTo(conn, speed, done); err != nil {
+			log.Println("Replay playback failed,", err)
+		}
+		close(finished)
+	}()
+
+	// Read pump will hold the connection open until the client leaves
+	conn.ReadPump()
+	close(done)
+	<-finished
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Creates the handler serving the profiles of accounts as JSON, at the
+// account's id under the path. Only served if profiles are enabled.
+func (h *HttpHandler) initServeProfileHndlr(path string) {
+	if h.Profiles == nil {
+		return
+	}
+
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			reportJSONError(w, ErrHttpMethodNotAllowed)
+			return
+		}
+		accountId := r.URL.Path[len(path):]
+		if len(accountId) == 0 || len(accountId) > maxAccountIdLen {
+			reportJSONError(w, ErrHttpResourceNotFound)
+			return
+		}
+
+		profile := h.Profiles.Get(accountId)
+		if profile == nil {
+			reportJSONError(w, ErrHttpResourceNotFound)
+			return
+		}
+		writeJSONReply(w, profile)
+	})
+}
+
+// Creates the handler serving pages of the leaderboards as JSON, at the
+// game type, and window under the path, eg. "duel/weekly". The page
+// starts at the "offset" query parameter, or is centered on the entry of
+// the account in the "around" parameter, and has up to "limit" entries.
+func (h *HttpHandler) initServeLeaderboardHndlr(path string) {
+	if h.Leaderboards == nil {
+		return
+	}
+
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			reportJSONError(w, ErrHttpMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path[len(path):], "/"), "/")
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			reportJSONError(w, ErrHttpResourceNotFound)
+			return
+		}
+		window, ok := ParseLeaderboardWindow(parts[1])
+		if !ok {
+			reportJSONError(w, ErrHttpResourceNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		offset, limit := 0, 0
+		var err error
+		if v := query.Get("offset"); len(v) != 0 {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				reportJSONError(w, ErrHttpBadRequeset)
+				return
+			}
+		}
+		if v := query.Get("limit"); len(v) != 0 {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+				reportJSONError(w, ErrHttpBadRequeset)
+				return
+			}
+		}
+
+		var page *LeaderboardPage
+		if around := query.Get("around"); len(around) != 0 {
+			page = h.Leaderboards.Around(parts[0], window, around, limit)
+			if page == nil {
+				reportJSONError(w, ErrHttpResourceNotFound)
+				return
+			}
+		} else {
+			page = h.Leaderboards.Page(parts[0], window, offset, limit)
+		}
+		writeJSONReply(w, page)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type InboundError struct {
+	InboundErrorString string
+	CodeNum            ActionCode
+}
+
+func (i *InboundError) Error() string    { return i.InboundErrorString }
+func (i *InboundError) Code() ActionCode { return i.CodeNum }
+
+var (
+	InboundErrorRateLimited    = &InboundError{"Too many actions, slow down", ActionCodeRateLimited}
+	InboundErrorMalformed      = &InboundError{"Message could not be decoded", ActionCodeMalformed}
+	InboundErrorNoAction       = &InboundError{"Message has no action", ActionCodeInvalid}
+	InboundErrorFieldTooLong   = &InboundError{"Message field is too long", ActionCodeInvalid}
+	InboundErrorFieldInvalid   = &InboundError{"Message field is invalid", ActionCodeInvalid}
+	InboundErrorUnknownCommand = &InboundError{"Unknown action command", ActionCodeUnknownCommand}
+)
+
+const (
+	maxReqIdLen     = 64
+	maxGameTypeLen  = 64
+	maxAccountIdLen = 128
+)
+
+// Limits of the actions a player can send. Game, world, and chat actions
+// are each limited by a token bucket. Every rejected or malformed message
+// is a strike against the player, and players who run out of strikes
+// are kicked. A strike is restored each second.
+type ActionLimits struct {
+	GameRate   float64 // Game actions allowed per second
+	GameBurst  int     // Game actions allowed at once
+	WorldRate  float64 // World actions allowed per second
+	WorldBurst int     // World actions allowed at once
+	ChatRate   float64 // Chat messages allowed per second
+	ChatBurst  int     // Chat messages allowed at once
+	Strikes    int     // Rejected messages allowed at once before a kick
+}
+
+var (
+	DefaultActionLimits = ActionLimits{
+		GameRate:   10,
+		GameBurst:  20,
+		WorldRate:  2,
+		WorldBurst: 5,
+		ChatRate:   1,
+		ChatBurst:  3,
+		Strikes:    20,
+	}
+)
+
+// Counts of the messages received from all players
+type InboundStats struct {
+	Accepted    uint64
+	RateLimited uint64
+	Invalid     uint64
+	Malformed   uint64
+	Kicked      uint64
+}
+
+var inboundStats InboundStats
+
+// Returns a copy of the counts of the messages received from all players
+func GetInboundStats() InboundStats {
+	return InboundStats{
+		Accepted:    atomic.LoadUint64(&inboundStats.Accepted),
+		RateLimited: atomic.LoadUint64(&inboundStats.RateLimited),
+		Invalid:     atomic.LoadUint64(&inboundStats.Invalid),
+		Malformed:   atomic.LoadUint64(&inboundStats.Malformed),
+		Kicked:      atomic.LoadUint64(&inboundStats.Kicked),
+	}
+}
+
+// Token bucket refilled at a constant rate, up to its burst size.
+// Not safe for use by multiple goroutines.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a new full token bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Takes a token from the bucket, returns false if the bucket is empty
+func (b *TokenBucket) Allow() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limits the actions received from a single player
+type ActionLimiter struct {
+	game    *TokenBucket
+	world   *TokenBucket
+	chat    *TokenBucket
+	strikes *TokenBucket
+}
+
+// Creates a new action limiter with full buckets
+func NewActionLimiter(limits ActionLimits) *ActionLimiter {
+	return &ActionLimiter{
+		game:    NewTokenBucket(limits.GameRate, limits.GameBurst),
+		world:   NewTokenBucket(limits.WorldRate, limits.WorldBurst),
+		chat:    NewTokenBucket(limits.ChatRate, limits.ChatBurst),
+		strikes: NewTokenBucket(1, limits.Strikes),
+	}
+}
+
+// Validates the message, and checks the player is within their limits
+// for its actions. Acknowledgements of game updates are not limited.
+func (l *ActionLimiter) Check(msg *MessageIn) error {
+	if err := msg.Validate(); err != nil {
+		if err == InboundErrorMalformed {
+			atomic.AddUint64(&inboundStats.Malformed, 1)
+		} else {
+			atomic.AddUint64(&inboundStats.Invalid, 1)
+		}
+		return err
+	}
+
+	act := msg.Act
+	if act.G != nil && PlayerCmd(act.G.C) != PlayerCmdGameAck && !l.game.Allow() {
+		atomic.AddUint64(&inboundStats.RateLimited, 1)
+		return InboundErrorRateLimited
+	}
+	if act.W != nil && !l.world.Allow() {
+		atomic.AddUint64(&inboundStats.RateLimited, 1)
+		return InboundErrorRateLimited
+	}
+	if act.C != nil && !l.chat.Allow() {
+		atomic.AddUint64(&inboundStats.RateLimited, 1)
+		return InboundErrorRateLimited
+	}
+
+	atomic.AddUint64(&inboundStats.Accepted, 1)
+	return nil
+}
+
+// Records a strike against the player, returns false if the player
+// has run out of strikes.
+func (l *ActionLimiter) Strike() bool {
+	return l.strikes.Allow()
+}
+
+// Validates the message's fields, and that its commands are known
+func (m *MessageIn) Validate() error {
+	if m.Err != nil {
+		return InboundErrorMalformed
+	}
+	if m.Act == nil || (m.Act.W == nil && m.Act.G == nil && m.Act.C == nil) {
+		return InboundErrorNoAction
+	}
+	if len(m.ReqId) > maxReqIdLen {
+		return InboundErrorFieldTooLong
+	}
+
+	if w := m.Act.W; w != nil {
+		if len(w.T) > maxGameTypeLen || len(w.A) > maxAccountIdLen {
+			return InboundErrorFieldTooLong
+		}
+		if w.C < int(PlayerCmdWorldListGames) || w.C > int(PlayerCmdWorldFindGame) {
+			return InboundErrorUnknownCommand
+		}
+		if !LeaderboardWindow(w.L).Valid() || w.O < 0 {
+			return InboundErrorFieldInvalid
+		}
+	}
+	if g := m.Act.G; g != nil {
+		if g.C < int(PlayerCmdGameSelectEntity) || g.C > int(PlayerCmdGameSnapshot) {
+			return InboundErrorUnknownCommand
+		}
+	}
+	return nil
+}
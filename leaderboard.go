@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type LeaderboardWindow int
+
+var (
+	// Leaderboard windows
+	LeaderboardDaily   = LeaderboardWindow(0)
+	LeaderboardWeekly  = LeaderboardWindow(1)
+	LeaderboardAllTime = LeaderboardWindow(2)
+)
+
+var leaderboardWindowNames = []string{"daily", "weekly", "alltime"}
+
+const (
+	// Entries in a leaderboard page if no limit is requested
+	defaultLeaderboardPageLen = 10
+	// Most entries in a leaderboard page
+	maxLeaderboardPageLen = 100
+)
+
+// Returns the window's name
+func (w LeaderboardWindow) String() string {
+	if w < 0 || int(w) >= len(leaderboardWindowNames) {
+		return "unknown"
+	}
+	return leaderboardWindowNames[w]
+}
+
+// Returns if the window is one of the known windows
+func (w LeaderboardWindow) Valid() bool {
+	return w >= LeaderboardDaily && w <= LeaderboardAllTime
+}
+
+// Returns the window with the name, and false if there is none
+func ParseLeaderboardWindow(name string) (LeaderboardWindow, bool) {
+	for i, n := range leaderboardWindowNames {
+		if n == name {
+			return LeaderboardWindow(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the start of the window containing the time. Days start at
+// midnight UTC, and weeks at midnight UTC on Monday. The all-time window
+// starts at the unix epoch.
+func (w LeaderboardWindow) Start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch w {
+	case LeaderboardDaily:
+		return day
+	case LeaderboardWeekly:
+		// Weekdays count from Sunday, weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// Returns the end of the window starting at the time. Windows include
+// their start, but not their end. The all-time window has no end, and
+// the zero time is returned.
+func (w LeaderboardWindow) End(start time.Time) time.Time {
+	switch w {
+	case LeaderboardDaily:
+		return start.AddDate(0, 0, 1)
+	case LeaderboardWeekly:
+		return start.AddDate(0, 0, 7)
+	}
+	return time.Time{}
+}
+
+// Standing of an account in a leaderboard
+type LeaderboardEntry struct {
+	AccountId string
+	Name      string
+	Score     int // Total score of the rounds played in the window
+	Wins      int
+	Games     int
+}
+
+// Entry with its rank. Entries with the same score, and wins share the
+// same rank, and are ordered by account id.
+type RankedLeaderboardEntry struct {
+	Rank int
+	LeaderboardEntry
+}
+
+// Page of a leaderboard's entries
+type LeaderboardPage struct {
+	Type    string
+	Window  string
+	Start   int64 // Unix time the window started
+	Ends    int64 // Unix time the window ends, 0 if it doesn't
+	Total   int   // Number of entries in the leaderboard
+	Entries []RankedLeaderboardEntry
+}
+
+// Final result of a player in a round, recorded to the leaderboards
+type LeaderboardResult struct {
+	Account *Account
+	Name    string
+	Score   int
+	Won     bool
+}
+
+// Daily, weekly, and all-time leaderboards of each game type, ranking
+// the accounts by the total score of the rounds they played. The daily
+// and weekly leaderboards are emptied when their window rolls over. If
+// the leaderboards are persisted each change appends the entry to a
+// record log. Safe for use by multiple goroutines.
+type Leaderboards struct {
+	mu     sync.Mutex
+	boards map[leaderboardKey]*leaderboard
+	clock  Clock
+	log    *RecordLog // Nil if not persisted
+}
+
+type leaderboardKey struct {
+	gameType string
+	window   LeaderboardWindow
+}
+
+type leaderboard struct {
+	start   time.Time
+	entries map[string]*LeaderboardEntry
+	ranked  []RankedLeaderboardEntry // Nil if entries changed since ranked
+}
+
+// Entry of a leaderboard as it is written to the record log
+type leaderboardRecord struct {
+	Type   string
+	Window LeaderboardWindow
+	Start  int64
+	LeaderboardEntry
+}
+
+// Creates new empty leaderboards which are not persisted
+func NewLeaderboards() *Leaderboards {
+	return &Leaderboards{
+		boards: make(map[leaderboardKey]*leaderboard),
+		clock:  WallClock{},
+	}
+}
+
+// Opens the leaderboards persisted in the file, creating it if it
+// doesn't exist. Entries of windows which have rolled over are dropped.
+func OpenLeaderboards(path string) (*Leaderboards, error) {
+	l := NewLeaderboards()
+	now := l.clock.Now()
+	err := ReadRecordLog(path, func(data []byte) error {
+		var record leaderboardRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if len(record.Type) == 0 || len(record.AccountId) == 0 || !record.Window.Valid() {
+			return StoreErrorInvalidRecord
+		}
+		if record.Window.Start(now).Unix() != record.Start {
+			return nil
+		}
+		board := l.board(record.Type, record.Window, now, true)
+		entry := record.LeaderboardEntry
+		board.entries[entry.AccountId] = &entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if l.log, err = OpenRecordLog(path, l.records(now)); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Returns the records of the entries of the leaderboards. Leaderboards
+// whose window has rolled over are dropped. Must be called while locked.
+func (l *Leaderboards) records(now time.Time) []interface{} {
+	records := make([]interface{}, 0)
+	for key, board := range l.boards {
+		if !board.start.Equal(key.window.Start(now)) {
+			delete(l.boards, key)
+			continue
+		}
+		for _, entry := range board.entries {
+			records = append(records, &leaderboardRecord{
+				Type:             key.gameType,
+				Window:           key.window,
+				Start:            board.start.Unix(),
+				LeaderboardEntry: *entry,
+			})
+		}
+	}
+	return records
+}
+
+// Compacts the log to the entries of the leaderboards whose windows
+// haven't rolled over. Must be called while locked.
+func (l *Leaderboards) compact(now time.Time) {
+	if err := l.log.Compact(l.records(now)); err != nil {
+		log.Println("Failed to compact leaderboards,", err)
+	}
+}
+
+// Replaces the clock deciding the windows results are recorded in. Must
+// be called before the leaderboards are used.
+func (l *Leaderboards) SetClock(clock Clock) {
+	l.clock = clock
+}
+
+// Returns the leaderboard of the game type in the window containing the
+// time. A leaderboard whose window has rolled over is emptied, and its
+// entries compacted out of the log. Nil is returned if the leaderboard
+// doesn't exist, unless create is set.
+func (l *Leaderboards) board(gameType string, window LeaderboardWindow, now time.Time, create bool) *leaderboard {
+	key := leaderboardKey{gameType, window}
+	start := window.Start(now)
+	board := l.boards[key]
+	if board != nil && !board.start.Equal(start) {
+		delete(l.boards, key)
+		board = nil
+		if l.log != nil {
+			l.compact(now)
+		}
+	}
+	if board == nil && create {
+		board = &leaderboard{start: start, entries: make(map[string]*LeaderboardEntry)}
+		l.boards[key] = board
+	}
+	return board
+}
+
+// Records the results of a round of the game type to each of its
+// leaderboards. Guests are not recorded. The results are recorded in
+// memory even if appending them to the log fails, and the first error
+// is returned.
+func (l *Leaderboards) Record(gameType string, results []*LeaderboardResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var rtrn error = nil
+	now := l.clock.Now()
+	for window := LeaderboardDaily; window <= LeaderboardAllTime; window++ {
+		board := l.board(gameType, window, now, true)
+		for _, result := range results {
+			if result.Account.Guest || len(result.Account.Id) == 0 {
+				continue
+			}
+			entry := board.entries[result.Account.Id]
+			if entry == nil {
+				entry = &LeaderboardEntry{AccountId: result.Account.Id}
+				board.entries[entry.AccountId] = entry
+			}
+			entry.Name = result.Name
+			entry.Score += result.Score
+			entry.Games++
+			if result.Won {
+				entry.Wins++
+			}
+			board.ranked = nil
+
+			if l.log == nil {
+				continue
+			}
+			err := l.log.Append(&leaderboardRecord{
+				Type:             gameType,
+				Window:           window,
+				Start:            board.start.Unix(),
+				LeaderboardEntry: *entry,
+			})
+			if err != nil && rtrn == nil {
+				rtrn = err
+			}
+		}
+	}
+
+	if l.log != nil {
+		entries := 0
+		for _, board := range l.boards {
+			entries += len(board.entries)
+		}
+		if l.log.NeedsCompact(entries) {
+			l.compact(now)
+		}
+	}
+	return rtrn
+}
+
+// Returns the page of the game type's leaderboard in the window, with
+// up to limit entries starting from the offset.
+func (l *Leaderboards) Page(gameType string, window LeaderboardWindow, offset, limit int) *LeaderboardPage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	page, ranked := l.newPage(gameType, window)
+	page.Entries = pageEntries(ranked, offset, limit)
+	return page
+}
+
+// Returns the page of the game type's leaderboard in the window, with
+// up to limit entries centered on the account's entry. Nil is returned
+// if the account isn't in the leaderboard.
+func (l *Leaderboards) Around(gameType string, window LeaderboardWindow, accountId string, limit int) *LeaderboardPage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	page, ranked := l.newPage(gameType, window)
+	idx := -1
+	for i := range ranked {
+		if ranked[i].AccountId == accountId {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return nil
+	}
+
+	limit = clampPageLen(limit)
+	offset := idx - limit/2
+	if offset+limit > len(ranked) {
+		offset = len(ranked) - limit
+	}
+	page.Entries = pageEntries(ranked, offset, limit)
+	return page
+}
+
+// Creates an empty page of the leaderboard, and returns the leaderboard's
+// ranked entries.
+func (l *Leaderboards) newPage(gameType string, window LeaderboardWindow) (*LeaderboardPage, []RankedLeaderboardEntry) {
+	now := l.clock.Now()
+	start := window.Start(now)
+	page := &LeaderboardPage{
+		Type:    gameType,
+		Window:  window.String(),
+		Start:   start.Unix(),
+		Entries: make([]RankedLeaderboardEntry, 0),
+	}
+	if end := window.End(start); !end.IsZero() {
+		page.Ends = end.Unix()
+	}
+
+	board := l.board(gameType, window, now, false)
+	if board == nil {
+		return page, nil
+	}
+	if board.ranked == nil {
+		board.rank()
+	}
+	page.Total = len(board.ranked)
+	return page, board.ranked
+}
+
+// Sorts the leaderboard's entries, and ranks them. Entries tied with
+// the entry before them share its rank. The ranked entries are copies,
+// which are replaced instead of modified when the entries change, so
+// pages can be read after the leaderboards are unlocked.
+func (b *leaderboard) rank() {
+	sorted := make([]*LeaderboardEntry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Sort(leaderboardEntriesByRank(sorted))
+
+	b.ranked = make([]RankedLeaderboardEntry, len(sorted))
+	for i, entry := range sorted {
+		b.ranked[i] = RankedLeaderboardEntry{Rank: i + 1, LeaderboardEntry: *entry}
+		if i > 0 && !leaderboardEntryBeats(sorted[i-1], entry) {
+			b.ranked[i].Rank = b.ranked[i-1].Rank
+		}
+	}
+}
+
+// Returns the limit of a page, clamped to the allowed page lengths
+func clampPageLen(limit int) int {
+	if limit <= 0 {
+		return defaultLeaderboardPageLen
+	}
+	if limit > maxLeaderboardPageLen {
+		return maxLeaderboardPageLen
+	}
+	return limit
+}
+
+// Returns the ranked entries from the offset, up to the limit
+func pageEntries(ranked []RankedLeaderboardEntry, offset, limit int) []RankedLeaderboardEntry {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(ranked) {
+		return make([]RankedLeaderboardEntry, 0)
+	}
+	end := offset + clampPageLen(limit)
+	if end > len(ranked) {
+		end = len(ranked)
+	}
+	return ranked[offset:end]
+}
+
+// Returns if the entry ranks strictly above the other entry
+func leaderboardEntryBeats(a, b *LeaderboardEntry) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.Wins > b.Wins
+}
+
+// Sorts the leaderboard entries by rank, highest score first, then most
+// wins, with ties ordered by account id.
+type leaderboardEntriesByRank []*LeaderboardEntry
+
+func (l leaderboardEntriesByRank) Len() int      { return len(l) }
+func (l leaderboardEntriesByRank) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l leaderboardEntriesByRank) Less(i, j int) bool {
+	if leaderboardEntryBeats(l[i], l[j]) || leaderboardEntryBeats(l[j], l[i]) {
+		return leaderboardEntryBeats(l[i], l[j])
+	}
+	return l[i].AccountId < l[j].AccountId
+}
+
+// Writes any pending changes, and closes the leaderboards' record log
+func (l *Leaderboards) Close() error {
+	if l.log == nil {
+		return nil
+	}
+	return l.log.Close()
+}
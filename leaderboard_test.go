@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaderboardWindowStart(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		window LeaderboardWindow
+		time   string
+		start  string
+	}{
+		{LeaderboardDaily, "2026-10-18T00:00:00Z", "2026-10-18T00:00:00Z"},
+		{LeaderboardDaily, "2026-10-18T23:59:59.999Z", "2026-10-18T00:00:00Z"},
+		{LeaderboardDaily, "2026-10-19T00:00:00Z", "2026-10-19T00:00:00Z"},
+		{LeaderboardDaily, "2026-10-18T20:00:00-05:00", "2026-10-19T00:00:00Z"},
+		// The 18th is a Sunday, the last day of the week starting the 12th
+		{LeaderboardWeekly, "2026-10-18T23:59:59.999Z", "2026-10-12T00:00:00Z"},
+		{LeaderboardWeekly, "2026-10-19T00:00:00Z", "2026-10-19T00:00:00Z"},
+		{LeaderboardWeekly, "2026-10-25T23:59:59Z", "2026-10-19T00:00:00Z"},
+		{LeaderboardWeekly, "2026-12-31T12:00:00Z", "2026-12-28T00:00:00Z"},
+		{LeaderboardAllTime, "2026-10-18T12:00:00Z", "1970-01-01T00:00:00Z"},
+	}
+	for _, test := range tests {
+		start := test.window.Start(at(test.time))
+		if !start.Equal(at(test.start)) {
+			t.Errorf("%s window at %s, expected start %s got %s", test.window, test.time, test.start, start)
+		}
+	}
+}
+
+// Returns the account ids in the game type's leaderboard in the window
+func leaderboardIds(l *Leaderboards, window LeaderboardWindow) []string {
+	ids := make([]string, 0)
+	for _, e := range l.Page("duel", window, 0, 10).Entries {
+		ids = append(ids, e.AccountId)
+	}
+	return ids
+}
+
+func TestLeaderboardsRollOver(t *testing.T) {
+	l := NewLeaderboards()
+	// The last millisecond of Sunday, and so of the week
+	clock := NewStepClock(time.Date(2026, 10, 18, 23, 59, 59, 999e6, time.UTC))
+	l.SetClock(clock)
+
+	record := func(id string, score int) {
+		err := l.Record("duel", []*LeaderboardResult{{Account: &Account{Id: id}, Name: id, Score: score}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(when string, window LeaderboardWindow, ids ...string) {
+		got := leaderboardIds(l, window)
+		if fmt.Sprint(got) != fmt.Sprint(ids) {
+			t.Errorf("%s, expected the %s leaderboard to have %v, got %v", when, window, ids, got)
+		}
+	}
+
+	record("jo", 10)
+	expect("Sunday", LeaderboardDaily, "jo")
+	expect("Sunday", LeaderboardWeekly, "jo")
+
+	clock.Advance(time.Millisecond)
+	expect("Monday", LeaderboardDaily)
+	expect("Monday", LeaderboardWeekly)
+	expect("Monday", LeaderboardAllTime, "jo")
+
+	record("al", 5)
+	clock.Advance(24*time.Hour - time.Millisecond)
+	expect("End of Monday", LeaderboardDaily, "al")
+
+	clock.Advance(time.Millisecond)
+	record("jo", 1)
+	expect("Tuesday", LeaderboardDaily, "jo")
+	expect("Tuesday", LeaderboardWeekly, "al", "jo")
+	expect("Tuesday", LeaderboardAllTime, "jo", "al")
+
+	page := l.Page("duel", LeaderboardWeekly, 0, 10)
+	if page.Start != time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC).Unix() ||
+		page.Ends != time.Date(2026, 10, 26, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("Unexpected weekly window %d to %d", page.Start, page.Ends)
+	}
+
+	clock.Advance(6 * 24 * time.Hour)
+	expect("Next Monday", LeaderboardWeekly)
+	expect("Next Monday", LeaderboardAllTime, "jo", "al")
+}
+
+func TestOpenLeaderboardsDropsRolledOverWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaderboards.log")
+	yesterday := LeaderboardDaily.Start(time.Now()).AddDate(0, 0, -1).Unix()
+	data := fmt.Sprintf("{\"Type\":\"duel\",\"Window\":0,\"Start\":%d,\"AccountId\":\"jo\",\"Score\":3}\n"+
+		"{\"Type\":\"duel\",\"Window\":2,\"Start\":0,\"AccountId\":\"jo\",\"Score\":3}\n", yesterday)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := OpenLeaderboards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ids := leaderboardIds(l, LeaderboardDaily); len(ids) != 0 {
+		t.Error("Expected yesterday's daily leaderboard to be dropped, got", ids)
+	}
+	if ids := leaderboardIds(l, LeaderboardAllTime); len(ids) != 1 {
+		t.Error("Expected the all-time leaderboard to be kept, got", ids)
+	}
+	if lines := countLines(t, path); lines != 1 {
+		t.Error("Expected the dropped entries to be compacted away, got", lines, "lines")
+	}
+}
+
+func TestLeaderboardsCompactOnRollOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaderboards.log")
+	l, err := OpenLeaderboards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last millisecond of Sunday, and so of the week
+	clock := NewStepClock(time.Date(2026, 10, 18, 23, 59, 59, 999e6, time.UTC))
+	l.SetClock(clock)
+	record := func(id string) {
+		l.Record("duel", []*LeaderboardResult{{Account: &Account{Id: id}, Name: id, Score: 1}})
+	}
+
+	record("jo")
+	record("al")
+	clock.Advance(time.Millisecond)
+	record("jo")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The all-time entries, then jo's appended to each board
+	if lines := countLines(t, path); lines != 5 {
+		t.Fatal("Expected the rolled over entries to be compacted away, got", lines, "lines")
+	}
+}
+
+func TestLeaderboardsCompactAsLogGrows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaderboards.log")
+	l, err := OpenLeaderboards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log.compactMin = 12
+	for i := 0; i < 10; i++ {
+		l.Record("duel", []*LeaderboardResult{{Account: &Account{Id: "jo"}, Name: "jo", Score: 1}})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, path); lines >= 12 {
+		t.Fatal("Expected the log to be compacted while open, got", lines, "lines")
+	}
+
+	l, err = OpenLeaderboards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	page := l.Page("duel", LeaderboardAllTime, 0, 10)
+	if len(page.Entries) != 1 || page.Entries[0].Score != 10 {
+		t.Fatalf("Expected the latest entry to survive compaction, %+v", page.Entries)
+	}
+}
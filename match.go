@@ -0,0 +1,117 @@
+package main
+
+type MatchError struct {
+	MatchErrorString string
+}
+
+func (m *MatchError) Error() string { return m.MatchErrorString }
+
+var (
+	MatchErrorNothingSelected = &MatchError{"Nothing is selected to claim"}
+	MatchErrorColorMismatch   = &MatchError{"Selected blocks are not all the same color"}
+	MatchErrorNotConnected    = &MatchError{"Selected blocks are not connected"}
+	MatchErrorGroupTooSmall   = &MatchError{"Not enough blocks selected"}
+)
+
+// Rules a player's selection must follow to be claimed, and the
+// points awarded for a successful claim.
+type MatchRules struct {
+	MinGroupSize int          // Minimum number of blocks in a claim
+	Connected    bool         // Claimed blocks must form a single region
+	Diagonal     bool         // Diagonal blocks are adjacent to each other
+	Scoring      ScoringCurve // Points awarded for the claim
+}
+
+// Scoring curve for a claim of n blocks, where the points
+// awarded are: Base + PerBlock*n + Bonus*(n-MinGroupSize)^2
+type ScoringCurve struct {
+	Base, PerBlock, Bonus int
+}
+
+var (
+	// A connected group of two or more blocks, worth one less
+	// point than the number of blocks in the group.
+	DefaultMatchRules = &MatchRules{
+		MinGroupSize: 2,
+		Connected:    true,
+		Scoring:      ScoringCurve{Base: -1, PerBlock: 1},
+	}
+)
+
+// Returns if the rules are usable
+func (r *MatchRules) Valid() bool {
+	return r.MinGroupSize > 0
+}
+
+// Validates the selection against the match rules. Nil entities
+// in the selection are ignored.
+func (r *MatchRules) Validate(selected []*Entity) error {
+	group := make([]*Entity, 0, len(selected))
+	for _, e := range selected {
+		if e != nil {
+			group = append(group, e)
+		}
+	}
+
+	if len(group) == 0 {
+		return MatchErrorNothingSelected
+	}
+	for _, e := range group {
+		if e.color != group[0].color {
+			return MatchErrorColorMismatch
+		}
+	}
+	if len(group) < r.MinGroupSize {
+		return MatchErrorGroupTooSmall
+	}
+	if r.Connected && !r.isConnected(group) {
+		return MatchErrorNotConnected
+	}
+
+	return nil
+}
+
+// Returns the points a valid claim of n blocks is worth.
+func (r *MatchRules) Score(n int) int {
+	extra := n - r.MinGroupSize
+	return r.Scoring.Base + r.Scoring.PerBlock*n + r.Scoring.Bonus*extra*extra
+}
+
+// Returns if the adjacent entities in the group form a single region.
+func (r *MatchRules) isConnected(group []*Entity) bool {
+	visited := make([]bool, len(group))
+	visited[0] = true
+	queue := []int{0}
+	found := 1
+
+	for len(queue) > 0 {
+		cur := group[queue[0]]
+		queue = queue[1:]
+
+		for i, e := range group {
+			if !visited[i] && r.isAdjacent(cur, e) {
+				visited[i] = true
+				queue = append(queue, i)
+				found++
+			}
+		}
+	}
+
+	return found == len(group)
+}
+
+// Returns if the two entities are next to each other on the board
+func (r *MatchRules) isAdjacent(a, b *Entity) bool {
+	dx, dy := a.x-b.x, a.y-b.y
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+
+	if r.Diagonal {
+		return dx <= 1 && dy <= 1 && dx+dy > 0
+	}
+	return dx+dy == 1
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Rules the matchmaker places waiting players into games by. A player
+// is placed in the game whose players' average rating is closest to
+// theirs, if it is within the band. The band widens the longer they
+// wait, and once they have waited the longest allowed they are placed in
+// the closest game regardless, or a new game if there is none. No new
+// game is created while a game out of the band has room, so with the
+// default rules a player waits 20s for a game 300 away from them.
+type MatchmakingRules struct {
+	Band       float64       // Rating difference accepted when a player starts waiting
+	BandGrowth float64       // Rating difference the band widens by each second
+	MaxWait    time.Duration // Longest a player waits for a game in their band
+}
+
+var (
+	DefaultMatchmakingRules = MatchmakingRules{
+		Band:       100,
+		BandGrowth: 10,
+		MaxWait:    30 * time.Second,
+	}
+)
+
+// Player waiting to be placed in a game
+type MatchTicket struct {
+	Player   *Player
+	GameType *GameType
+	Rating   float64
+	Queued   time.Time
+}
+
+// Game a waiting player could be placed in, and the average rating of
+// its players.
+type MatchCandidate struct {
+	Game   *Game
+	Rating float64
+}
+
+// Queue of the players waiting to be placed in games. Only used by the
+// world's event loop.
+type Matchmaker struct {
+	rules   MatchmakingRules
+	tickets []*MatchTicket
+}
+
+// Creates a new matchmaker with no players waiting
+func NewMatchmaker(rules MatchmakingRules) *Matchmaker {
+	return &Matchmaker{
+		rules:   rules,
+		tickets: make([]*MatchTicket, 0, 10),
+	}
+}
+
+// Replaces the matchmaker's rules. Players already waiting are matched
+// by the new rules.
+func (m *Matchmaker) SetRules(rules MatchmakingRules) {
+	m.rules = rules
+}
+
+// Adds the player to the end of the queue, replacing the ticket they
+// already had.
+func (m *Matchmaker) Enqueue(ticket *MatchTicket) {
+	m.Cancel(ticket.Player)
+	m.tickets = append(m.tickets, ticket)
+}
+
+// Removes the player from the queue, returns false if they weren't in it
+func (m *Matchmaker) Cancel(p *Player) bool {
+	for i, t := range m.tickets {
+		if t.Player == p {
+			copy(m.tickets[i:], m.tickets[i+1:])
+			m.tickets[len(m.tickets)-1] = nil
+			m.tickets = m.tickets[:len(m.tickets)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// Returns if the player is waiting to be placed in a game
+func (m *Matchmaker) IsQueued(p *Player) bool {
+	for _, t := range m.tickets {
+		if t.Player == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the queue, longest waiting first
+func (m *Matchmaker) Queued() []*MatchTicket {
+	tickets := make([]*MatchTicket, len(m.tickets))
+	copy(tickets, m.tickets)
+	return tickets
+}
+
+// Returns the rating difference accepted for the ticket at the time
+func (m *Matchmaker) Band(ticket *MatchTicket, now time.Time) float64 {
+	if now.Sub(ticket.Queued) >= m.rules.MaxWait {
+		return math.Inf(1)
+	}
+	return m.rules.Band + m.rules.BandGrowth*now.Sub(ticket.Queued).Seconds()
+}
+
+// Picks the game to place the waiting player in from the candidates.
+// The closest candidate within the player's band is picked, with ties
+// going to the earliest candidate. A nil game is returned if a new game
+// should be created, which is when there are no candidates at all, or
+// the player has waited the longest allowed. False is returned if the
+// player should keep waiting.
+func (m *Matchmaker) Match(ticket *MatchTicket, candidates []MatchCandidate, now time.Time) (*Game, bool) {
+	band := m.Band(ticket, now)
+
+	var best *Game
+	bestDiff := 0.0
+	for _, c := range candidates {
+		diff := math.Abs(c.Rating - ticket.Rating)
+		if diff <= band && (best == nil || diff < bestDiff) {
+			best, bestDiff = c.Game, diff
+		}
+	}
+	if best != nil {
+		return best, true
+	}
+	if len(candidates) == 0 || math.IsInf(band, 1) {
+		return nil, true
+	}
+	return nil, false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMatchmakerBandWidens(t *testing.T) {
+	m := NewMatchmaker(DefaultMatchmakingRules)
+	queued := time.Unix(1000, 0)
+	ticket := &MatchTicket{Rating: 1500, Queued: queued}
+
+	tests := []struct {
+		waited time.Duration
+		band   float64
+	}{
+		{0, 100},
+		{5 * time.Second, 150},
+		{20 * time.Second, 300},
+		{29 * time.Second, 390},
+		{30 * time.Second, math.Inf(1)},
+	}
+	for _, test := range tests {
+		if band := m.Band(ticket, queued.Add(test.waited)); band != test.band {
+			t.Errorf("Waited %s, expected band %v got %v", test.waited, test.band, band)
+		}
+	}
+}
+
+func TestMatchmakerMatch(t *testing.T) {
+	m := NewMatchmaker(DefaultMatchmakingRules)
+	queued := time.Unix(1000, 0)
+	ticket := &MatchTicket{Rating: 1500, Queued: queued}
+	near, far, farther := &Game{}, &Game{}, &Game{}
+
+	// A game 300 away is only in the band once the player waits 20s
+	candidates := []MatchCandidate{{far, 1800}, {farther, 1900}}
+	for _, waited := range []time.Duration{0, 10 * time.Second, 19 * time.Second} {
+		if g, ok := m.Match(ticket, candidates, queued.Add(waited)); ok || g != nil {
+			t.Errorf("Waited %s, expected to keep waiting", waited)
+		}
+	}
+	if g, ok := m.Match(ticket, candidates, queued.Add(20*time.Second)); !ok || g != far {
+		t.Error("Expected the far game once the band widened")
+	}
+
+	// Every game is in the band once the player has waited the longest
+	if g, ok := m.Match(ticket, []MatchCandidate{{farther, 1900}}, queued.Add(30*time.Second)); !ok || g != farther {
+		t.Error("Expected the closest game after the max wait")
+	}
+
+	// The closest game in the band wins, ties go to the earliest
+	candidates = []MatchCandidate{{far, 1560}, {near, 1540}, {farther, 1460}}
+	if g, ok := m.Match(ticket, candidates, queued); !ok || g != near {
+		t.Error("Expected the closest game")
+	}
+
+	// A new game is created if there are none to join
+	if g, ok := m.Match(ticket, nil, queued); !ok || g != nil {
+		t.Error("Expected a new game without candidates")
+	}
+}
+
+func TestMatchmakerQueue(t *testing.T) {
+	m := NewMatchmaker(DefaultMatchmakingRules)
+	p1, p2 := newTestPlayer(1), newTestPlayer(2)
+	m.Enqueue(&MatchTicket{Player: p1, Rating: 1500})
+	m.Enqueue(&MatchTicket{Player: p2, Rating: 1600})
+	m.Enqueue(&MatchTicket{Player: p1, Rating: 1700})
+
+	queued := m.Queued()
+	if len(queued) != 2 || queued[0].Player != p2 || queued[1].Rating != 1700 {
+		t.Fatal("Expected re-queuing to replace the ticket at the end of the queue")
+	}
+	if !m.Cancel(p2) || m.IsQueued(p2) || m.Cancel(p2) {
+		t.Fatal("Expected the player to be removed from the queue once")
+	}
+	if !m.IsQueued(p1) {
+		t.Fatal("Expected the other player to still be queued")
+	}
+}
+
+func TestMatchCandidates(t *testing.T) {
+	w := NewWorld(&HttpHandler{}, NewGameTypeRegistry())
+	gameType := w.gameTypes.Default()
+	full, open, empty := NewGame(0, gameType, 1, nil), NewGame(1, gameType, 1, nil), NewGame(2, gameType, 1, nil)
+	w.games = []*Game{full, open, empty}
+	for i := 0; i < gameType.Players; i++ {
+		w.players[newTestPlayer(PlayerId(i))] = &PlayerInstance{Game: full}
+	}
+	w.players[newTestPlayer(100)] = &PlayerInstance{Game: open}
+	w.players[newTestPlayer(101)] = &PlayerInstance{Game: open, Spectator: true}
+
+	ratings := w.gameRatings()
+	candidates := matchCandidates(w.games, ratings, gameType)
+	if len(candidates) != 1 || candidates[0].Game != open || candidates[0].Rating != DefaultRating {
+		t.Fatalf("Expected only the open game to be a candidate, %+v", candidates)
+	}
+
+	// Players placed during a pass are counted without rebuilding
+	ratings[open].add(DefaultRating + 300)
+	candidates = matchCandidates(w.games, ratings, gameType)
+	if len(candidates) != 1 || candidates[0].Rating != DefaultRating+150 {
+		t.Fatalf("Expected the placed player's rating to be averaged in, %+v", candidates)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"time"
 )
 
@@ -9,19 +10,32 @@ import (
 type MessageIn struct {
 	ReqId string
 	Act   *MsgPlayerAction
+	Err   error `json:"-"` // Set if the message could not be decoded
 }
 
 type MsgPlayerAction struct {
 	W *MsgPartActionWorld
 	G *MsgPartActionGame
+	C *MsgPartActionChat
 }
 
 type MsgPartActionWorld struct {
+	C int    // Command
+	G uint64 // Game id
+	T string // Game type name
+	A string // Account id
+	L int    // Leaderboard window
+	O int    // Leaderboard offset
 }
 
 type MsgPartActionGame struct {
-	C int
-	E uint64
+	C  int
+	E  uint64
+	Sq uint64 // Sequence of the game update being acknowledged
+}
+
+type MsgPartActionChat struct {
+	M string // Text, sent to the player's game, or the lobby
 }
 
 // Builds the player control object from the message
@@ -30,22 +44,49 @@ func GetPlayerActionFromMessage(msg MessageIn, p *Player) *PlayerAction {
 		return nil
 	}
 
-	action := &PlayerAction{Player: p}
+	action := &PlayerAction{Player: p, ReqId: msg.ReqId}
 	if msg.Act.W != nil {
-		action.World = &PlayerWorldAction{}
-
+		action.World = &PlayerWorldAction{
+			Command:   PlayerCmd(msg.Act.W.C),
+			GameId:    msg.Act.W.G,
+			GameType:  msg.Act.W.T,
+			AccountId: msg.Act.W.A,
+			Window:    LeaderboardWindow(msg.Act.W.L),
+			Offset:    msg.Act.W.O,
+		}
 	}
 
 	if msg.Act.G != nil {
 		action.Game = &PlayerGameAction{
 			Command:  PlayerCmd(msg.Act.G.C),
 			EntityId: EntityId(msg.Act.G.E),
+			Seq:      msg.Act.G.Sq,
 		}
 	}
 
+	if msg.Act.C != nil {
+		action.Chat = &PlayerChatAction{Text: msg.Act.C.M}
+	}
+
 	return action
 }
 
+// Reply to a player's action, echoing the request id of the action
+type MsgActionReply struct {
+	AR bool
+	R  string // Request id of the action
+	E  int    // Error code, 0 if the action was accepted
+	M  string `json:",omitempty"` // Description of the error
+}
+
+func MsgCreateActionReply(reqId string, err error) *MsgActionReply {
+	msg := &MsgActionReply{AR: true, R: reqId, E: int(GetActionCode(err))}
+	if err != nil {
+		msg.M = err.Error()
+	}
+	return msg
+}
+
 type MsgBoardUpdates struct {
 	BU []MsgBoardUpdateItem // Board Updates
 }
@@ -54,15 +95,36 @@ type MsgBoardUpdateItem struct {
 	E interface{} // Entity
 }
 
-// Game update message
+// Game update message. Every update the game broadcasts has the next
+// sequence number of the game's state, so players can detect when they
+// missed an update, and request a snapshot.
 type MsgGameUpdate struct {
 	GU bool
+	Sq uint64 // Sequence of the game state the update brings the player to
+	Sn bool   // If the update is a complete snapshot of the game
+	G  *MsgPartGameInfo
 	Gt *MsgPartGameType
+	Rd *MsgPartRound
+	Rs *MsgPartRoundResults
 	Ps []MsgPartPlayerInfo
+	Ss []MsgPartPlayerInfo // Spectators
 	Es []MsgPartEntity
 }
 type MsgPartGameType struct {
-	R, C int // rows and columns
+	N    string // Name
+	R, C int    // rows and columns
+	P    int    // Max players
+	Cs   int    // Number of block colors
+}
+type MsgPartRound struct {
+	N  int   // Round number
+	St int   // State of the game
+	T  int64 // Time left in the state, in milliseconds, -1 if no limit
+	Ts int   // Target score, 0 if none
+}
+type MsgPartRoundResults struct {
+	W  []uint64            // Ids of the winning players
+	Ps []MsgPartPlayerInfo // Final standings, highest score first
 }
 type MsgPartPlayerInfo struct {
 	Id uint64 // Id
@@ -70,14 +132,302 @@ type MsgPartPlayerInfo struct {
 	N  string // Name
 	Sc int    // Score
 }
+
+// Entity in a game update. If the field flags are set only the flagged
+// fields are included, and the rest are unchanged since the state the
+// player acknowledged. Otherwise the entity is complete. Zero valued
+// fields are left out of the JSON encoding.
 type MsgPartEntity struct {
-	Id       uint64 // entity ID
-	T        int    // Type of the entity
-	St       int    // State of the entity
-	X, Y     int    // position
-	C        int    // color
-	Ttl      int64  // Time to live, in miliseconds
-	CAt, UAt int64  // Create and Update Time
+	Id  uint64 // entity ID
+	F   int    `json:",omitempty"` // Fields included in the update, all if 0
+	T   int    `json:",omitempty"` // Type of the entity
+	St  int    `json:",omitempty"` // State of the entity
+	X   int    `json:",omitempty"` // position
+	Y   int    `json:",omitempty"`
+	C   int    `json:",omitempty"` // color
+	Ttl int64  `json:",omitempty"` // Time to live, in miliseconds
+	CAt int64  `json:",omitempty"` // Create and Update Time
+	UAt int64  `json:",omitempty"`
+}
+
+// Field flags of an entity in a game update
+const (
+	MsgEntityFieldType = 1 << iota
+	MsgEntityFieldState
+	MsgEntityFieldX
+	MsgEntityFieldY
+	MsgEntityFieldColor
+	MsgEntityFieldTtl
+	MsgEntityFieldCreatedAt
+	MsgEntityFieldUpdatedAt
+)
+
+// Returns the entity with only the flagged fields, and their flags set
+func (e MsgPartEntity) WithFields(fields int) MsgPartEntity {
+	d := MsgPartEntity{Id: e.Id, F: fields}
+	if fields&MsgEntityFieldType != 0 {
+		d.T = e.T
+	}
+	if fields&MsgEntityFieldState != 0 {
+		d.St = e.St
+	}
+	if fields&MsgEntityFieldX != 0 {
+		d.X = e.X
+	}
+	if fields&MsgEntityFieldY != 0 {
+		d.Y = e.Y
+	}
+	if fields&MsgEntityFieldColor != 0 {
+		d.C = e.C
+	}
+	if fields&MsgEntityFieldTtl != 0 {
+		d.Ttl = e.Ttl
+	}
+	if fields&MsgEntityFieldCreatedAt != 0 {
+		d.CAt = e.CAt
+	}
+	if fields&MsgEntityFieldUpdatedAt != 0 {
+		d.UAt = e.UAt
+	}
+	return d
+}
+
+// Returns the entity with only the fields which differ from the
+// known state of the entity, and the flags of those fields set.
+func (e MsgPartEntity) DiffFrom(known *MsgPartEntity) MsgPartEntity {
+	d := MsgPartEntity{Id: e.Id}
+	if e.T != known.T {
+		d.F |= MsgEntityFieldType
+		d.T = e.T
+	}
+	if e.St != known.St {
+		d.F |= MsgEntityFieldState
+		d.St = e.St
+	}
+	if e.X != known.X {
+		d.F |= MsgEntityFieldX
+		d.X = e.X
+	}
+	if e.Y != known.Y {
+		d.F |= MsgEntityFieldY
+		d.Y = e.Y
+	}
+	if e.C != known.C {
+		d.F |= MsgEntityFieldColor
+		d.C = e.C
+	}
+	if e.Ttl != known.Ttl {
+		d.F |= MsgEntityFieldTtl
+		d.Ttl = e.Ttl
+	}
+	if e.CAt != known.CAt {
+		d.F |= MsgEntityFieldCreatedAt
+		d.CAt = e.CAt
+	}
+	if e.UAt != known.UAt {
+		d.F |= MsgEntityFieldUpdatedAt
+		d.UAt = e.UAt
+	}
+	return d
+}
+
+// World update message, sent to a player in response to world
+// actions, and when ever the player moves between games.
+type MsgWorldUpdate struct {
+	WU bool
+	G  int64 // Id of the game the player is in, -1 if in the lobby
+	Sp bool  // If the player is spectating the game
+	Q  bool  // If the player is waiting to be matched into a game
+	Gs []MsgPartGameInfo
+	Ts []MsgPartGameType
+}
+type MsgPartGameInfo struct {
+	Id    uint64 // Game id
+	T     string // Game type name
+	P, Mp int    // Number of players, and max players
+	S     int    // Number of spectators
+	Sd    int64  // Seed of the game's random number generator
+}
+
+// Session message, sent to a player when they register, and when they
+// resume their session on a new connection.
+type MsgSession struct {
+	SU bool
+	S  string // Session token
+	Id uint64 // Player id
+	N  string // Player's display name
+	A  string // Id of the player's account, empty for guests
+	Gr int64  // Grace period the session is held for, in milliseconds
+	R  bool   // If the session was resumed
+}
+
+func MsgCreateSession(p *Player, session string, grace time.Duration, resumed bool) *MsgSession {
+	return &MsgSession{
+		SU: true,
+		S:  session,
+		Id: uint64(p.GetId()),
+		N:  p.GetName(),
+		A:  p.GetAccount().Id,
+		Gr: int64(grace / time.Millisecond),
+		R:  resumed,
+	}
+}
+
+// Notice from the server's admin, sent to all players
+type MsgNotice struct {
+	NU bool
+	M  string // Text of the notice
+}
+
+func MsgCreateNotice(notice string) *MsgNotice {
+	return &MsgNotice{NU: true, M: notice}
+}
+
+// Shutdown message, sent to all players when the server starts
+// shutting down.
+type MsgShutdown struct {
+	SD bool
+	T  int64 // Time until the server shuts down, in milliseconds
+}
+
+func MsgCreateShutdown(remaining time.Duration) *MsgShutdown {
+	return &MsgShutdown{SD: true, T: int64(remaining / time.Millisecond)}
+}
+
+// Profile message, sent to a player in response to their request for
+// an account's profile.
+type MsgProfile struct {
+	PF bool
+	A  string // Account id
+	N  string // Display name
+	Gp int    // Games played
+	W  int    // Wins
+	Ts int    // Total score
+	Bs int    // Best score
+	Bc int    // Blocks claimed
+	Tp int64  // Time played, in milliseconds
+	Rt int    // Rating
+}
+
+func MsgCreateProfile(p *Profile) *MsgProfile {
+	return &MsgProfile{
+		PF: true,
+		A:  p.AccountId,
+		N:  p.Name,
+		Gp: p.GamesPlayed,
+		W:  p.Wins,
+		Ts: p.TotalScore,
+		Bs: p.BestScore,
+		Bc: p.BlocksClaimed,
+		Tp: p.TimePlayed,
+		Rt: int(math.Floor(p.GetRating() + 0.5)),
+	}
+}
+
+// Leaderboard message, sent to a player in response to their request
+// for a page of a leaderboard.
+type MsgLeaderboard struct {
+	LB bool
+	T  string // Game type name
+	W  int    // Window
+	St int64  // Time the window started, in milliseconds since the unix epoch
+	En int64  // Time the window ends, 0 if it doesn't
+	N  int    // Number of entries in the leaderboard
+	Es []MsgPartLeaderboardEntry
+}
+type MsgPartLeaderboardEntry struct {
+	R  int    // Rank
+	A  string // Account id
+	N  string // Display name
+	Sc int    // Score
+	W  int    // Wins
+	Gp int    // Games played
+}
+
+func MsgCreateLeaderboard(window LeaderboardWindow, page *LeaderboardPage) *MsgLeaderboard {
+	msg := &MsgLeaderboard{
+		LB: true,
+		T:  page.Type,
+		W:  int(window),
+		St: page.Start * 1000,
+		En: page.Ends * 1000,
+		N:  page.Total,
+		Es: make([]MsgPartLeaderboardEntry, len(page.Entries)),
+	}
+	for i, entry := range page.Entries {
+		msg.Es[i] = MsgPartLeaderboardEntry{
+			R:  entry.Rank,
+			A:  entry.AccountId,
+			N:  entry.Name,
+			Sc: entry.Score,
+			W:  entry.Wins,
+			Gp: entry.Games,
+		}
+	}
+	return msg
+}
+
+// Chat message, sent to the players in the channel the lines were sent
+// in. Players joining a channel are sent its recent lines as history.
+type MsgChat struct {
+	CH bool
+	G  int64 // Id of the game the lines were sent in, -1 if the lobby
+	H  bool  // If the lines are the channel's history
+	Ls []MsgPartChatLine
+}
+type MsgPartChatLine struct {
+	Id uint64 // Id of the player who sent the line
+	N  string // Player's display name
+	M  string // Text
+	T  int64  // Time sent, in milliseconds since the unix epoch
+}
+
+func MsgCreateChat(g *Game, history bool, lines []MsgPartChatLine) *MsgChat {
+	msg := &MsgChat{CH: true, G: -1, H: history, Ls: lines}
+	if g != nil {
+		msg.G = int64(g.GetId())
+	}
+	return msg
+}
+
+func MsgCreateWorldUpdate() *MsgWorldUpdate {
+	return &MsgWorldUpdate{WU: true, G: -1}
+}
+
+// Sets the game the player is currently in, and if they are only
+// spectating it. A nil game means the player is in the lobby.
+func (m *MsgWorldUpdate) SetCurrentGame(g *Game, spectator bool) {
+	if g == nil {
+		m.G = -1
+		return
+	}
+	m.G = int64(g.GetId())
+	m.Sp = spectator
+}
+
+// Adds the game types players can select from to the world update
+func (m *MsgWorldUpdate) AddGameTypes(gameTypes []*GameType) {
+	for _, gt := range gameTypes {
+		m.Ts = append(m.Ts, MsgPartGameType{
+			N:  gt.Name,
+			R:  gt.Rows,
+			C:  gt.Cols,
+			P:  gt.Players,
+			Cs: gt.GetSimConfig().Colors,
+		})
+	}
+}
+
+// Adds a game's info to the list of games in the world update
+func (m *MsgWorldUpdate) AddGameInfo(g *Game, numPlayers, numSpectators int) {
+	m.Gs = append(m.Gs, MsgPartGameInfo{
+		Id: g.GetId(),
+		T:  g.gameType.Name,
+		P:  numPlayers,
+		Mp: g.gameType.Players,
+		S:  numSpectators,
+		Sd: g.GetSeed(),
+	})
 }
 
 func MsgCreateGameUpdate() *MsgGameUpdate {
@@ -87,10 +437,8 @@ func MsgCreateGameUpdate() *MsgGameUpdate {
 // Grows the player game info list of game update if needed
 // to fit the extra legthn needed.
 func (m *MsgGameUpdate) growPlayerGameInfosToFit(addLen int) {
-	if m.Ps != nil {
-		m.Ps = make([]MsgPartPlayerInfo, addLen)
-	} else if len(m.Ps)+addLen > cap(m.Ps) {
-		newPs := make([]MsgPartPlayerInfo, len(m.Ps)+addLen)
+	if len(m.Ps)+addLen > cap(m.Ps) {
+		newPs := make([]MsgPartPlayerInfo, len(m.Ps), len(m.Ps)+addLen)
 		copy(newPs, m.Ps)
 		m.Ps = newPs
 	}
@@ -99,10 +447,8 @@ func (m *MsgGameUpdate) growPlayerGameInfosToFit(addLen int) {
 // Grows the entity update list of game update if needed
 // to fit the extra legthn needed.
 func (m *MsgGameUpdate) growEntityUpdatesToFit(addLen int) {
-	if m.Es != nil {
-		m.Es = make([]MsgPartEntity, addLen)
-	} else if len(m.Es)+addLen > cap(m.Es) {
-		newEs := make([]MsgPartEntity, len(m.Es)+addLen)
+	if len(m.Es)+addLen > cap(m.Es) {
+		newEs := make([]MsgPartEntity, len(m.Es), len(m.Es)+addLen)
 		copy(newEs, m.Es)
 		m.Es = newEs
 	}
@@ -111,8 +457,58 @@ func (m *MsgGameUpdate) growEntityUpdatesToFit(addLen int) {
 // Adds the game type to the message to be sent to the player
 func (m *MsgGameUpdate) AddGameType(gameType *GameType) {
 	m.Gt = &MsgPartGameType{
-		R: gameType.Rows,
-		C: gameType.Cols,
+		N:  gameType.Name,
+		R:  gameType.Rows,
+		C:  gameType.Cols,
+		P:  gameType.Players,
+		Cs: gameType.GetSimConfig().Colors,
+	}
+}
+
+// Adds the game's id and seed to the message to be sent to the player
+func (m *MsgGameUpdate) AddGameInfo(g *Game) {
+	m.G = &MsgPartGameInfo{
+		Id: g.GetId(),
+		T:  g.gameType.Name,
+		Mp: g.gameType.Players,
+		Sd: g.GetSeed(),
+	}
+}
+
+// Adds the game's current round, and its state to the message
+func (m *MsgGameUpdate) AddRound(g *Game) {
+	remaining := g.phaseRemaining()
+	if remaining > 0 {
+		remaining /= time.Millisecond
+	}
+
+	m.Rd = &MsgPartRound{
+		N:  g.round,
+		St: int(g.state),
+		T:  int64(remaining),
+		Ts: g.gameType.GetRoundConfig().TargetScore,
+	}
+}
+
+// Adds the final standings of a round to the message. The results
+// are expected to be ordered by highest score first. All players
+// sharing the highest score are winners, if any points were scored.
+func (m *MsgGameUpdate) AddRoundResults(results []*GamePlayerInfo) {
+	m.Rs = &MsgPartRoundResults{
+		W:  make([]uint64, 0, 1),
+		Ps: make([]MsgPartPlayerInfo, len(results)),
+	}
+
+	for i, info := range results {
+		m.Rs.Ps[i] = MsgPartPlayerInfo{
+			Id: uint64(info.PlayerId),
+			St: int(info.State),
+			N:  info.Name,
+			Sc: info.Score,
+		}
+		if info.Score > 0 && info.Score == results[0].Score {
+			m.Rs.W = append(m.Rs.W, uint64(info.PlayerId))
+		}
 	}
 }
 
@@ -121,8 +517,11 @@ func (m *MsgGameUpdate) AddGameType(gameType *GameType) {
 func (m *MsgGameUpdate) AddPlayerGameInfos(infos []*GamePlayerInfo) {
 	m.growPlayerGameInfosToFit(len(infos))
 
-	for i, info := range infos {
-		m.AddPlayerGameInfo(info, i)
+	for _, info := range infos {
+		if info == nil {
+			continue
+		}
+		m.AddPlayerGameInfo(info, -1)
 	}
 }
 
@@ -136,6 +535,7 @@ func (m *MsgGameUpdate) AddPlayerGameInfo(info *GamePlayerInfo, idx int) {
 	if i == -1 {
 		i = len(m.Ps)
 		m.growPlayerGameInfosToFit(1)
+		m.Ps = m.Ps[:i+1]
 	}
 
 	m.Ps[i].Id = uint64(info.PlayerId)
@@ -144,16 +544,35 @@ func (m *MsgGameUpdate) AddPlayerGameInfo(info *GamePlayerInfo, idx int) {
 	m.Ps[i].Sc = info.Score
 }
 
+// Adds a list of spectator infos to the update message.
+func (m *MsgGameUpdate) AddSpectatorInfos(infos []*GamePlayerInfo) {
+	for _, info := range infos {
+		m.AddSpectatorInfo(info)
+	}
+}
+
+// Adds a single spectator info to the update message.
+func (m *MsgGameUpdate) AddSpectatorInfo(info *GamePlayerInfo) {
+	if info == nil {
+		return
+	}
+	m.Ss = append(m.Ss, MsgPartPlayerInfo{
+		Id: uint64(info.PlayerId),
+		St: int(info.State),
+		N:  info.Name,
+	})
+}
+
 // Adds a list of entities to the update message. This will auto
 // grow the message as needed
 func (m *MsgGameUpdate) AddEntityUpdates(entities []*Entity) {
 	m.growEntityUpdatesToFit(len(entities))
 
-	for i, e := range entities {
+	for _, e := range entities {
 		if e == nil {
 			continue
 		}
-		m.AddEntityUpdate(e, i)
+		m.AddEntityUpdate(e, -1)
 	}
 }
 
@@ -167,6 +586,7 @@ func (m *MsgGameUpdate) AddEntityUpdate(e *Entity, idx int) {
 	if i == -1 {
 		i = len(m.Es)
 		m.growEntityUpdatesToFit(1)
+		m.Es = m.Es[:i+1]
 	}
 
 	m.Es[i].Id = uint64(e.id)
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Reasons messages to players are dropped
+const (
+	DropReasonCoalesced  = "coalesced"   // Game update dropped from a full queue
+	DropReasonQueueFull  = "queue_full"  // Message dropped from a queue at its max items
+	DropReasonDetached   = "detached"    // Player had no connection
+	DropReasonSendFailed = "send_failed" // Connection failed to send the message
+)
+
+// Counter which can be incremented by multiple goroutines
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Add(n uint64)  { atomic.AddUint64(&c.v, n) }
+func (c *Counter) Inc()          { atomic.AddUint64(&c.v, 1) }
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.v) }
+
+// Histogram of observed values, counted into buckets by their upper
+// bound. Safe for use by multiple goroutines.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Creates a new histogram with the buckets' upper bounds, in
+// increasing order.
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+// Adds the value to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Writes the histogram in the Prometheus text format. Buckets are
+// cumulative.
+func (h *Histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// Metrics of the server, exposed in the Prometheus text format. The
+// world publishes its player and game counts, and everything else is
+// counted where it happens.
+type ServerMetrics struct {
+	MessagesIn     Counter // Messages read from all connections
+	MessagesOut    Counter // Messages written to all connections
+	BytesIn        Counter
+	BytesSent      Counter
+	RecordsDropped Counter    // Records not written because a record log fell behind
+	TickDuration   *Histogram // Seconds to step a game's simulation
+	SessionLength  *Histogram // Seconds a player was connected to the world
+
+	dropped map[string]*Counter
+
+	mu       sync.Mutex
+	players  int // Players with a connection
+	detached int // Players held for their session to be resumed
+	games    map[string]int
+}
+
+var serverMetrics = NewServerMetrics()
+
+// Creates new empty server metrics
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		TickDuration:  NewHistogram(.0001, .0005, .001, .005, .01, .025, .05, .1, .25),
+		SessionLength: NewHistogram(10, 30, 60, 300, 600, 1800, 3600, 7200),
+		dropped: map[string]*Counter{
+			DropReasonCoalesced:  &Counter{},
+			DropReasonQueueFull:  &Counter{},
+			DropReasonDetached:   &Counter{},
+			DropReasonSendFailed: &Counter{},
+		},
+		games: make(map[string]int),
+	}
+}
+
+// Counts the messages to players dropped for the reason
+func (m *ServerMetrics) Dropped(reason string, n uint64) {
+	m.dropped[reason].Add(n)
+}
+
+// Sets the number of players in the world, and the number of games of
+// each game type.
+func (m *ServerMetrics) SetWorld(players, detached int, games map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.players = players
+	m.detached = detached
+	m.games = games
+}
+
+// Writes all metrics in the Prometheus text format
+func (m *ServerMetrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	writeMetric(w, "apollo_players", "gauge", "Players connected to the world.", m.players)
+	writeMetric(w, "apollo_players_detached", "gauge", "Players disconnected, and held for their session to be resumed.", m.detached)
+	writeMetricHeader(w, "apollo_games", "gauge", "Active games by game type.")
+	types := make([]string, 0, len(m.games))
+	for t, _ := range m.games {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "apollo_games{type=\"%s\"} %d\n", escapeLabel(t), m.games[t])
+	}
+	m.mu.Unlock()
+
+	writeMetric(w, "apollo_messages_in_total", "counter", "Messages read from players.", m.MessagesIn.Value())
+	writeMetric(w, "apollo_messages_out_total", "counter", "Messages written to players.", m.MessagesOut.Value())
+	writeMetric(w, "apollo_bytes_in_total", "counter", "Bytes of messages read from players.", m.BytesIn.Value())
+	writeMetric(w, "apollo_bytes_sent_total", "counter", "Bytes of messages written to players.", m.BytesSent.Value())
+	writeMetric(w, "apollo_records_dropped_total", "counter", "Profile and leaderboard records dropped because their log fell behind.", m.RecordsDropped.Value())
+
+	writeMetricHeader(w, "apollo_messages_dropped_total", "counter", "Messages to players which were dropped, by reason.")
+	for _, reason := range []string{DropReasonCoalesced, DropReasonQueueFull, DropReasonDetached, DropReasonSendFailed} {
+		fmt.Fprintf(w, "apollo_messages_dropped_total{reason=\"%s\"} %d\n", reason, m.dropped[reason].Value())
+	}
+
+	stats := GetInboundStats()
+	writeMetricHeader(w, "apollo_actions_total", "counter", "Messages received from players, by if they were accepted or why they were rejected.")
+	fmt.Fprintf(w, "apollo_actions_total{result=\"accepted\"} %d\n", stats.Accepted)
+	fmt.Fprintf(w, "apollo_actions_total{result=\"rate_limited\"} %d\n", stats.RateLimited)
+	fmt.Fprintf(w, "apollo_actions_total{result=\"invalid\"} %d\n", stats.Invalid)
+	fmt.Fprintf(w, "apollo_actions_total{result=\"malformed\"} %d\n", stats.Malformed)
+	writeMetric(w, "apollo_players_kicked_total", "counter", "Players kicked for sending too many rejected messages.", stats.Kicked)
+
+	m.TickDuration.write(w, "apollo_tick_duration_seconds", "Time taken to step a game's simulation.")
+	m.SessionLength.write(w, "apollo_session_length_seconds", "Time players were in the world.")
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escapes the value for use as a label value
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -1,14 +1,30 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
 type PlayerCmd int
 type PlayerId uint64
 
 var (
-	PlayerCmdGameSelectEntity = PlayerCmd(0)
+	// Game commands
+	PlayerCmdGameSelectEntity   = PlayerCmd(0)
+	PlayerCmdGameClaimSelection = PlayerCmd(1)
+	PlayerCmdGameAck            = PlayerCmd(2)
+	PlayerCmdGameSnapshot       = PlayerCmd(3)
+	// World commands
+	PlayerCmdWorldListGames    = PlayerCmd(0)
+	PlayerCmdWorldJoinGame     = PlayerCmd(1)
+	PlayerCmdWorldLeaveGame    = PlayerCmd(2)
+	PlayerCmdWorldCreateGame   = PlayerCmd(3)
+	PlayerCmdWorldSpectateGame = PlayerCmd(4)
+	PlayerCmdWorldProfile      = PlayerCmd(5)
+	PlayerCmdWorldLeaderboard  = PlayerCmd(6)
+	PlayerCmdWorldFindGame     = PlayerCmd(7)
 )
 
 type PlayerError struct {
@@ -19,43 +35,87 @@ func (p *PlayerError) Error() string { return p.PlayerErrorString }
 
 var (
 	PlayerErrorDisconnected = &PlayerError{"Player's connection has been disconnected"}
+	PlayerErrorBehind       = &PlayerError{"Player fell behind, and queued game updates were dropped"}
+	PlayerErrorQueueFull    = &PlayerError{"Player's queue is full, and the message was dropped"}
 )
 
 type PlayerAction struct {
+	ReqId  string // Id the client gave the action, echoed in the reply
 	World  *PlayerWorldAction
 	Game   *PlayerGameAction
+	Chat   *PlayerChatAction
 	Player *Player
 }
 
 type PlayerWorldAction struct {
+	Command   PlayerCmd
+	GameId    uint64
+	GameType  string
+	AccountId string // Account of the requested profile, or leaderboard entry
+	Window    LeaderboardWindow
+	Offset    int // Offset of the requested leaderboard page
 }
 
 type PlayerGameAction struct {
 	Command  PlayerCmd
 	EntityId EntityId
+	Seq      uint64 // Sequence of the game update acknowledged
+}
+
+type PlayerChatAction struct {
+	Text string
 }
 
 // Player object
 type Player struct {
-	id          PlayerId
-	conn        Connection
-	reader      chan MessageIn
-	toPlayer    chan interface{}
-	setGameCtrl chan *GamePlayerCtrl
-	gameCtrl    GamePlayerCtrl
+	id       PlayerId
+	conn     Connection
+	account  *Account
+	reader   chan MessageIn
+	toPlayer *OutQueue
+	gameCtrl GamePlayerCtrl
+	gameQuit chan bool // Closed once the game has quit
+	limiter  *ActionLimiter
+}
+
+// Limits of the messages sent to, and received from a player
+type PlayerLimits struct {
+	Queue   QueueLimits
+	Actions ActionLimits
 }
 
-// Creates a new intance of the player object, and attaches the
-// existing connection to the player.
-func NewPlayer(id PlayerId, c Connection) *Player {
+var (
+	DefaultPlayerLimits = PlayerLimits{
+		Queue:   DefaultQueueLimits,
+		Actions: DefaultActionLimits,
+	}
+)
+
+// Connection and the channel its messages are read from
+type playerConn struct {
+	conn   Connection
+	reader chan MessageIn
+}
+
+// Game control channel the player should send its game actions to
+type playerGameCtrl struct {
+	ctrl *GamePlayerCtrl
+	quit chan bool
+}
+
+// Creates a new intance of the player object for the account, and
+// attaches the existing connection to the player. Messages to and from
+// the player are limited by the limits.
+func NewPlayer(id PlayerId, account *Account, c Connection, limits PlayerLimits) *Player {
 	p := &Player{
-		id:   id,
-		conn: c,
+		id:      id,
+		account: account,
+		conn:    c,
+		limiter: NewActionLimiter(limits.Actions),
 	}
 
 	p.reader = make(chan MessageIn)
-	p.toPlayer = make(chan interface{}, 10)
-	p.setGameCtrl = make(chan *GamePlayerCtrl)
+	p.toPlayer = NewOutQueue(limits.Queue)
 	p.conn.AttachReader(p.reader)
 
 	return p
@@ -66,84 +126,167 @@ func (p Player) GetId() PlayerId {
 	return p.id
 }
 
-// Terminates the player's connection
-func (p *Player) Disconnect() {
-	if p.conn != nil {
-		p.conn.Close()
-	}
-	if p.toPlayer != nil {
-		close(p.toPlayer)
-	}
-	if p.setGameCtrl != nil {
-		close(p.setGameCtrl)
+// Returns the account the player connected as
+func (p Player) GetAccount() *Account {
+	return p.account
+}
+
+// Returns the player's display name. Players without one are named
+// by their id.
+func (p Player) GetName() string {
+	if len(p.account.Name) != 0 {
+		return p.account.Name
 	}
+	return fmt.Sprintf("Player %d", p.id)
+}
 
-	p.conn = nil
-	p.toPlayer = nil
-	p.setGameCtrl = nil
+// Terminates the player's event loop, which will close the
+// player's connection.
+func (p *Player) Disconnect() {
+	p.toPlayer.Close()
+}
+
+// Replaces the player's connection with a new one, closing the old
+// connection. A nil connection detaches the player from its connection,
+// and messages sent to the player are dropped until it is rebound. The
+// new connection is passed through the same queue as the messages sent
+// to the player, so messages sent after rebinding will be sent to the new
+// connection.
+func (p *Player) Rebind(conn Connection) error {
+	pc := &playerConn{conn: conn}
+	if conn != nil {
+		pc.reader = make(chan MessageIn)
+		conn.AttachReader(pc.reader)
+	}
+	return p.SendToPlayer(pc)
 }
 
 // Event handler for a player. Will process events as they are
-// received from the player, world, or game
+// received from the player, world, or game. The player's connection
+// is closed when the event loop terminates. If the player's queue
+// stays over its high water mark for too long the player's connection
+// is kicked, since the player can't keep up with the game.
 func (p *Player) Run(w *World) {
-	defer func() { log.Println("Player ", p.id, " event loop terminating") }()
+	started := time.Now()
+	defer func() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		serverMetrics.SessionLength.Observe(time.Since(started).Seconds())
+		log.Println("Player ", p.id, " event loop terminating")
+	}()
 	for {
 		select {
 		case msg, ok := <-p.reader:
 			if !ok {
-				return
-			}
-			if msg.Act != nil {
-				ctrl := GetPlayerActionFromMessage(msg, p)
-				// forward the control onto the world or game
-				if ctrl.Game != nil && p.gameCtrl != nil {
-					p.gameCtrl <- ctrl
-				}
-
-				if ctrl.World != nil {
-					w.playerAction <- ctrl
-				}
+				// Wait to be rebound to a new connection, or disconnected
+				p.reader = nil
+				continue
 			}
+			p.procMessage(w, msg)
 
-		case msg, ok := <-p.toPlayer:
+		case _, ok := <-p.toPlayer.Ready():
 			if !ok {
 				return
 			}
-			if p.conn == nil {
-				return
-			}
-			p.conn.Send(msg)
-
-		case ctrl, ok := <-p.setGameCtrl:
+			items, ok := p.toPlayer.Pop()
 			if !ok {
 				return
 			}
-			if ctrl == nil {
-				p.gameCtrl = nil
-				continue
+			for _, item := range items {
+				p.procQueued(item)
+			}
+			if p.conn != nil && p.toPlayer.OverLimit() {
+				log.Println("Player", p.id, "fell too far behind, kicking")
+				p.conn.Kick(CloseCodeSlowClient, "Client fell too far behind")
 			}
-			p.gameCtrl = *ctrl
 		}
 	}
 }
 
-// Pushes the message to the player asynchronously
-func (p *Player) SendToPlayer(msg interface{}) error {
-	if p.toPlayer == nil {
-		return PlayerErrorDisconnected
+// Validates the message received from the player, and forwards its
+// actions to the world or game. Rejected messages are replied to, and
+// count as strikes against the player. The player is kicked once they
+// run out of strikes.
+func (p *Player) procMessage(w *World, msg MessageIn) {
+	if err := p.limiter.Check(&msg); err != nil {
+		p.conn.Send(MsgCreateActionReply(msg.ReqId, err))
+		if !p.limiter.Strike() {
+			log.Println("Player", p.id, "kicked for sending too many rejected messages,", err)
+			atomic.AddUint64(&inboundStats.Kicked, 1)
+			if err == InboundErrorRateLimited {
+				p.conn.Kick(CloseCodeFlooding, "Too many actions")
+			} else {
+				p.conn.Kick(CloseCodeBadMessages, "Too many invalid messages")
+			}
+		}
+		return
+	}
+
+	ctrl := GetPlayerActionFromMessage(msg, p)
+	// forward the control onto the world or game
+	if ctrl.Game != nil {
+		sent := false
+		if p.gameCtrl != nil {
+			// The game may quit before the player is told they left it
+			select {
+			case p.gameCtrl <- ctrl:
+				sent = true
+			case <-p.gameQuit:
+			}
+		}
+		if !sent {
+			p.conn.Send(MsgCreateActionReply(ctrl.ReqId, GameErrorNotInGame))
+		}
 	}
 
-	p.toPlayer <- msg
-	return nil
+	if ctrl.World != nil || ctrl.Chat != nil {
+		w.playerAction <- ctrl
+	}
 }
 
-// Sets the channel a player should use to use to send controls
-// to the the game at on.
-func (p *Player) SetGameCtrl(ctrlChan *GamePlayerCtrl) error {
-	if p.setGameCtrl == nil {
-		return PlayerErrorDisconnected
+// Processes an item taken off the player's queue. Messages are sent to
+// the player's connection, and controls change the connection or game
+// the player is bound to.
+func (p *Player) procQueued(item interface{}) {
+	switch it := item.(type) {
+	case *playerConn:
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		p.conn = it.conn
+		p.reader = it.reader
+
+	case *playerGameCtrl:
+		if it.ctrl == nil {
+			p.gameCtrl = nil
+			p.gameQuit = nil
+			return
+		}
+		p.gameCtrl = *it.ctrl
+		p.gameQuit = it.quit
+
+	default:
+		if p.conn == nil {
+			// Detached, drop the message
+			serverMetrics.Dropped(DropReasonDetached, 1)
+			return
+		}
+		if err := p.conn.Send(item); err != nil {
+			serverMetrics.Dropped(DropReasonSendFailed, 1)
+		}
 	}
+}
+
+// Pushes the message to the player asynchronously. PlayerErrorBehind
+// is returned for game updates if the player's queued updates had to be
+// dropped, and the player needs a snapshot of the game.
+func (p *Player) SendToPlayer(msg interface{}) error {
+	return p.toPlayer.Push(msg)
+}
 
-	p.setGameCtrl <- ctrlChan
-	return nil
+// Sets the channel a player should use to use to send controls
+// to the the game at on, and the channel closed once the game quits.
+func (p *Player) SetGameCtrl(ctrlChan *GamePlayerCtrl, quit chan bool) error {
+	return p.toPlayer.Push(&playerGameCtrl{ctrl: ctrlChan, quit: quit})
 }
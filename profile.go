@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lifetime stats of an account. Guests have no profile.
+type Profile struct {
+	AccountId     string
+	Name          string // Display name the account last played as
+	GamesPlayed   int    // Rounds played through to their results
+	Wins          int
+	TotalScore    int
+	BestScore     int // Highest score of a single round
+	BlocksClaimed int
+	TimePlayed    int64 // Milliseconds
+	LastPlayed    time.Time
+	Rating        float64 // Elo rating, only valid once a rated game is played
+	RatedGames    int
+}
+
+// Change to an account's stats, recorded when a round ends, or the
+// player leaves the game.
+type ProfileUpdate struct {
+	Account       *Account
+	Name          string
+	Completed     bool // If the player played the round through to its results
+	Won           bool
+	Score         int // Points scored since the last update
+	RoundScore    int // Final score of the round, if completed
+	BlocksClaimed int
+	TimePlayed    time.Duration
+	Rated         bool    // If the round changed the player's rating
+	RatingChange  float64 // Change to the player's rating
+}
+
+// Persistent store of account profiles. Must be safe for use by
+// multiple goroutines.
+type ProfileStore interface {
+	// Returns a copy of the account's profile, nil if it has none
+	Get(accountId string) *Profile
+	// Adds the update to the account's profile, creating it if needed
+	Record(update *ProfileUpdate) error
+	// Writes any pending updates, and closes the store
+	Close() error
+}
+
+// Returns the account's rating, or the default rating if the account
+// hasn't played a rated game.
+func (p *Profile) GetRating() float64 {
+	if p.RatedGames == 0 {
+		return DefaultRating
+	}
+	return p.Rating
+}
+
+// Profile store kept in memory, and persisted to a record log. Every
+// update appends the account's complete profile to the log, which is
+// compacted once it has grown to several times the number of profiles.
+type FileProfileStore struct {
+	mu       sync.Mutex
+	profiles map[string]*Profile
+	log      *RecordLog
+}
+
+// Opens the profile store in the file, creating it if it doesn't exist
+func OpenProfileStore(path string) (*FileProfileStore, error) {
+	profiles := make(map[string]*Profile)
+	err := ReadRecordLog(path, func(record []byte) error {
+		p := &Profile{}
+		if err := json.Unmarshal(record, p); err != nil {
+			return err
+		}
+		if len(p.AccountId) == 0 {
+			return StoreErrorInvalidRecord
+		}
+		profiles[p.AccountId] = p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]interface{}, 0, len(profiles))
+	for _, p := range profiles {
+		records = append(records, p)
+	}
+	recordLog, err := OpenRecordLog(path, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileProfileStore{profiles: profiles, log: recordLog}, nil
+}
+
+func (s *FileProfileStore) Get(accountId string) *Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.profiles[accountId]
+	if p == nil {
+		return nil
+	}
+	profile := *p
+	return &profile
+}
+
+func (s *FileProfileStore) Record(update *ProfileUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.profiles[update.Account.Id]
+	if p == nil {
+		p = &Profile{AccountId: update.Account.Id}
+		s.profiles[p.AccountId] = p
+	}
+	p.apply(update)
+	// Appended while locked, so the last record is the current profile
+	err := s.log.Append(p)
+	if s.log.NeedsCompact(len(s.profiles)) {
+		s.compact()
+	}
+	return err
+}
+
+// Compacts the log to the current profiles. Must be called while locked.
+func (s *FileProfileStore) compact() {
+	records := make([]interface{}, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		records = append(records, p)
+	}
+	if err := s.log.Compact(records); err != nil {
+		log.Println("Failed to compact profiles,", err)
+	}
+}
+
+func (s *FileProfileStore) Close() error {
+	return s.log.Close()
+}
+
+// Adds the update to the profile's stats
+func (p *Profile) apply(update *ProfileUpdate) {
+	if len(update.Name) != 0 {
+		p.Name = update.Name
+	}
+	if update.Completed {
+		p.GamesPlayed++
+		if update.RoundScore > p.BestScore {
+			p.BestScore = update.RoundScore
+		}
+	}
+	if update.Won {
+		p.Wins++
+	}
+	if update.Rated {
+		p.Rating = p.GetRating() + update.RatingChange
+		p.RatedGames++
+	}
+	p.TotalScore += update.Score
+	p.BlocksClaimed += update.BlocksClaimed
+	p.TimePlayed += int64(update.TimePlayed / time.Millisecond)
+	p.LastPlayed = time.Now()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits of a player's outbound message queue
+type QueueLimits struct {
+	HighWater  int           // Messages queued before game updates are coalesced
+	MaxItems   int           // Messages queued before further messages are dropped, and the player disconnected
+	EvictAfter time.Duration // Time over the high water mark before the player is disconnected
+}
+
+var (
+	DefaultQueueLimits = QueueLimits{
+		HighWater:  64,
+		MaxItems:   256,
+		EvictAfter: 10 * time.Second,
+	}
+)
+
+// Outbound queue of the messages, and controls sent to a player. Pushing
+// to the queue never blocks, so a slow player doesn't hold up the game
+// sending to it. When the queue reaches its high water mark the game
+// updates queued are dropped, and the game is told to send the player a
+// snapshot instead the next time it sends the player an update. Game
+// updates pushed while the queue is over its high water mark are dropped
+// as they are pushed. Other messages are dropped once the queue holds
+// its max items, and the queue is then over its limit.
+type OutQueue struct {
+	limits    QueueLimits
+	mu        sync.Mutex
+	items     []interface{}
+	updates   int // Game updates in the queue
+	closed    bool
+	full      bool      // Messages were dropped because the queue was full
+	coalesced bool      // Game updates were dropped, and the game not told yet
+	behind    bool      // Game updates were dropped since the last pop
+	overSince time.Time // When the queue went over its high water mark
+	ready     chan bool
+}
+
+// Creates a new empty queue
+func NewOutQueue(limits QueueLimits) *OutQueue {
+	return &OutQueue{
+		limits: limits,
+		items:  make([]interface{}, 0, limits.HighWater),
+		ready:  make(chan bool, 1),
+	}
+}
+
+// Adds the item to the end of the queue. PlayerErrorBehind is returned
+// for a game update if queued game updates were dropped since the last
+// game update was pushed, and PlayerErrorQueueFull if the message was
+// dropped because the queue is full. Controls are never dropped.
+func (q *OutQueue) Push(item interface{}) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return PlayerErrorDisconnected
+	}
+
+	isUpdate, isCtrl := false, false
+	switch item.(type) {
+	case *MsgGameUpdate:
+		isUpdate = true
+	case *playerConn, *playerGameCtrl:
+		isCtrl = true
+	}
+
+	over := q.limits.HighWater > 0 && len(q.items) >= q.limits.HighWater
+	switch {
+	case isUpdate && over:
+		// Already coalesced, so only the new update needs dropping
+		serverMetrics.Dropped(DropReasonCoalesced, 1)
+		q.markBehind()
+	case !isUpdate && !isCtrl && q.limits.MaxItems > 0 && len(q.items) >= q.limits.MaxItems:
+		serverMetrics.Dropped(DropReasonQueueFull, 1)
+		q.full = true
+		return PlayerErrorQueueFull
+	default:
+		q.items = append(q.items, item)
+		if isUpdate {
+			q.updates++
+		}
+		if q.limits.HighWater > 0 && len(q.items) >= q.limits.HighWater && q.updates > 0 {
+			q.coalesce()
+		}
+	}
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+
+	if isUpdate && q.coalesced {
+		q.coalesced = false
+		return PlayerErrorBehind
+	}
+	return nil
+}
+
+// Drops all queued game updates, and marks when the queue went over
+// its high water mark. Only needed when the queue reaches its high water
+// mark, updates pushed while over it are never queued.
+func (q *OutQueue) coalesce() {
+	kept := q.items[0:0]
+	for _, item := range q.items {
+		if _, ok := item.(*MsgGameUpdate); !ok {
+			kept = append(kept, item)
+		}
+	}
+	for i := len(kept); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	serverMetrics.Dropped(DropReasonCoalesced, uint64(len(q.items)-len(kept)))
+	q.items = kept
+	q.updates = 0
+	q.markBehind()
+}
+
+// Marks game updates as dropped, and when the queue went over its high
+// water mark.
+func (q *OutQueue) markBehind() {
+	q.coalesced = true
+	q.behind = true
+	if q.overSince.IsZero() {
+		q.overSince = time.Now()
+	}
+}
+
+// Removes and returns all items in the queue. False is returned once
+// the queue is closed. The queue is no longer considered over its high
+// water mark if no game updates were dropped since the last pop.
+func (q *OutQueue) Pop() ([]interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, false
+	}
+
+	items := q.items
+	q.items = make([]interface{}, 0, cap(items))
+	q.updates = 0
+	if !q.behind {
+		q.overSince = time.Time{}
+	}
+	q.behind = false
+
+	return items, true
+}
+
+// Returns if the queue has been over its high water mark for longer
+// than its limit allows, or messages were dropped because it was full.
+func (q *OutQueue) OverLimit() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.full || (!q.overSince.IsZero() && time.Since(q.overSince) > q.limits.EvictAfter)
+}
+
+// Returns the channel signaled when items are pushed to the queue
+func (q *OutQueue) Ready() <-chan bool {
+	return q.ready
+}
+
+// Closes the queue, dropping any queued items
+func (q *OutQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.items = nil
+	close(q.ready)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func countGameUpdates(items []interface{}) int {
+	n := 0
+	for _, item := range items {
+		if _, ok := item.(*MsgGameUpdate); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestQueueCoalescesGameUpdates(t *testing.T) {
+	q := NewOutQueue(QueueLimits{HighWater: 4, MaxItems: 8, EvictAfter: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if err := q.Push(MsgCreateGameUpdate()); err != nil {
+			t.Fatal("Unexpected error under the high water mark,", err)
+		}
+	}
+	q.Push(MsgCreateWorldUpdate())
+	if err := q.Push(MsgCreateGameUpdate()); err != PlayerErrorBehind {
+		t.Fatal("Expected the game update to be dropped, got", err)
+	}
+
+	// Still over the high water mark with other messages, updates are
+	// dropped as they are pushed
+	for i := 0; i < 3; i++ {
+		q.Push(MsgCreateWorldUpdate())
+	}
+	for i := 0; i < 3; i++ {
+		if err := q.Push(MsgCreateGameUpdate()); err != PlayerErrorBehind {
+			t.Fatal("Expected game updates over the high water mark to be dropped, got", err)
+		}
+	}
+
+	items, _ := q.Pop()
+	if len(items) != 4 || countGameUpdates(items) != 0 {
+		t.Fatalf("Expected only the world updates to be kept, %+v", items)
+	}
+	q.Pop()
+
+	// The player caught up, updates are queued again
+	if err := q.Push(MsgCreateGameUpdate()); err != nil {
+		t.Fatal("Unexpected error after popping,", err)
+	}
+	if items, _ = q.Pop(); countGameUpdates(items) != 1 {
+		t.Fatalf("Expected the game update to be queued, %+v", items)
+	}
+	if q.OverLimit() {
+		t.Fatal("Queue isn't behind anymore")
+	}
+}
+
+func TestQueueEvictsWhenBehind(t *testing.T) {
+	q := NewOutQueue(QueueLimits{HighWater: 2, MaxItems: 8, EvictAfter: time.Millisecond})
+	q.Push(MsgCreateGameUpdate())
+	q.Push(MsgCreateGameUpdate())
+	q.Pop()
+	q.Pop()
+
+	time.Sleep(2 * time.Millisecond)
+	if q.OverLimit() {
+		t.Fatal("Expected the queue not to be over its limit until updates are dropped again")
+	}
+
+	q.Push(MsgCreateGameUpdate())
+	q.Push(MsgCreateGameUpdate())
+	q.Pop()
+	q.Push(MsgCreateGameUpdate())
+	q.Push(MsgCreateGameUpdate())
+	time.Sleep(2 * time.Millisecond)
+	if !q.OverLimit() {
+		t.Fatal("Expected the queue to be over its limit after falling behind")
+	}
+}
+
+func TestQueueCapsOtherMessages(t *testing.T) {
+	q := NewOutQueue(QueueLimits{HighWater: 2, MaxItems: 4, EvictAfter: time.Hour})
+	for i := 0; i < 4; i++ {
+		if err := q.Push(MsgCreateWorldUpdate()); err != nil {
+			t.Fatal("Unexpected error under max items,", err)
+		}
+	}
+	if q.OverLimit() {
+		t.Fatal("Queue isn't full yet")
+	}
+
+	if err := q.Push(MsgCreateWorldUpdate()); err != PlayerErrorQueueFull {
+		t.Fatal("Expected the message to be dropped, got", err)
+	}
+	if err := q.Push(&playerGameCtrl{}); err != nil {
+		t.Fatal("Expected controls to never be dropped, got", err)
+	}
+	if !q.OverLimit() {
+		t.Fatal("Expected a full queue to be over its limit")
+	}
+	if items, _ := q.Pop(); len(items) != 5 {
+		t.Fatalf("Expected the 4 messages and control, %+v", items)
+	}
+}
+
+func TestQueueClosed(t *testing.T) {
+	q := NewOutQueue(DefaultQueueLimits)
+	q.Close()
+	if err := q.Push(MsgCreateGameUpdate()); err != PlayerErrorDisconnected {
+		t.Fatal("Expected a closed queue to reject items, got", err)
+	}
+	if _, ok := q.Pop(); ok {
+		t.Fatal("Expected pop to fail once closed")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Rating of accounts which haven't played a rated game, and guests
+	DefaultRating = 1500
+	// Most a rating can change from a single game
+	eloK = 32
+)
+
+// Returns the change in each player's Elo rating from the scores of a
+// game they played together. Each player is treated as having played
+// every other player, winning if they scored more, and drawing if they
+// scored the same. The changes are scaled by the number of opponents, so
+// a game moves a rating at most as much as a two player game would.
+func EloRatingChanges(ratings []float64, scores []int) []float64 {
+	changes := make([]float64, len(ratings))
+	if len(ratings) < 2 {
+		return changes
+	}
+
+	for i := range ratings {
+		for j := range ratings {
+			if i == j {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, (ratings[j]-ratings[i])/400))
+			actual := 0.5
+			if scores[i] > scores[j] {
+				actual = 1
+			} else if scores[i] < scores[j] {
+				actual = 0
+			}
+			changes[i] += actual - expected
+		}
+		changes[i] *= eloK / float64(len(ratings)-1)
+	}
+	return changes
+}
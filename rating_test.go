@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEloRatingChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratings []float64
+		scores  []int
+		changes []float64
+	}{
+		{"even win", []float64{1500, 1500}, []int{10, 5}, []float64{16, -16}},
+		{"even draw", []float64{1500, 1500}, []int{7, 7}, []float64{0, 0}},
+		// The lower rated player was expected to score 1/11
+		{"upset", []float64{1500, 1900}, []int{10, 5}, []float64{32 * 10.0 / 11, -32 * 10.0 / 11}},
+		{"expected win", []float64{1500, 1900}, []int{5, 10}, []float64{-32 * 1.0 / 11, 32 * 1.0 / 11}},
+		{"draw against higher", []float64{1500, 1900}, []int{5, 5}, []float64{32 * (0.5 - 1.0/11), -32 * (0.5 - 1.0/11)}},
+		// Each player plays the other two, scaled by half
+		{"three players", []float64{1500, 1500, 1500}, []int{3, 2, 1}, []float64{16, 0, -16}},
+		{"three players tied", []float64{1500, 1500, 1500}, []int{3, 3, 1}, []float64{8, 8, -16}},
+		{"single player", []float64{1500}, []int{10}, []float64{0}},
+	}
+
+	for _, test := range tests {
+		changes := EloRatingChanges(test.ratings, test.scores)
+		sum := 0.0
+		for i := range changes {
+			if math.Abs(changes[i]-test.changes[i]) > 1e-9 {
+				t.Errorf("%s, expected %v got %v", test.name, test.changes, changes)
+				break
+			}
+			sum += changes[i]
+		}
+		if math.Abs(sum) > 1e-9 {
+			t.Errorf("%s, expected the changes to sum to 0, got %v", test.name, sum)
+		}
+	}
+}
+
+func TestEloRatingChangeBoundedByK(t *testing.T) {
+	for _, players := range []int{2, 3, 4, 8} {
+		ratings := make([]float64, players)
+		scores := make([]int, players)
+		for i := range ratings {
+			ratings[i] = 1000
+			scores[i] = i
+		}
+		// The lowest rated player beats every far higher rated player
+		ratings[players-1] = 0
+		for i := 0; i < players-1; i++ {
+			ratings[i] = 3000
+		}
+		changes := EloRatingChanges(ratings, scores)
+		if changes[players-1] > eloK || changes[players-1] < eloK-1 {
+			t.Errorf("%d players, expected nearly K for the upset, got %v", players, changes[players-1])
+		}
+	}
+}
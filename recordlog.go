@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+type StoreError struct {
+	StoreErrorString string
+}
+
+func (s *StoreError) Error() string { return s.StoreErrorString }
+
+var (
+	StoreErrorClosed        = &StoreError{"Store is closed"}
+	StoreErrorInvalidRecord = &StoreError{"Record is missing its key"}
+	StoreErrorBehind        = &StoreError{"Store fell behind writing, and the record was dropped"}
+)
+
+const (
+	// Records waiting to be written before appended records are dropped
+	recordLogQueueLen = 256
+	// Longest record read from a record log
+	maxRecordLen = 64 * 1024
+	// Logs are compacted once they hold this many times the current
+	// records, and at least the minimum records
+	recordLogCompactRatio = 4
+	recordLogCompactMin   = 1024
+)
+
+// File of JSON records, a record per line, which stores are persisted
+// to. Stores append a record each time something changes, so the last
+// record of a key is its current value, and compact the log to only
+// the current records when they are opened, and again once the log has
+// grown to several times the current records. Records are written in
+// the background, and appending never blocks, so stores can append from
+// the game loops. If the disk falls too far behind, records appended are
+// dropped and counted instead.
+type RecordLog struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	writes     chan recordLogWrite
+	done       chan bool
+	closed     bool
+	records    int    // Records in the log, including those queued
+	compactMin int    // Fewest records the log is compacted at
+	dropped    uint64 // Records dropped because the queue was full
+}
+
+// Record appended to the log, or the records the log is compacted to
+type recordLogWrite struct {
+	data    []byte
+	compact bool
+}
+
+// Passes each record in the log to decode in the order they were
+// written. A missing file has no records. A partial last record, left
+// by a crash, is ignored, but any other record decode fails on is an
+// error.
+func ReadRecordLog(path string, decode func(record []byte) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxRecordLen)
+	var badLine int
+	for line := 1; scanner.Scan(); line++ {
+		if badLine != 0 {
+			return fmt.Errorf("record log %s line %d is corrupt", path, badLine)
+		}
+		if err := decode(scanner.Bytes()); err != nil {
+			badLine = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if badLine != 0 {
+		log.Println("Ignoring partial last line", badLine, "of record log", path)
+	}
+	return nil
+}
+
+// Compacts the log to the records, and opens it for appending.
+func OpenRecordLog(path string, records []interface{}) (*RecordLog, error) {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return nil, err
+	}
+	file, err := writeRecordFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RecordLog{
+		path:       path,
+		file:       file,
+		writes:     make(chan recordLogWrite, recordLogQueueLen),
+		done:       make(chan bool),
+		records:    len(records),
+		compactMin: recordLogCompactMin,
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+// Returns the records encoded a record per line
+func encodeRecords(records []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the file at the path with the data, and returns the file
+// opened for appending. The data is written to a temporary file first,
+// so the file is never left partially written.
+func writeRecordFile(path string, data []byte) (*os.File, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return file, nil
+}
+
+// Writes the queued records to the file until the log is closed
+func (l *RecordLog) writeLoop() {
+	defer close(l.done)
+	for write := range l.writes {
+		if !write.compact {
+			if _, err := l.file.Write(write.data); err != nil {
+				log.Println("Failed to write record,", err)
+			}
+			continue
+		}
+
+		file, err := writeRecordFile(l.path, write.data)
+		if err != nil {
+			// Appending to the uncompacted log instead
+			log.Println("Failed to compact record log", l.path, err)
+			continue
+		}
+		l.file.Close()
+		l.file = file
+	}
+}
+
+// Queues the record to be appended to the log. Records are written in
+// the order they are appended. If too many records are waiting to be
+// written the record is dropped, and StoreErrorBehind returned.
+func (l *RecordLog) Append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return StoreErrorClosed
+	}
+	select {
+	case l.writes <- recordLogWrite{data: append(data, '\n')}:
+		l.records++
+		return nil
+	default:
+		n := atomic.AddUint64(&l.dropped, 1)
+		serverMetrics.RecordsDropped.Inc()
+		log.Println("Record log", l.path, "fell behind, dropped", n, "records")
+		return StoreErrorBehind
+	}
+}
+
+// Returns if the log holds enough more records than the number of
+// current records to be compacted
+func (l *RecordLog) NeedsCompact(current int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records >= l.compactMin && l.records > recordLogCompactRatio*current
+}
+
+// Queues the log to be rewritten with only the records, in the order
+// of the records appended before and after it. Stores must compact to
+// their current records while no records are appended. Compaction is
+// skipped if the log has fallen behind.
+func (l *RecordLog) Compact(records []interface{}) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return StoreErrorClosed
+	}
+	select {
+	case l.writes <- recordLogWrite{data: data, compact: true}:
+		l.records = len(records)
+		return nil
+	default:
+		return StoreErrorBehind
+	}
+}
+
+// Returns the number of records dropped because the log fell behind
+func (l *RecordLog) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Writes the queued records, and closes the log
+func (l *RecordLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.writes)
+	l.mu.Unlock()
+
+	<-l.done
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	Key   string
+	Value int
+}
+
+// Reads the records of the log at the path
+func readTestRecords(path string) ([]testRecord, error) {
+	records := make([]testRecord, 0)
+	err := ReadRecordLog(path, func(data []byte) error {
+		var r testRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+func TestReadRecordLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		records int
+		fails   bool
+	}{
+		{"complete", "{\"Key\":\"a\",\"Value\":1}\n{\"Key\":\"b\",\"Value\":2}\n", 2, false},
+		{"torn last line", "{\"Key\":\"a\",\"Value\":1}\n{\"Key\":\"b\",\"Value\":2}\n{\"Key\":\"a\",\"Va", 2, false},
+		{"torn last line with newline", "{\"Key\":\"a\",\"Value\":1}\n{\"Ke\n", 1, false},
+		{"corrupt middle line", "{\"Key\":\"a\",\"Value\":1}\n{\"Ke\n{\"Key\":\"b\",\"Value\":2}\n", 0, true},
+		{"empty", "", 0, false},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "records.log")
+		if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		records, err := readTestRecords(path)
+		if test.fails {
+			if err == nil {
+				t.Error(test.name, "expected an error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.name, "failed,", err)
+		} else if len(records) != test.records {
+			t.Errorf("%s expected %d records, got %+v", test.name, test.records, records)
+		}
+	}
+
+	if _, err := readTestRecords(filepath.Join(t.TempDir(), "missing.log")); err != nil {
+		t.Fatal("Expected a missing log to have no records, got", err)
+	}
+}
+
+func TestOpenRecordLogCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.log")
+	s, err := OpenProfileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{Id: "local:jo"}
+	for i := 0; i < 5; i++ {
+		if err := s.Record(&ProfileUpdate{Account: account, Name: "Jo", Completed: true, Score: 10, RoundScore: 10 * i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Record(&ProfileUpdate{Account: &Account{Id: "local:al"}, Name: "Al", Score: 1})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, path); lines != 6 {
+		t.Fatal("Expected every update to be appended, got", lines, "lines")
+	}
+
+	// Left by a crash while appending
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString("{\"AccountId\":\"local:jo\",\"Na")
+	file.Close()
+
+	s, err = OpenProfileStore(path)
+	if err != nil {
+		t.Fatal("Failed to replay the log after a torn line,", err)
+	}
+	defer s.Close()
+	if lines := countLines(t, path); lines != 2 {
+		t.Fatal("Expected the log to be compacted to a record per account, got", lines, "lines")
+	}
+	p := s.Get("local:jo")
+	if p == nil || p.GamesPlayed != 5 || p.BestScore != 40 || p.TotalScore != 50 {
+		t.Fatalf("Expected the last profile to be replayed, %+v", p)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("Expected the temporary file to be renamed over the log")
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestRecordLogAppendNeverBlocks(t *testing.T) {
+	// Not written, as if the disk stalled
+	l := &RecordLog{path: "stalled.log", writes: make(chan recordLogWrite, 2), done: make(chan bool)}
+	for i := 0; i < 2; i++ {
+		if err := l.Append(&testRecord{Key: "a", Value: i}); err != nil {
+			t.Fatal("Expected the record to be queued, got", err)
+		}
+	}
+	dropped := serverMetrics.RecordsDropped.Value()
+	if err := l.Append(&testRecord{Key: "a", Value: 2}); err != StoreErrorBehind {
+		t.Fatal("Expected the record to be dropped, got", err)
+	}
+	if l.Dropped() != 1 || serverMetrics.RecordsDropped.Value() != dropped+1 {
+		t.Fatal("Expected the dropped record to be counted")
+	}
+}
+
+func TestProfileStoreCompactsInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.log")
+	s, err := OpenProfileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.log.compactMin = 8
+	jo, al := &Account{Id: "local:jo"}, &Account{Id: "local:al"}
+	s.Record(&ProfileUpdate{Account: al, Name: "Al", Score: 1})
+	for i := 0; i < 10; i++ {
+		if err := s.Record(&ProfileUpdate{Account: jo, Name: "Jo", Completed: true, Score: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compacted to both profiles at the 9th record, then 2 appended
+	if lines := countLines(t, path); lines != 4 {
+		t.Fatal("Expected the log to be compacted while open, got", lines, "lines")
+	}
+	s, err = OpenProfileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if p := s.Get("local:jo"); p == nil || p.GamesPlayed != 10 || p.TotalScore != 10 {
+		t.Fatalf("Expected the latest profile to survive compaction, %+v", p)
+	}
+	if p := s.Get("local:al"); p == nil || p.TotalScore != 1 {
+		t.Fatalf("Expected other profiles to survive compaction, %+v", p)
+	}
+}
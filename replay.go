@@ -0,0 +1,236 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+type ReplayRecordKind int
+
+var (
+	ReplayRecordHeader        = ReplayRecordKind(0)
+	ReplayRecordPlayerAdded   = ReplayRecordKind(1)
+	ReplayRecordPlayerRemoved = ReplayRecordKind(2)
+	ReplayRecordAction        = ReplayRecordKind(3)
+	ReplayRecordUpdate        = ReplayRecordKind(4)
+)
+
+type ReplayError struct {
+	ReplayErrorString string
+}
+
+func (r *ReplayError) Error() string { return r.ReplayErrorString }
+
+var (
+	ReplayErrorNoHeader = &ReplayError{"Replay file does not start with a header"}
+)
+
+// Single entry in a replay file. Replay files are a gzip compressed
+// stream of JSON encoded records, starting with a header record.
+type ReplayRecord struct {
+	K ReplayRecordKind   // Kind of record
+	T uint64             // Tick the record was made on
+	H *ReplayHeader      `json:",omitempty"`
+	P uint64             `json:",omitempty"` // Player id
+	A *MsgPartActionGame `json:",omitempty"`
+	U *MsgGameUpdate     `json:",omitempty"`
+}
+
+// Describes the game that was recorded
+type ReplayHeader struct {
+	GameId    uint64
+	GameType  *GameType
+	Seed      int64
+	Step      int64 // Time between simulation steps, in milliseconds
+	StartedAt int64 // Unix time the recording was started
+}
+
+// Records a game's player actions, and updates to a replay file.
+type ReplayRecorder struct {
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// Creates a new replay file at the path, and writes the game's
+// header to it.
+func NewReplayRecorder(path string, g *Game) (*ReplayRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	r := &ReplayRecorder{
+		file: file,
+		gz:   gz,
+		enc:  json.NewEncoder(gz),
+	}
+
+	err = r.write(&ReplayRecord{
+		K: ReplayRecordHeader,
+		H: &ReplayHeader{
+			GameId:    g.GetId(),
+			GameType:  g.gameType,
+			Seed:      g.GetSeed(),
+			Step:      int64(g.stepDelay / time.Millisecond),
+			StartedAt: time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Records a player joining the game
+func (r *ReplayRecorder) RecordPlayerAdded(tick uint64, p *Player) {
+	r.write(&ReplayRecord{K: ReplayRecordPlayerAdded, T: tick, P: uint64(p.GetId())})
+}
+
+// Records a player leaving the game
+func (r *ReplayRecorder) RecordPlayerRemoved(tick uint64, p *Player) {
+	r.write(&ReplayRecord{K: ReplayRecordPlayerRemoved, T: tick, P: uint64(p.GetId())})
+}
+
+// Records a game action made by a player
+func (r *ReplayRecorder) RecordAction(tick uint64, ctrl *PlayerAction) {
+	r.write(&ReplayRecord{
+		K: ReplayRecordAction,
+		T: tick,
+		P: uint64(ctrl.Player.GetId()),
+		A: &MsgPartActionGame{
+			C: int(ctrl.Game.Command),
+			E: uint64(ctrl.Game.EntityId),
+		},
+	})
+}
+
+// Records an update sent to all players in the game
+func (r *ReplayRecorder) RecordUpdate(tick uint64, msg *MsgGameUpdate) {
+	r.write(&ReplayRecord{K: ReplayRecordUpdate, T: tick, U: msg})
+}
+
+// Flushes all records to the replay file and closes it
+func (r *ReplayRecorder) Close() {
+	if err := r.gz.Close(); err != nil {
+		log.Println("Failed to flush replay file,", err)
+	}
+	r.file.Close()
+}
+
+// Writes the record, logging any failures. A failed write will not
+// stop the game.
+func (r *ReplayRecorder) write(rec *ReplayRecord) error {
+	err := r.enc.Encode(rec)
+	if err != nil {
+		log.Println("Failed to write replay record,", err)
+	}
+	return err
+}
+
+// Reads the records of a replay file
+type ReplayReader struct {
+	Header *ReplayHeader
+	file   *os.File
+	gz     *gzip.Reader
+	dec    *json.Decoder
+}
+
+// Opens the replay file, and reads its header
+func OpenReplay(path string) (*ReplayReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	r := &ReplayReader{
+		file: file,
+		gz:   gz,
+		dec:  json.NewDecoder(gz),
+	}
+
+	rec, err := r.Next()
+	if err == nil && (rec.K != ReplayRecordHeader || rec.H == nil) {
+		err = ReplayErrorNoHeader
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.Header = rec.H
+
+	return r, nil
+}
+
+// Returns the next record in the replay, io.EOF is returned
+// once all records have been read.
+func (r *ReplayReader) Next() (*ReplayRecord, error) {
+	var rec ReplayRecord
+	if err := r.dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Closes the replay file
+func (r *ReplayReader) Close() {
+	r.gz.Close()
+	r.file.Close()
+}
+
+// Sends the recorded game updates to the connection at the same pace
+// they were recorded at, scaled by the speed. Playback stops when the
+// end of the replay is reached, or the done channel is closed.
+func (r *ReplayReader) PlayTo(conn Connection, speed float64, done chan bool) error {
+	step := time.Duration(float64(time.Duration(r.Header.Step)*time.Millisecond) / speed)
+
+	msg := MsgCreateGameUpdate()
+	msg.AddGameType(r.Header.GameType)
+	msg.G = &MsgPartGameInfo{
+		Id: r.Header.GameId,
+		T:  r.Header.GameType.Name,
+		Mp: r.Header.GameType.Players,
+		Sd: r.Header.Seed,
+	}
+	if err := conn.Send(msg); err != nil {
+		return err
+	}
+
+	var lastTick uint64
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if rec.K != ReplayRecordUpdate || rec.U == nil {
+			continue
+		}
+
+		if rec.T > lastTick {
+			select {
+			case <-done:
+				return nil
+			case <-time.After(time.Duration(rec.T-lastTick) * step):
+			}
+			lastTick = rec.T
+		}
+
+		if err := conn.Send(rec.U); err != nil {
+			return err
+		}
+	}
+}
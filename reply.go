@@ -0,0 +1,57 @@
+package main
+
+type ActionCode int
+
+// Codes replied to players for their actions, zero if the action was
+// accepted. Clients depend on these values, so new codes must only be
+// added to the end.
+var (
+	ActionCodeOk              = ActionCode(0)
+	ActionCodeUnknownEntity   = ActionCode(1)
+	ActionCodeNotYourTurn     = ActionCode(2)
+	ActionCodeWrongColor      = ActionCode(3)
+	ActionCodeRateLimited     = ActionCode(4)
+	ActionCodeNotInGame       = ActionCode(5)
+	ActionCodeSpectator       = ActionCode(6)
+	ActionCodeInvalidMatch    = ActionCode(7)
+	ActionCodeGameNotFound    = ActionCode(8)
+	ActionCodeGameFull        = ActionCode(9)
+	ActionCodeUnknownGameType = ActionCode(10)
+	ActionCodeUnknownCommand  = ActionCode(11)
+	ActionCodeFailed          = ActionCode(12) // Failed for any other reason
+	ActionCodeMalformed       = ActionCode(13) // Message could not be decoded
+	ActionCodeInvalid         = ActionCode(14) // Message failed validation
+	ActionCodeShuttingDown    = ActionCode(15) // Server is shutting down
+	ActionCodeNoProfile       = ActionCode(16) // Account has no profile
+	ActionCodeNotRanked       = ActionCode(17) // Account is not on the leaderboard
+	ActionCodeMuted           = ActionCode(18) // Player is muted, and can't chat
+)
+
+// Errors which can be replied to players for their actions
+type ActionError interface {
+	error
+	Code() ActionCode
+}
+
+// Returns the code to reply to the player with for the error
+func GetActionCode(err error) ActionCode {
+	if err == nil {
+		return ActionCodeOk
+	}
+	switch e := err.(type) {
+	case ActionError:
+		return e.Code()
+	case *MatchError:
+		return ActionCodeInvalidMatch
+	}
+	return ActionCodeFailed
+}
+
+// Sends the player the reply to their action. Sync acknowledgements
+// are not replied to, since they are sent continuously.
+func ReplyToAction(ctrl *PlayerAction, err error) {
+	if ctrl.Game != nil && ctrl.Game.Command == PlayerCmdGameAck && err == nil {
+		return
+	}
+	ctrl.Player.SendToPlayer(MsgCreateActionReply(ctrl.ReqId, err))
+}
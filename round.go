@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Configuration of a game type's rounds. All times are in seconds.
+type RoundConfig struct {
+	Length      int // Time a round lasts, 0 for no time limit
+	TargetScore int // Score which ends the round, 0 for no target
+	Countdown   int // Time before a round starts
+	Results     int // Time the results are shown before the next round
+}
+
+var (
+	// Two minute rounds, with a three second countdown, and the
+	// results shown for ten seconds.
+	DefaultRoundConfig = &RoundConfig{
+		Length:    120,
+		Countdown: 3,
+		Results:   10,
+	}
+)
+
+// Returns if the config is usable
+func (c *RoundConfig) Valid() bool {
+	return c.Length >= 0 && c.TargetScore >= 0 && c.Countdown >= 0 && c.Results >= 0
+}
+
+// Returns the number of simulation steps in the number of seconds
+func (g *Game) secondsToTicks(seconds int) uint64 {
+	return uint64(time.Duration(seconds) * time.Second / g.stepDelay)
+}
+
+// Starts a new round with the players currently in the game. The
+// board, and all scores are reset, and the countdown to the start of
+// the round begins.
+func (g *Game) newRound() {
+	g.round++
+	g.board = NewBoard(g.gameType.Rows, g.gameType.Cols)
+	g.sim = NewSimulation(g.board, g.gameType.GetSimConfig().NewSimRules(), g.rng, g.clock)
+	for _, pInfo := range g.players {
+		pInfo.Score = 0
+		pInfo.recordedScore = 0
+		pInfo.clearSelected()
+	}
+
+	countdown := g.secondsToTicks(g.gameType.GetRoundConfig().Countdown)
+	if countdown == 0 {
+		countdown = 1
+	}
+	g.setPhase(GameStateCountdown, countdown)
+
+	// Players reset their board when they receive the game type
+	msg := MsgCreateGameUpdate()
+	msg.AddGameType(g.gameType)
+	msg.AddGameInfo(g)
+	msg.AddRound(g)
+	msg.AddPlayerGameInfos(g.playerInfoList())
+	g.broadcastUpdate(msg)
+}
+
+// Ends the countdown, and starts the round running
+func (g *Game) beginRound() {
+	g.setPhase(GameStateRunning, g.secondsToTicks(g.gameType.GetRoundConfig().Length))
+
+	msg := MsgCreateGameUpdate()
+	msg.AddRound(g)
+	g.broadcastUpdate(msg)
+}
+
+// Ends the current round, releasing all selections and sending the
+// players the final standings. The players' stats are recorded to their
+// profiles, and the leaderboards. The next round will be started once
+// the results have been shown.
+func (g *Game) endRound() {
+	released := make([]*Entity, 0, 10)
+	for _, pInfo := range g.players {
+		released = append(released, g.releaseSelection(pInfo)...)
+	}
+
+	results := g.playerInfoList()
+	sort.Sort(gamePlayerInfosByScore(results))
+	changes := g.ratingChanges()
+	standings := make([]*LeaderboardResult, 0, len(g.players))
+	for p, pInfo := range g.players {
+		change, rated := changes[p]
+		outcome := &roundOutcome{
+			won:          pInfo.Score > 0 && pInfo.Score == results[0].Score,
+			rated:        rated,
+			ratingChange: change,
+		}
+		g.recordProfile(p, pInfo, outcome)
+		standings = append(standings, &LeaderboardResult{
+			Account: p.GetAccount(),
+			Name:    pInfo.Name,
+			Score:   pInfo.Score,
+			Won:     outcome.won,
+		})
+	}
+	if g.leaderboards != nil {
+		if err := g.leaderboards.Record(g.gameType.Name, standings); err != nil {
+			log.Println("Failed to record leaderboards of game", g.id, err)
+		}
+	}
+
+	wait := g.secondsToTicks(g.gameType.GetRoundConfig().Results)
+	if wait == 0 {
+		wait = 1
+	}
+	g.setPhase(GameStateEnded, wait)
+
+	msg := MsgCreateGameUpdate()
+	msg.AddRound(g)
+	msg.AddRoundResults(results)
+	msg.AddEntityUpdates(released)
+	g.broadcastUpdate(msg)
+}
+
+// Returns the change to the rating of each player with an account from
+// the round's final scores. Rounds are only rated if at least two players
+// with accounts played, and one of them scored. Nil is returned if the
+// round isn't rated.
+func (g *Game) ratingChanges() map[*Player]float64 {
+	if g.profiles == nil {
+		return nil
+	}
+	rated := make([]*Player, 0, len(g.players))
+	scored := false
+	for p, pInfo := range g.players {
+		if account := p.GetAccount(); !account.Guest && len(account.Id) != 0 {
+			rated = append(rated, p)
+			scored = scored || pInfo.Score > 0
+		}
+	}
+	if len(rated) < 2 || !scored {
+		return nil
+	}
+
+	ratings := make([]float64, len(rated))
+	scores := make([]int, len(rated))
+	for i, p := range rated {
+		ratings[i] = DefaultRating
+		if profile := g.profiles.Get(p.GetAccount().Id); profile != nil {
+			ratings[i] = profile.GetRating()
+		}
+		scores[i] = g.players[p].Score
+	}
+
+	changes := make(map[*Player]float64, len(rated))
+	for i, change := range EloRatingChanges(ratings, scores) {
+		changes[rated[i]] = change
+	}
+	return changes
+}
+
+// Returns if the round is over because a player reached the
+// round's target score.
+func (g *Game) targetScoreReached() bool {
+	target := g.gameType.GetRoundConfig().TargetScore
+	if target == 0 {
+		return false
+	}
+
+	for _, pInfo := range g.players {
+		if pInfo.Score >= target {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves the game into the state for the number of ticks. Zero
+// ticks means the state has no time limit.
+func (g *Game) setPhase(state GameState, ticks uint64) {
+	g.state = state
+	g.phaseEnds = 0
+	if ticks != 0 {
+		g.phaseEnds = g.tick + ticks
+	}
+}
+
+// Returns the time left in the current phase of the round, or -1
+// if the phase has no time limit.
+func (g *Game) phaseRemaining() time.Duration {
+	if g.phaseEnds == 0 {
+		return -1
+	}
+	if g.phaseEnds <= g.tick {
+		return 0
+	}
+	return time.Duration(g.phaseEnds-g.tick) * g.stepDelay
+}
+
+// Outcome of a round a player completed
+type roundOutcome struct {
+	won          bool
+	rated        bool    // If the round was rated
+	ratingChange float64 // Change to the player's rating
+}
+
+// Sorts the player infos by highest score first, and player
+// id when scores are tied.
+type gamePlayerInfosByScore []*GamePlayerInfo
+
+func (l gamePlayerInfosByScore) Len() int      { return len(l) }
+func (l gamePlayerInfosByScore) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l gamePlayerInfosByScore) Less(i, j int) bool {
+	if l[i].Score != l[j].Score {
+		return l[i].Score > l[j].Score
+	}
+	return l[i].PlayerId < l[j].PlayerId
+}
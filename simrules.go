@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Rules the simulation uses to decide when blocks are added to the
+// board, what they look like, and when they are removed.
+type SimRules interface {
+	// Minimum time between adding new blocks to the board
+	SpawnInterval() time.Duration
+	// Returns the number of blocks to try and add to the board
+	SpawnCount(rng *rand.Rand) int
+	// Returns the time to live of a new block
+	BlockTTL(rng *rand.Rand) time.Duration
+	// Returns the color of a new block
+	BlockColor(rng *rand.Rand) EntityColor
+	// Returns the number of colors blocks can be
+	NumColors() int
+	// Returns if the entity should be removed from the board
+	ShouldRemove(e *Entity, now time.Time) bool
+}
+
+// Creates the simulation rules from the game type's simulation config
+type SimRulesFactory func(cfg *SimConfig) SimRules
+
+// Configuration of the simulation rules used by a game type. All
+// durations are in milliseconds.
+type SimConfig struct {
+	Rules          string // Name of the simulation rules, default if empty
+	SpawnInterval  int    // Time between adding new blocks
+	MaxSpawn       int    // Most blocks which will be added at once
+	MinTTL, MaxTTL int    // Range of time a block lives for
+	Colors         int    // Number of block colors
+}
+
+const (
+	SimRulesRandom = "random"
+)
+
+var (
+	// Adds 0-4 blocks every second which live for seven seconds,
+	// and can be one of five colors.
+	DefaultSimConfig = &SimConfig{
+		Rules:         SimRulesRandom,
+		SpawnInterval: 1000,
+		MaxSpawn:      4,
+		MinTTL:        7000,
+		MaxTTL:        7000,
+		Colors:        5,
+	}
+
+	simRulesFactories = map[string]SimRulesFactory{
+		SimRulesRandom: NewRandomSimRules,
+	}
+)
+
+// Adds a new simulation rules implementation which game types
+// can select by name.
+func RegisterSimRules(name string, factory SimRulesFactory) {
+	simRulesFactories[name] = factory
+}
+
+// Returns the name of the rules the config selects
+func (c *SimConfig) RulesName() string {
+	if len(c.Rules) == 0 {
+		return SimRulesRandom
+	}
+	return c.Rules
+}
+
+// Returns if the config is usable
+func (c *SimConfig) Valid() bool {
+	if _, ok := simRulesFactories[c.RulesName()]; !ok {
+		return false
+	}
+	return c.SpawnInterval > 0 && c.MaxSpawn >= 0 && c.MinTTL > 0 &&
+		c.MaxTTL >= c.MinTTL && c.Colors > 0
+}
+
+// Creates the simulation rules selected by the config
+func (c *SimConfig) NewSimRules() SimRules {
+	return simRulesFactories[c.RulesName()](c)
+}
+
+// Default simulation rules, which adds a random number of blocks
+// at a fixed interval, with random colors, and a random time to live.
+type RandomSimRules struct {
+	spawnInterval  time.Duration
+	maxSpawn       int
+	minTTL, maxTTL time.Duration
+	colors         int
+}
+
+// Creates random simulation rules from the config
+func NewRandomSimRules(cfg *SimConfig) SimRules {
+	return &RandomSimRules{
+		spawnInterval: time.Duration(cfg.SpawnInterval) * time.Millisecond,
+		maxSpawn:      cfg.MaxSpawn,
+		minTTL:        time.Duration(cfg.MinTTL) * time.Millisecond,
+		maxTTL:        time.Duration(cfg.MaxTTL) * time.Millisecond,
+		colors:        cfg.Colors,
+	}
+}
+
+func (r *RandomSimRules) SpawnInterval() time.Duration {
+	return r.spawnInterval
+}
+
+func (r *RandomSimRules) SpawnCount(rng *rand.Rand) int {
+	return rng.Intn(r.maxSpawn + 1)
+}
+
+func (r *RandomSimRules) BlockTTL(rng *rand.Rand) time.Duration {
+	if r.maxTTL == r.minTTL {
+		return r.minTTL
+	}
+	return r.minTTL + time.Duration(rng.Int63n(int64(r.maxTTL-r.minTTL)+1))
+}
+
+func (r *RandomSimRules) BlockColor(rng *rand.Rand) EntityColor {
+	return EntityColor(rng.Intn(r.colors))
+}
+
+func (r *RandomSimRules) NumColors() int {
+	return r.colors
+}
+
+func (r *RandomSimRules) ShouldRemove(e *Entity, now time.Time) bool {
+	return now.Sub(e.updatedAt) >= e.ttl
+}
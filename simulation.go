@@ -5,13 +5,12 @@ import (
 	"time"
 )
 
-const (
-	MinTimeBetweenAdds = (1000 * time.Millisecond)
-)
-
 type Simulation struct {
 	nextEntityId EntityId
 	board        *Board
+	rules        SimRules
+	rng          *rand.Rand
+	clock        Clock
 	lastAddedOn  time.Time
 
 	// persistant temp storage
@@ -20,10 +19,16 @@ type Simulation struct {
 	lastAdd      time.Time
 }
 
-// Create a new instance of the simulator
-func NewSimulation(b *Board) *Simulation {
+// Create a new instance of the simulator, which will use the rules
+// to decide how blocks are added and removed from the board. All
+// randomness comes from the rng, and time from the clock, so the
+// simulation can be reproduced.
+func NewSimulation(b *Board, rules SimRules, rng *rand.Rand, clock Clock) *Simulation {
 	return &Simulation{
 		board:        b,
+		rules:        rules,
+		rng:          rng,
+		clock:        clock,
 		toRmList:     make([]*Entity, 5),
 		toUpdateList: make([]*Entity, 10),
 	}
@@ -35,9 +40,10 @@ func (s *Simulation) Step() []*Entity {
 	toRmList := s.toRmList[0:0]
 	toUpdateList := s.toUpdateList[0:0]
 
-	es := s.board.GetEntities()
+	now := s.clock.Now()
+	es := s.board.GetEntityArray()
 	for _, e := range es {
-		if time.Since(e.updatedAt) >= e.ttl {
+		if s.rules.ShouldRemove(e, now) {
 			toRmList = append(toRmList, e)
 		}
 		// TODO not sure what to do with just updated yet.
@@ -51,9 +57,9 @@ func (s *Simulation) Step() []*Entity {
 	}
 
 	// Adds new entities, and update the list
-	if time.Since(s.lastAddedOn) >= MinTimeBetweenAdds {
+	if now.Sub(s.lastAddedOn) >= s.rules.SpawnInterval() {
 		toUpdateList = s.addNew(toUpdateList)
-		s.lastAddedOn = time.Now().UTC()
+		s.lastAddedOn = now
 	}
 
 	// Update the persistant objects
@@ -70,7 +76,7 @@ func (s *Simulation) Step() []*Entity {
 
 // Adds new entities and updates the list as needed
 func (s *Simulation) addNew(list []*Entity) []*Entity {
-	c := rand.Intn(5)
+	c := s.rules.SpawnCount(s.rng)
 	for i := 0; i < c; i++ {
 		if e := s.addRandomBlock(); e != nil {
 			list = append(list, e)
@@ -83,19 +89,19 @@ func (s *Simulation) addNew(list []*Entity) []*Entity {
 // Creates a new random block and adds it to the board
 // The reference to the block created will be returned
 func (s *Simulation) addRandomBlock() *Entity {
-	x := rand.Intn(s.board.Cols)
-	y := rand.Intn(s.board.Rows)
+	x := s.rng.Intn(s.board.Cols)
+	y := s.rng.Intn(s.board.Rows)
 	if s.board.EntityAtPos(x, y) {
 		// don't create duplicate blocks at the same point
 		return nil
 	}
 
 	e := NewBoxEntity(s.nextEntityId,
-		time.Duration(7000)*time.Millisecond,
+		s.rules.BlockTTL(s.rng),
 		x, y,
-		EntityColor(rand.Intn(5)),
+		s.rules.BlockColor(s.rng),
 	)
 	s.nextEntityId++
-	s.board.AddEntity(e)
+	s.board.AddEntity(e, s.clock.Now())
 	return e
 }
@@ -1,50 +1,148 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type WorldError struct {
 	WorldErrorString string
+	CodeNum          ActionCode
 }
 
-func (w *WorldError) Error() string { return w.WorldErrorString }
+func (w *WorldError) Error() string    { return w.WorldErrorString }
+func (w *WorldError) Code() ActionCode { return w.CodeNum }
 
 var (
-	WorldErrorPlayerNotRegistered = &WorldError{"Player is not registred"}
+	WorldErrorPlayerNotRegistered = &WorldError{"Player is not registred", ActionCodeFailed}
+	WorldErrorGameNotFound        = &WorldError{"Game does not exist", ActionCodeGameNotFound}
+	WorldErrorGameFull            = &WorldError{"Game is full", ActionCodeGameFull}
+	WorldErrorUnknownGameType     = &WorldError{"Game type does not exist", ActionCodeUnknownGameType}
+	WorldErrorUnknownCommand      = &WorldError{"Unknown world command", ActionCodeUnknownCommand}
+	WorldErrorShuttingDown        = &WorldError{"Server is shutting down", ActionCodeShuttingDown}
+	WorldErrorNoProfile           = &WorldError{"Account has no profile", ActionCodeNoProfile}
+	WorldErrorProfilesDisabled    = &WorldError{"Profiles are not enabled", ActionCodeFailed}
+	WorldErrorNotRanked           = &WorldError{"Account is not on the leaderboard", ActionCodeNotRanked}
+	WorldErrorNoLeaderboards      = &WorldError{"Leaderboards are not enabled", ActionCodeFailed}
 )
 
 // The world object 
 type World struct {
+	// Directory replays of games will be recorded to, if not empty
+	ReplayDir string
+	// Time a player's session is held after their connection is lost,
+	// for them to resume it. Zero disables resuming sessions.
+	SessionGrace time.Duration
+	// Time between the simulation steps of new games
+	GameStep time.Duration
+	// Store the stats of players with accounts are recorded to, if set
+	Profiles ProfileStore
+	// Leaderboards the results of rounds are recorded to, if set
+	Leaderboards *Leaderboards
+
 	nextGameId uint64
 	players    map[*Player]*PlayerInstance
+	sessions   map[string]*Player
 	games      []*Game
+	gameTypes  *GameTypeRegistry
+	matchmaker *Matchmaker
+	chat       *Chat
+	muted      map[string]bool // Mute keys of the muted accounts, and guests
 
-	register     chan *Player
-	unregister   chan *Player
+	register     chan *PlayerRegistration
+	resume       chan *PlayerResume
+	connLost     chan *PlayerConnLost
 	playerAction chan *PlayerAction
+	gameEnded    chan *GameEnded
+	admin        chan *AdminRequest
+	shutdown     chan time.Duration
+	reconfigure  chan *Config
+	done         chan bool // Closed once the world has shut down
+
+	// Set once the world is shutting down
+	draining  bool
+	drainEnds time.Time
 
 	httpHndlr *HttpHandler
 }
 
+// Request for a player to be registered with the world, and placed
+// into a game of the requested type. An empty game type will use
+// the default game type.
+type PlayerRegistration struct {
+	Player    *Player
+	Conn      Connection
+	GameType  string
+	Spectator bool
+}
+
+// Request to resume a player's session with a new connection. The
+// resumed player is sent on the reply channel, or nil if the session
+// does not exist, or belongs to another account.
+type PlayerResume struct {
+	Session string
+	Account *Account // Account the new connection authenticated as
+	Conn    Connection
+	Reply   chan *Player
+}
+
+// Notification that a player's connection was closed
+type PlayerConnLost struct {
+	Player *Player
+	Conn   Connection
+}
+
 // Defines info about the player for this current instance 
 // being connected to the world
 type PlayerInstance struct {
-	Game *Game
+	Game       *Game
+	Spectator  bool       // Watching the game instead of playing in it
+	Session    string     // Token the player can resume their session with
+	Conn       Connection // Current connection, nil while detached
+	DetachedAt time.Time  // When the player's connection was lost
+	Muted      bool       // Muted by an admin, and can't chat
+}
+
+// Returns the key the player's mute is kept by. Accounts stay muted
+// when they reconnect, guests only for their session.
+func (info *PlayerInstance) muteKey(p *Player) string {
+	if account := p.GetAccount(); account != nil && !account.Guest && len(account.Id) != 0 {
+		return "account:" + account.Id
+	}
+	if len(info.Session) != 0 {
+		return "session:" + info.Session
+	}
+	return fmt.Sprint("player:", p.GetId())
 }
 
 // Initalization of the game object.game  It s being done in the package's
 // global scope so the network event handler will have access to it when
 // receiving new player connections.
-func NewWorld(httpHndlr *HttpHandler) *World {
+func NewWorld(httpHndlr *HttpHandler, gameTypes *GameTypeRegistry) *World {
 	w := &World{
 		nextGameId: 0,
 		players:    make(map[*Player]*PlayerInstance),
+		sessions:   make(map[string]*Player),
 		games:      make([]*Game, 0, 10),
+		gameTypes:  gameTypes,
+		matchmaker: NewMatchmaker(DefaultMatchmakingRules),
+		chat:       NewChat(DefaultChatSettings),
+		muted:      make(map[string]bool),
 
-		register:     make(chan *Player),
-		unregister:   make(chan *Player),
+		register:     make(chan *PlayerRegistration),
+		resume:       make(chan *PlayerResume),
+		connLost:     make(chan *PlayerConnLost),
 		playerAction: make(chan *PlayerAction),
+		gameEnded:    make(chan *GameEnded),
+		admin:        make(chan *AdminRequest),
+		shutdown:     make(chan time.Duration),
+		reconfigure:  make(chan *Config),
+		done:         make(chan bool),
 		httpHndlr:    httpHndlr,
 	}
 	return w
@@ -53,27 +151,38 @@ func NewWorld(httpHndlr *HttpHandler) *World {
 // Event receiver to processing messages between the simulation and
 // the players.  If players are connected to the game the simulation
 // will be started, but as soon as the last player drops out the
-// simulation will be terminated.
+// simulation will be terminated. Returns once the world has shut down.
 func (w *World) Run() {
 	go w.httpHndlr.HandleHttpConnection(w)
 
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer close(w.done)
+
 	for {
 		select {
-		case p := <-w.register:
+		case reg := <-w.register:
 			log.Println("Registering player")
-			err := w.registerPlayer(p)
+			err := w.registerPlayer(reg.Player, reg.Conn, reg.GameType, reg.Spectator)
 			if err != nil {
 				log.Println("Player failed to register: ", err)
-				w.unregister <- p
+				w.unregisterPlayer(reg.Player)
 			}
 
-		case p := <-w.unregister:
-			log.Println("Player unregistered")
-			err := w.unregisterPlayer(p)
+		case res := <-w.resume:
+			res.Reply <- w.resumeSession(res.Session, res.Account, res.Conn)
+
+		case lost := <-w.connLost:
+			err := w.playerConnLost(lost.Player, lost.Conn)
 			if err != nil {
 				log.Println("Failed to unregister player, ", err)
 			}
 
+		case <-ticker.C:
+			w.expireSessions()
+			w.matchmake()
+			w.publishMetrics()
+
 		case ctrl := <-w.playerAction:
 			info := w.players[ctrl.Player]
 			if info == nil {
@@ -81,68 +190,696 @@ func (w *World) Run() {
 				continue
 			}
 
-			// TODO handle player world controls
+			var err error
+			if ctrl.Chat != nil {
+				err = w.procChat(ctrl.Player, info, ctrl.Chat.Text)
+			}
+			if ctrl.World != nil && err == nil {
+				err = w.procPlayerCtrl(ctrl, info)
+				if err != nil {
+					log.Println("Player", ctrl.Player.GetId(), "world action failed,", err)
+				}
+			}
+			ReplyToAction(ctrl, err)
+			if ctrl.World != nil {
+				w.sendWorldUpdate(ctrl.Player, info)
+			}
+
+		case ended := <-w.gameEnded:
+			// A player may have been added to the game after it emptied
+			if ended.Reason == GameEndReasonEmpty && w.gamePlayerCount(ended.Game) != 0 {
+				continue
+			}
+			w.removeGame(ended.Game)
+
+		case req := <-w.admin:
+			req.Reply <- w.procAdminRequest(req)
+
+		case drain := <-w.shutdown:
+			w.beginDrain(drain)
+
+		case cfg := <-w.reconfigure:
+			if err := w.Configure(cfg); err != nil {
+				log.Println("Failed to reconfigure world,", err)
+			}
+		}
+
+		if w.draining && (len(w.games) == 0 || time.Now().After(w.drainEnds)) {
+			w.closeAll()
+			return
 		}
 	}
 }
 
-// Registers the player with the world and randomly adds them to a game
-// that is not full. If there are no available games a new one will be 
-// created.
-func (w *World) registerPlayer(p *Player) error {
-	// TODO need some kind of logic for a player to specifiy the game type
-	g := w.getAvailableGame(GameTypeMobileSmall)
-
-	w.players[p] = &PlayerInstance{Game: g}
-
+// Registers the player with the world, and queues them with the
+// matchmaker to be placed in a game of the requested type. Spectators
+// are added to the first game of the requested type, or left in the
+// lobby if there are none.
+func (w *World) registerPlayer(p *Player, conn Connection, gameTypeName string, spectator bool) error {
 	// Kick off the player's event loop
 	go p.Run(w)
 
-	g.AddPlayer <- p
+	if w.draining {
+		conn.Kick(CloseCodeShutdown, "Server shutting down")
+		return WorldErrorShuttingDown
+	}
+
+	gameType := w.gameTypes.Get(gameTypeName)
+	if gameType == nil {
+		conn.Kick(CloseCodeUnknownType, "Unknown game type")
+		return WorldErrorUnknownGameType
+	}
+
+	info := &PlayerInstance{Conn: conn}
+	w.players[p] = info
+	if w.SessionGrace != 0 {
+		info.Session = newSessionToken()
+		w.sessions[info.Session] = p
+		w.sendSession(p, info, false)
+	}
+	if info.Muted = w.muted[info.muteKey(p)]; info.Muted {
+		p.SendToPlayer(MsgCreateNotice("You have been muted by an admin"))
+	}
+
+	if spectator {
+		w.movePlayerToGame(p, info, w.getGameOfType(gameType), true)
+	} else {
+		w.findGame(p, info, gameType)
+	}
+	if info.Game == nil {
+		w.sendChatHistory(p, nil)
+	}
+	w.sendWorldUpdate(p, info)
 
 	return nil
 }
 
-// Returns a game object from the pool of available games
-// If no available game exists, one will be created.
-func (w *World) getAvailableGame(gameType *GameType) *Game {
-	if len(w.games) == 0 {
-		return w.addNewGame(gameType)
+// Rebinds the player with the session to the new connection, and
+// brings the player up to date with the world, and their game. Nil is
+// returned if there is no player with the session. Sessions of players
+// with an account can only be resumed by the same account.
+func (w *World) resumeSession(session string, account *Account, conn Connection) *Player {
+	p := w.sessions[session]
+	if p == nil {
+		return nil
+	}
+	if owner := p.GetAccount(); !owner.Guest && owner.Id != account.Id {
+		log.Println("Player", p.GetId(), "session resumed by another account")
+		return nil
+	}
+	info := w.players[p]
+	if info == nil {
+		delete(w.sessions, session)
+		return nil
 	}
+	if err := p.Rebind(conn); err != nil {
+		return nil
+	}
+
+	log.Println("Player", p.GetId(), "resumed session")
+	info.Conn = conn
+	info.DetachedAt = time.Time{}
+	w.sendSession(p, info, true)
+	w.sendWorldUpdate(p, info)
+	w.sendChatHistory(p, info.Game)
+	if w.draining {
+		p.SendToPlayer(MsgCreateShutdown(w.drainEnds.Sub(time.Now())))
+	}
+	if info.Game != nil {
+		info.Game.Resync <- p
+	}
+
+	return p
+}
+
+// Handles the player's connection being closed. If sessions can be
+// resumed the player is detached from the connection, and held until
+// the grace period expires. Otherwise the player is unregistered.
+// Nothing is done if the player was already unregistered, such as when
+// kicked.
+func (w *World) playerConnLost(p *Player, conn Connection) error {
+	info := w.players[p]
+	if info == nil {
+		return nil
+	}
+	if info.Conn != conn {
+		// The player has already resumed their session on a new connection
+		return nil
+	}
+	if w.SessionGrace == 0 || len(info.Session) == 0 {
+		log.Println("Player unregistered")
+		return w.unregisterPlayer(p)
+	}
+
+	log.Println("Player", p.GetId(), "connection lost, holding session")
+	info.Conn = nil
+	info.DetachedAt = time.Now()
+	return p.Rebind(nil)
+}
 
-	for _, g := range w.games[:] {
-		if g != nil && g.gameType == gameType && !g.IsFull() {
+// Unregisters all detached players whose grace period has expired
+func (w *World) expireSessions() {
+	for p, info := range w.players {
+		if info.Conn == nil && time.Since(info.DetachedAt) >= w.SessionGrace {
+			log.Println("Player", p.GetId(), "session expired")
+			w.unregisterPlayer(p)
+		}
+	}
+}
+
+// Sends the player their session token
+func (w *World) sendSession(p *Player, info *PlayerInstance, resumed bool) {
+	msg := MsgCreateSession(p, info.Session, w.SessionGrace, resumed)
+	if err := p.SendToPlayer(msg); err != nil {
+		log.Println("Failed to send session to player", p.GetId(), err)
+	}
+}
+
+// Returns a new random session token
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Unable to generate session token, ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Processes the player's world control, moving the player between
+// games, and the lobby as requested.
+func (w *World) procPlayerCtrl(ctrl *PlayerAction, info *PlayerInstance) error {
+	cmd := ctrl.World.Command
+	if w.draining && cmd != PlayerCmdWorldListGames && cmd != PlayerCmdWorldLeaveGame &&
+		cmd != PlayerCmdWorldProfile && cmd != PlayerCmdWorldLeaderboard {
+		return WorldErrorShuttingDown
+	}
+
+	switch cmd {
+	case PlayerCmdWorldListGames:
+		// Nothing to do, the game list is always sent in response
+
+	case PlayerCmdWorldJoinGame:
+		g := w.getGameById(ctrl.World.GameId)
+		if g == nil {
+			return WorldErrorGameNotFound
+		}
+		if (g != info.Game || info.Spectator) && w.gamePlayerCount(g) >= g.gameType.Players {
+			return WorldErrorGameFull
+		}
+		w.movePlayerToGame(ctrl.Player, info, g, false)
+
+	case PlayerCmdWorldSpectateGame:
+		g := w.getGameById(ctrl.World.GameId)
+		if g == nil {
+			return WorldErrorGameNotFound
+		}
+		w.movePlayerToGame(ctrl.Player, info, g, true)
+
+	case PlayerCmdWorldLeaveGame:
+		w.movePlayerToGame(ctrl.Player, info, nil, false)
+
+	case PlayerCmdWorldCreateGame:
+		gameType := w.gameTypes.Get(ctrl.World.GameType)
+		if gameType == nil {
+			return WorldErrorUnknownGameType
+		}
+		w.movePlayerToGame(ctrl.Player, info, w.addNewGame(gameType), false)
+
+	case PlayerCmdWorldProfile:
+		return w.sendProfile(ctrl.Player, ctrl.World.AccountId)
+
+	case PlayerCmdWorldLeaderboard:
+		return w.sendLeaderboard(ctrl.Player, info, ctrl.World)
+
+	case PlayerCmdWorldFindGame:
+		gameType := w.gameTypes.Get(ctrl.World.GameType)
+		if gameType == nil {
+			return WorldErrorUnknownGameType
+		}
+		w.findGame(ctrl.Player, info, gameType)
+
+	default:
+		return WorldErrorUnknownCommand
+	}
+
+	return nil
+}
+
+// Moves the player out of the game they are currently in, and into
+// the new game as either a player or spectator. If the new game is nil
+// the player will be returned to the lobby. Players moved to another
+// game, or the lobby are sent its chat history.
+func (w *World) movePlayerToGame(p *Player, info *PlayerInstance, g *Game, spectator bool) {
+	w.matchmaker.Cancel(p)
+	if info.Game == g && (g == nil || info.Spectator == spectator) {
+		return
+	}
+	if info.Game != nil {
+		info.Game.RmPlayer <- p
+	}
+
+	if info.Game != g {
+		w.sendChatHistory(p, g)
+	}
+	info.Game = g
+	info.Spectator = spectator && g != nil
+	if g == nil {
+		return
+	}
+	if info.Spectator {
+		g.AddSpectator <- p
+	} else {
+		g.AddPlayer <- p
+	}
+}
+
+// Sends the player the list of games, and the game they are
+// currently in.
+func (w *World) sendWorldUpdate(p *Player, info *PlayerInstance) {
+	msg := MsgCreateWorldUpdate()
+	msg.SetCurrentGame(info.Game, info.Spectator)
+	msg.Q = w.matchmaker.IsQueued(p)
+	msg.AddGameTypes(w.gameTypes.List())
+	for _, g := range w.games {
+		msg.AddGameInfo(g, w.gamePlayerCount(g), w.gameSpectatorCount(g))
+	}
+
+	if err := p.SendToPlayer(msg); err != nil {
+		log.Println("Failed to send world update to player", p.GetId(), err)
+	}
+}
+
+// Sends the player's chat message to the players in the same game as
+// them, or in the lobby if they aren't in a game.
+func (w *World) procChat(p *Player, info *PlayerInstance, text string) error {
+	if info.Muted {
+		return ChatErrorMuted
+	}
+	line, err := w.chat.Post(info.Game, p, text, time.Now())
+	if err != nil {
+		return err
+	}
+
+	msg := MsgCreateChat(info.Game, false, []MsgPartChatLine{*line})
+	for other, otherInfo := range w.players {
+		if otherInfo.Game == info.Game {
+			other.SendToPlayer(msg)
+		}
+	}
+	return nil
+}
+
+// Sends the player the recent messages of the game's chat channel, or
+// the lobby's if the game is nil. Nothing is sent if there are none.
+func (w *World) sendChatHistory(p *Player, g *Game) {
+	lines := w.chat.History(g)
+	if len(lines) == 0 {
+		return
+	}
+	if err := p.SendToPlayer(MsgCreateChat(g, true, lines)); err != nil {
+		log.Println("Failed to send chat history to player", p.GetId(), err)
+	}
+}
+
+// Sends the player the profile of the account, or their own profile if
+// the account id is empty.
+func (w *World) sendProfile(p *Player, accountId string) error {
+	if w.Profiles == nil {
+		return WorldErrorProfilesDisabled
+	}
+	if len(accountId) == 0 {
+		accountId = p.GetAccount().Id
+	}
+	if len(accountId) == 0 {
+		return WorldErrorNoProfile
+	}
+
+	profile := w.Profiles.Get(accountId)
+	if profile == nil {
+		return WorldErrorNoProfile
+	}
+	if err := p.SendToPlayer(MsgCreateProfile(profile)); err != nil {
+		log.Println("Failed to send profile to player", p.GetId(), err)
+	}
+	return nil
+}
+
+// Sends the player the requested page of a leaderboard. The page is
+// centered on the account's entry if an account is requested, otherwise
+// it starts at the offset. The leaderboard of the player's current game's
+// type is sent if no game type is requested, or the default game type's
+// if the player is in the lobby.
+func (w *World) sendLeaderboard(p *Player, info *PlayerInstance, action *PlayerWorldAction) error {
+	if w.Leaderboards == nil {
+		return WorldErrorNoLeaderboards
+	}
+	gameType := w.gameTypes.Default()
+	if len(action.GameType) != 0 {
+		gameType = w.gameTypes.Get(action.GameType)
+	} else if info.Game != nil {
+		gameType = info.Game.gameType
+	}
+	if gameType == nil {
+		return WorldErrorUnknownGameType
+	}
+
+	var page *LeaderboardPage
+	if len(action.AccountId) != 0 {
+		page = w.Leaderboards.Around(gameType.Name, action.Window, action.AccountId, defaultLeaderboardPageLen)
+		if page == nil {
+			return WorldErrorNotRanked
+		}
+	} else {
+		page = w.Leaderboards.Page(gameType.Name, action.Window, action.Offset, defaultLeaderboardPageLen)
+	}
+
+	if err := p.SendToPlayer(MsgCreateLeaderboard(action.Window, page)); err != nil {
+		log.Println("Failed to send leaderboard to player", p.GetId(), err)
+	}
+	return nil
+}
+
+// Returns the game with the matching id, nil if no game is found
+func (w *World) getGameById(id uint64) *Game {
+	for _, g := range w.games {
+		if g.GetId() == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// Returns the number of players the world has placed in the game.
+// Spectators are not included.
+func (w *World) gamePlayerCount(g *Game) int {
+	n := 0
+	for _, info := range w.players {
+		if info.Game == g && !info.Spectator {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the number of spectators watching the game
+func (w *World) gameSpectatorCount(g *Game) int {
+	n := 0
+	for _, info := range w.players {
+		if info.Game == g && info.Spectator {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the first game of the game type, or nil if there are none.
+func (w *World) getGameOfType(gameType *GameType) *Game {
+	for _, g := range w.games {
+		if g.gameType.Name == gameType.Name {
 			return g
 		}
 	}
+	return nil
+}
+
+// Moves the player to the lobby, and queues them with the matchmaker
+// to be placed in a game of the type. The player is placed right away if
+// a game close to their rating is available.
+func (w *World) findGame(p *Player, info *PlayerInstance, gameType *GameType) {
+	w.movePlayerToGame(p, info, nil, false)
+	w.matchmaker.Enqueue(&MatchTicket{
+		Player:   p,
+		GameType: gameType,
+		Rating:   w.playerRating(p),
+		Queued:   time.Now(),
+	})
+	w.matchmake()
+}
+
+// Places the players waiting in the matchmaker's queue into games, longest
+// waiting first. Players are not placed while the world is draining.
+func (w *World) matchmake() {
+	if w.draining {
+		return
+	}
+	now := time.Now()
+	ratings := w.gameRatings()
+	for _, ticket := range w.matchmaker.Queued() {
+		info := w.players[ticket.Player]
+		if info == nil {
+			w.matchmaker.Cancel(ticket.Player)
+			continue
+		}
+
+		g, ok := w.matchmaker.Match(ticket, matchCandidates(w.games, ratings, ticket.GameType), now)
+		if !ok {
+			continue
+		}
+		if g == nil {
+			g = w.addNewGame(ticket.GameType)
+			ratings[g] = &gameRating{}
+		}
+		log.Println("Matched player", ticket.Player.GetId(), "into game", g.GetId())
+		w.movePlayerToGame(ticket.Player, info, g, false)
+		w.sendWorldUpdate(ticket.Player, info)
+		ratings[g].add(ticket.Rating)
+	}
+}
+
+// Number of players in a game, and the total of their ratings
+type gameRating struct {
+	players int
+	total   float64
+}
+
+func (r *gameRating) add(rating float64) {
+	r.players++
+	r.total += rating
+}
+
+// Returns the players, and their total rating of each game with players.
+// Built once per matchmaking pass, as looking up ratings locks the
+// profile store.
+func (w *World) gameRatings() map[*Game]*gameRating {
+	ratings := make(map[*Game]*gameRating, len(w.games))
+	for p, info := range w.players {
+		if info.Game == nil || info.Spectator {
+			continue
+		}
+		r := ratings[info.Game]
+		if r == nil {
+			r = &gameRating{}
+			ratings[info.Game] = r
+		}
+		r.add(w.playerRating(p))
+	}
+	return ratings
+}
+
+// Returns the games of the type a waiting player could be placed in,
+// which are the games with players that aren't full, along with the
+// average rating of their players.
+func matchCandidates(games []*Game, ratings map[*Game]*gameRating, gameType *GameType) []MatchCandidate {
+	candidates := make([]MatchCandidate, 0, len(games))
+	for _, g := range games {
+		if g.gameType.Name != gameType.Name {
+			continue
+		}
+		r := ratings[g]
+		if r != nil && r.players != 0 && r.players < g.gameType.Players {
+			candidates = append(candidates, MatchCandidate{Game: g, Rating: r.total / float64(r.players)})
+		}
+	}
+	return candidates
+}
 
-	return w.addNewGame(gameType)
+// Returns the player's rating from their profile. Guests, and players
+// without a profile have the default rating.
+func (w *World) playerRating(p *Player) float64 {
+	account := p.GetAccount()
+	if w.Profiles == nil || account.Guest || len(account.Id) == 0 {
+		return DefaultRating
+	}
+	if profile := w.Profiles.Get(account.Id); profile != nil {
+		return profile.GetRating()
+	}
+	return DefaultRating
 }
 
 // Creates a new game and adds it to the list of games. The
 // newly created game is also returned.
 func (w *World) addNewGame(gameType *GameType) *Game {
-	g := NewGame(w.nextGameId, gameType)
+	seed := time.Now().UnixNano() & maxGameSeed
+	g := NewGame(w.nextGameId, gameType, seed, w.gameEnded)
 	w.nextGameId++
+	if w.GameStep != 0 {
+		g.SetStepDelay(w.GameStep)
+	}
+	if w.Profiles != nil {
+		g.SetProfileStore(w.Profiles)
+	}
+	if w.Leaderboards != nil {
+		g.SetLeaderboards(w.Leaderboards)
+	}
+	log.Println("Created game", g.GetId(), "of type", gameType.Name, "with seed", seed)
+
+	if len(w.ReplayDir) != 0 {
+		name := fmt.Sprintf("game-%d-%d.replay", time.Now().Unix(), g.GetId())
+		recorder, err := NewReplayRecorder(filepath.Join(w.ReplayDir, name), g)
+		if err != nil {
+			log.Println("Failed to create replay for game", g.GetId(), err)
+		} else {
+			g.SetRecorder(recorder)
+		}
+	}
 	w.games = append(w.games, g)
 	go g.Run()
 
 	return g
 }
 
-// Remvoes a game from the world's list of available games
+// Remvoes a game from the world's list of available games. Players
+// still in the game are moved back to the lobby, and the game's event
+// loop is terminated.
 func (w *World) removeGame(g *Game) {
-	// TODO remove all players from a game, and terminate the game
+	idx := -1
+	for i, game := range w.games {
+		if game == g {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		// The game was already removed
+		return
+	}
+	copy(w.games[idx:], w.games[idx+1:])
+	w.games[len(w.games)-1] = nil
+	w.games = w.games[:len(w.games)-1]
+	w.chat.RemoveChannel(g)
+
+	for p, info := range w.players {
+		if info.Game == g {
+			w.movePlayerToGame(p, info, nil, false)
+			w.sendWorldUpdate(p, info)
+		}
+	}
+
+	log.Println("Removing game", g.GetId())
+	g.Quit()
+}
+
+// Applies the config's game types, game, chat, and player settings to the
+// world. Games and players which already exist keep their settings.
+// Must only be called before the world is run, use Reconfigure after.
+func (w *World) Configure(cfg *Config) error {
+	gameTypes, err := cfg.GameTypeRegistry()
+	if err != nil {
+		return err
+	}
+	w.gameTypes = gameTypes
+	w.GameStep = cfg.Game.Step.Duration()
+	w.matchmaker.SetRules(cfg.MatchmakingRules())
+	w.chat.SetSettings(cfg.ChatSettings())
+	w.SessionGrace = cfg.Game.SessionGrace.Duration()
+	w.httpHndlr.SetPlayerLimits(cfg.PlayerLimits())
+	return nil
+}
+
+// Reconfigures the running world with the config. Ignored once the
+// world has shut down.
+func (w *World) Reconfigure(cfg *Config) {
+	select {
+	case w.reconfigure <- cfg:
+	case <-w.done:
+	}
+}
+
+// Starts shutting down the world. The world will shut down once the
+// drain time passes, or every game has finished its current round,
+// whichever happens first. The world will no longer accept new players,
+// and the players in it can't join or create games.
+func (w *World) Shutdown(drain time.Duration) {
+	select {
+	case w.shutdown <- drain:
+	case <-w.done:
+	}
+}
+
+// Stops accepting new players, tells the players the server is shutting
+// down, and lets every game know to end after its current round.
+func (w *World) beginDrain(drain time.Duration) {
+	if w.draining {
+		return
+	}
+	log.Println("World draining for", drain)
+	w.draining = true
+	w.drainEnds = time.Now().Add(drain)
+	w.httpHndlr.Drain()
+
+	msg := MsgCreateShutdown(drain)
+	for p, _ := range w.players {
+		p.SendToPlayer(msg)
+	}
+	for _, g := range w.games {
+		g.Control(GameControlDrain)
+	}
+}
+
+// Terminates all games, waiting for their replays to be written, and
+// closes the connections of all players.
+func (w *World) closeAll() {
+	for _, g := range w.games {
+		g.Quit()
+	}
+	for _, g := range w.games {
+		g.Wait()
+	}
+	for p, info := range w.players {
+		if info.Conn != nil {
+			info.Conn.Kick(CloseCodeShutdown, "Server shutting down")
+		}
+		p.Disconnect()
+	}
+	w.httpHndlr.Shutdown()
+	log.Println("World shut down")
+}
+
+// Publishes the number of players, and games of each type in the world
+// to the server's metrics. Called every second rather than per event.
+func (w *World) publishMetrics() {
+	players, detached := 0, 0
+	for _, info := range w.players {
+		if info.Conn == nil {
+			detached++
+		} else {
+			players++
+		}
+	}
+
+	games := make(map[string]int)
+	for _, gameType := range w.gameTypes.List() {
+		games[gameType.Name] = 0
+	}
+	for _, g := range w.games {
+		games[g.gameType.Name]++
+	}
+	serverMetrics.SetWorld(players, detached, games)
 }
 
 // Removes a player from the world and all games they are connected to
 func (w *World) unregisterPlayer(p *Player) error {
 	var rtrn error = nil
 	info := w.players[p]
+	w.matchmaker.Cancel(p)
 	if info != nil {
 		if info.Game != nil {
 			info.Game.RmPlayer <- p
 		}
+		if key := info.muteKey(p); !strings.HasPrefix(key, "account:") {
+			// Guests can't be recognized again once gone
+			delete(w.muted, key)
+		}
+		delete(w.sessions, info.Session)
 		delete(w.players, p)
 	} else {
 		rtrn = WorldErrorPlayerNotRegistered